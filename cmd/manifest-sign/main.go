@@ -0,0 +1,85 @@
+// Command manifest-sign signs launcher release manifests offline, so the
+// release key does not have to live on the API server.
+//
+//	manifest-sign -genkey
+//	    prints a new base64 Ed25519 private key (seed) and its public key
+//	manifest-sign -key release.key envelope.txt
+//	    prints the base64 signature of the envelope
+//
+// Fetch the envelope of a release on a channel with
+// GET /api/admin/launcher/releases/{version}/manifest?channel={name}, sign it
+// and upload the signature with
+// PUT /api/admin/launcher/releases/{version}/signature, along with the channel
+// and the X-Manifest-Issued-At and X-Manifest-Expires-At values the envelope
+// came with. Add the public key to MANIFEST_PUBLIC_KEYS on the server and pin
+// it in the launcher.
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+func main() {
+	genkey := flag.Bool("genkey", false, "generate a new signing key")
+	keyFile := flag.String("key", "", "file with the base64 private key")
+	flag.Parse()
+	log.SetFlags(0)
+
+	if *genkey {
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("private key:", base64.StdEncoding.EncodeToString(priv.Seed()))
+		fmt.Println("public key: ", base64.StdEncoding.EncodeToString(pub))
+		fmt.Println("key id:     ", keyID(pub))
+		return
+	}
+
+	if *keyFile == "" {
+		log.Fatal("usage: manifest-sign -genkey | manifest-sign -key FILE [MANIFEST]")
+	}
+	encoded, err := os.ReadFile(*keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		log.Fatal("the key file must hold a base64 Ed25519 seed as printed by -genkey")
+	}
+	priv := ed25519.NewKeyFromSeed(seed)
+
+	// The signature covers the exact bytes the server returned, so the
+	// manifest is read as is and never re-encoded.
+	in := io.Reader(os.Stdin)
+	if flag.NArg() > 0 {
+		file, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		in = file
+	}
+	manifest, err := io.ReadAll(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("signing %d bytes with key %s", len(manifest), keyID(priv.Public().(ed25519.PublicKey)))
+	fmt.Println(base64.StdEncoding.EncodeToString(ed25519.Sign(priv, manifest)))
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/joho/godotenv"
 )
@@ -17,6 +19,62 @@ type AppConfig struct {
 	TurnstileSecret string
 	ResendApiKey    string
 	EmailSender     string
+	KeyPrefix       string
+	KeyGroupLength  int
+	KeyGroups       int
+	TrustProxy      bool
+
+	RedeemWindowMinutes int
+	RedeemUserLimit     int
+	RedeemIPLimit       int
+	RedeemCaptchaAfter  int
+	RedeemBlockAfter    int
+	RedeemBlockMinutes  int
+
+	TrialDays       int
+	TrialProductIDs []int
+
+	GiftDailyLimit     int
+	ReferralRewardDays int
+
+	ReminderOffsetsDays     []int
+	ReminderIntervalMinutes int
+	SiteURL                 string
+	PublicURL               string
+	UploadDir               string
+	GameFilesDir            string
+	ManifestScanSeconds     int
+	LauncherProductIDs      []int
+
+	ManifestSigningKey       string
+	ManifestPublicKeys       []string
+	ManifestRequireSignature bool
+	ManifestSignatureDays    int
+
+	PatchMaxFileMB   int
+	PatchChainLength int
+
+	StorageBackend        string
+	DownloadURLSecret     string
+	DownloadBaseURL       string
+	DownloadURLTTLSeconds int
+	S3Endpoint            string
+	S3Region              string
+	S3Bucket              string
+	S3AccessKey           string
+	S3SecretKey           string
+	S3Prefix              string
+	S3PathStyle           bool
+
+	PaymentProvider     string
+	PaymentCurrency     string
+	StripeSecretKey     string
+	StripeWebhookSecret string
+	FakePaymentSecret   string
+	OrderExpiryMinutes  int
+	WalletTopUpMax      int
+
+	AlertEmails []string
 }
 
 var Cfg *AppConfig
@@ -36,9 +94,123 @@ func LoadConfig() {
 		TurnstileSecret: os.Getenv("TURNSTILE_SECRET_KEY"),
 		ResendApiKey:    os.Getenv("RESEND_API_KEY"),
 		EmailSender:     os.Getenv("EMAIL_SENDER"),
+		KeyPrefix:       os.Getenv("KEY_PREFIX"),
+		KeyGroupLength:  getEnvInt("KEY_GROUP_LENGTH", 5),
+		KeyGroups:       getEnvInt("KEY_GROUPS", 5),
+		TrustProxy:      os.Getenv("TRUST_PROXY_HEADERS") == "true",
+
+		RedeemWindowMinutes: getEnvInt("REDEEM_WINDOW_MINUTES", 15),
+		RedeemUserLimit:     getEnvInt("REDEEM_USER_LIMIT", 10),
+		RedeemIPLimit:       getEnvInt("REDEEM_IP_LIMIT", 30),
+		RedeemCaptchaAfter:  getEnvInt("REDEEM_CAPTCHA_AFTER", 3),
+		RedeemBlockAfter:    getEnvInt("REDEEM_BLOCK_AFTER", 10),
+		RedeemBlockMinutes:  getEnvInt("REDEEM_BLOCK_MINUTES", 60),
+
+		TrialDays:       getEnvInt("TRIAL_DAYS", 3),
+		TrialProductIDs: getEnvIntList("TRIAL_PRODUCT_IDS"),
+
+		GiftDailyLimit:     getEnvInt("GIFT_DAILY_LIMIT", 3),
+		ReferralRewardDays: getEnvInt("REFERRAL_REWARD_DAYS", 7),
+
+		ReminderOffsetsDays:     getEnvIntList("REMINDER_OFFSETS_DAYS"),
+		ReminderIntervalMinutes: getEnvInt("REMINDER_INTERVAL_MINUTES", 60),
+		SiteURL:                 os.Getenv("SITE_URL"),
+		PublicURL:               os.Getenv("PUBLIC_URL"),
+		UploadDir:               os.Getenv("UPLOAD_DIR"),
+		GameFilesDir:            os.Getenv("GAME_FILES_DIR"),
+		ManifestScanSeconds:     getEnvInt("MANIFEST_SCAN_SECONDS", 30),
+		LauncherProductIDs:      getEnvIntList("LAUNCHER_PRODUCT_IDS"),
+
+		ManifestSigningKey:       os.Getenv("MANIFEST_SIGNING_KEY"),
+		ManifestPublicKeys:       getEnvList("MANIFEST_PUBLIC_KEYS"),
+		ManifestRequireSignature: os.Getenv("MANIFEST_REQUIRE_SIGNATURE") == "true",
+		ManifestSignatureDays:    getEnvInt("MANIFEST_SIGNATURE_DAYS", 7),
+
+		PatchMaxFileMB:   getEnvInt("PATCH_MAX_FILE_MB", 512),
+		PatchChainLength: getEnvInt("PATCH_CHAIN_LENGTH", 5),
+
+		StorageBackend:        os.Getenv("STORAGE_BACKEND"),
+		DownloadURLSecret:     os.Getenv("DOWNLOAD_URL_SECRET"),
+		DownloadBaseURL:       os.Getenv("DOWNLOAD_BASE_URL"),
+		DownloadURLTTLSeconds: getEnvInt("DOWNLOAD_URL_TTL_SECONDS", 900),
+		S3Endpoint:            os.Getenv("S3_ENDPOINT"),
+		S3Region:              os.Getenv("S3_REGION"),
+		S3Bucket:              os.Getenv("S3_BUCKET"),
+		S3AccessKey:           os.Getenv("S3_ACCESS_KEY"),
+		S3SecretKey:           os.Getenv("S3_SECRET_KEY"),
+		S3Prefix:              os.Getenv("S3_PREFIX"),
+		S3PathStyle:           os.Getenv("S3_PATH_STYLE") == "true",
+
+		PaymentProvider:     os.Getenv("PAYMENT_PROVIDER"),
+		PaymentCurrency:     os.Getenv("PAYMENT_CURRENCY"),
+		StripeSecretKey:     os.Getenv("STRIPE_SECRET_KEY"),
+		StripeWebhookSecret: os.Getenv("STRIPE_WEBHOOK_SECRET"),
+		FakePaymentSecret:   os.Getenv("FAKE_PAYMENT_SECRET"),
+		OrderExpiryMinutes:  getEnvInt("ORDER_EXPIRY_MINUTES", 60),
+		WalletTopUpMax:      getEnvInt("WALLET_TOP_UP_MAX", 100000),
+
+		AlertEmails: getEnvList("ALERT_EMAILS"),
 	}
 
 	if Cfg.Port == "" {
 		Cfg.Port = ":8080"
 	}
-}
\ No newline at end of file
+	if len(Cfg.ReminderOffsetsDays) == 0 {
+		Cfg.ReminderOffsetsDays = []int{3, 1}
+	}
+	if Cfg.SiteURL == "" {
+		Cfg.SiteURL = "http://localhost:3000"
+	}
+	if Cfg.PublicURL == "" {
+		Cfg.PublicURL = "http://localhost" + Cfg.Port
+	}
+	if Cfg.UploadDir == "" {
+		Cfg.UploadDir = "./uploads"
+	}
+	if Cfg.GameFilesDir == "" {
+		Cfg.GameFilesDir = "./game_files"
+	}
+	if Cfg.StorageBackend == "" {
+		Cfg.StorageBackend = "local"
+	}
+	if Cfg.DownloadBaseURL == "" {
+		Cfg.DownloadBaseURL = Cfg.PublicURL + "/api/launcher/files"
+	}
+	if Cfg.S3Region == "" {
+		Cfg.S3Region = "us-east-1"
+	}
+	if Cfg.PaymentCurrency == "" {
+		Cfg.PaymentCurrency = "RUB"
+	}
+}
+
+func getEnvInt(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// getEnvIntList parses a comma-separated list of integers, skipping entries
+// that are not numbers.
+func getEnvIntList(name string) []int {
+	var values []int
+	for _, part := range strings.Split(os.Getenv(name), ",") {
+		if value, err := strconv.Atoi(strings.TrimSpace(part)); err == nil {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// getEnvList parses a comma-separated list, dropping empty entries.
+func getEnvList(name string) []string {
+	var values []string
+	for _, part := range strings.Split(os.Getenv(name), ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			values = append(values, part)
+		}
+	}
+	return values
+}
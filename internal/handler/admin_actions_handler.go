@@ -2,13 +2,17 @@ package handler
 
 import (
 	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
 	"astralis.backend/internal/model"
-	"crypto/rand"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
+	"io"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func AdminUpdateUserStatusHandler(w http.ResponseWriter, r *http.Request) {
@@ -20,25 +24,68 @@ func AdminUpdateUserStatusHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var req struct {
-		IsBanned  *bool `json:"is_banned"`
-		ResetSub  *bool `json:"reset_subscription"`
-		ResetHwid *bool `json:"reset_hwid"`
+		IsBanned  *bool   `json:"is_banned"`
+		ResetSub  *bool   `json:"reset_subscription"`
+		ResetHwid *bool   `json:"reset_hwid"`
+		Reason    string  `json:"reason"`
+		Trial     *string `json:"trial"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
 		return
 	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.ResetSub != nil && *req.ResetSub && req.Reason == "" {
+		http.Error(w, `{"error":"A reason is required to reset a subscription"}`, http.StatusBadRequest)
+		return
+	}
 	
-	if req.IsBanned != nil {
-		_, err = database.DB.Exec("UPDATE users SET is_banned = ? WHERE id = ?", *req.IsBanned, userID)
+	var trialOverride *string
+	if req.Trial != nil {
+		switch *req.Trial {
+		case model.TrialOverrideGrant, model.TrialOverrideDeny:
+			trialOverride = req.Trial
+		case "default":
+		default:
+			http.Error(w, `{"error":"Trial must be grant, deny or default"}`, http.StatusBadRequest)
+			return
+		}
 	}
-	if req.ResetSub != nil && *req.ResetSub {
-		_, err = database.DB.Exec("UPDATE users SET subscription_expires_at = NULL WHERE id = ?", userID)
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow("SELECT id FROM users WHERE id = ? FOR UPDATE", userID).Scan(&userID); err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Failed to update user"}`, http.StatusInternalServerError)
+		return
+	}
+	if req.IsBanned != nil && err == nil {
+		_, err = tx.Exec("UPDATE users SET is_banned = ? WHERE id = ?", *req.IsBanned, userID)
+	}
+	if req.Trial != nil && err == nil {
+		_, err = tx.Exec("UPDATE users SET trial_override = ? WHERE id = ?", trialOverride, userID)
+	}
+	if req.ResetSub != nil && *req.ResetSub && err == nil {
+		err = resetGlobalSubscription(tx, r, userID, req.Reason)
+	}
+	if req.ResetHwid != nil && *req.ResetHwid && err == nil {
+		_, err = tx.Exec("UPDATE users SET hwid = NULL WHERE id = ?", userID)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM user_devices WHERE user_id = ?", userID)
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
 	}
-    if req.ResetHwid != nil && *req.ResetHwid {
-        _, err = database.DB.Exec("UPDATE users SET hwid = NULL WHERE id = ?", userID)
-    }
 
 	if err != nil {
 		http.Error(w, `{"error":"Failed to update user"}`, http.StatusInternalServerError)
@@ -57,14 +104,50 @@ func AdminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = database.DB.Exec("DELETE FROM activation_keys WHERE used_by_user_id = ?", userID)
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM activation_keys WHERE used_by_user_id = ?", userID)
 	if err != nil {
 		http.Error(w, `{"error":"Failed to delete user's keys"}`, http.StatusInternalServerError)
 		return
 	}
 	
-	_, err = database.DB.Exec("DELETE FROM users WHERE id = ?", userID)
+	_, err = tx.Exec("DELETE FROM subscriptions WHERE user_id = ?", userID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to delete user's subscriptions"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM user_devices WHERE user_id = ?", userID)
 	if err != nil {
+		http.Error(w, `{"error":"Failed to delete user's devices"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM referrals WHERE referrer_id = ? OR referred_id = ?", userID, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to delete user's referrals"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM release_channel_members WHERE user_id = ?", userID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to delete user's channel memberships"}`, http.StatusInternalServerError)
+		return
+	}
+
+	_, err = tx.Exec("DELETE FROM users WHERE id = ?", userID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to delete user"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
 		http.Error(w, `{"error":"Failed to delete user"}`, http.StatusInternalServerError)
 		return
 	}
@@ -73,18 +156,16 @@ func AdminDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"message": "User deleted successfully"})
 }
 
-func generateActivationKey() (string, error) {
-	bytes := make([]byte, 16)
-	if _, err := rand.Read(bytes); err != nil {
-		return "", err
-	}
-	return fmt.Sprintf("%X-%X-%X-%X", bytes[0:4], bytes[4:8], bytes[8:12], bytes[12:16]), nil
-}
-
 func AdminCreateKeyHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
-		DurationDays int `json:"duration_days"`
-		Quantity     int `json:"quantity"`
+		KeyType      string  `json:"key_type"`
+		DurationDays int     `json:"duration_days"`
+		ProductID    *int    `json:"product_id"`
+		GrantRole    *string `json:"grant_role"`
+		Quantity     int     `json:"quantity"`
+		Prefix       string  `json:"prefix"`
+		GroupLength  int     `json:"group_length"`
+		Groups       int     `json:"groups"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
@@ -95,8 +176,30 @@ func AdminCreateKeyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"Duration cannot be negative"}`, http.StatusBadRequest)
 		return
 	}
+	if req.KeyType == "" {
+		// Older admin clients create HWID reset keys by sending a zero duration.
+		req.KeyType = model.KeyTypeSubscription
+		if req.DurationDays == 0 {
+			req.KeyType = model.KeyTypeHwidReset
+		}
+	}
+	kt, ok := keyTypes[req.KeyType]
+	if !ok {
+		http.Error(w, `{"error":"Unknown key type"}`, http.StatusBadRequest)
+		return
+	}
+	params := keyParams{DurationDays: req.DurationDays, ProductID: req.ProductID, GrantRole: req.GrantRole}
+	if err := kt.validate(params); err != nil {
+		writeKeyError(w, err, "Failed to validate key parameters")
+		return
+	}
+	format, err := resolveKeyFormat(req.Prefix, req.GroupLength, req.Groups, req.ProductID)
+	if err != nil {
+		writeKeyError(w, err, "Failed to validate key format")
+		return
+	}
 	if req.Quantity <= 0 || req.Quantity > 100 {
-		http.Error(w, `{"error":"Quantity must be between 1 and 100"}`, http.StatusBadRequest)
+		http.Error(w, `{"error":"Quantity must be between 1 and 100, use /api/admin/key-jobs for larger batches"}`, http.StatusBadRequest)
 		return
 	}
 
@@ -106,7 +209,7 @@ func AdminCreateKeyHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO activation_keys (key_string, duration_days) VALUES (?, ?)"
+	query := "INSERT INTO activation_keys (key_string, key_type, duration_days, product_id, grant_role) VALUES (?, ?, ?, ?, ?)"
 	stmt, err := tx.Prepare(query)
 	if err != nil {
 		tx.Rollback()
@@ -116,13 +219,13 @@ func AdminCreateKeyHandler(w http.ResponseWriter, r *http.Request) {
 	defer stmt.Close()
 
 	for i := 0; i < req.Quantity; i++ {
-		newKey, err := generateActivationKey()
+		newKey, err := generateActivationKey(format)
 		if err != nil {
 			tx.Rollback()
 			http.Error(w, `{"error":"Failed to generate key"}`, http.StatusInternalServerError)
 			return
 		}
-		_, err = stmt.Exec(newKey, req.DurationDays)
+		_, err = stmt.Exec(newKey, req.KeyType, req.DurationDays, req.ProductID, req.GrantRole)
 		if err != nil {
 			tx.Rollback()
 			http.Error(w, `{"error":"Failed to save key to database"}`, http.StatusInternalServerError)
@@ -139,7 +242,11 @@ func AdminCreateKeyHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf("%d keys created successfully", req.Quantity)})
 }
 
+// productPutFields are the product fields a PUT must send.
+var productPutFields = []string{"name", "description", "price", "is_featured", "sort_index", "duration_days", "slug", "image_url", "currency", "status", "duration_options"}
 
+// AdminUpdateProductHandler changes a product: PUT replaces all of it, PATCH
+// only the fields sent.
 func AdminUpdateProductHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	productID, err := strconv.Atoi(vars["id"])
@@ -148,18 +255,95 @@ func AdminUpdateProductHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var p model.Product
-	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
-		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+	p, err := loadProduct(productID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Product not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get product"}`, http.StatusInternalServerError)
 		return
 	}
 
-	query := "UPDATE products SET name = ?, description = ?, price = ?, is_featured = ? WHERE id = ?"
-	_, err = database.DB.Exec(query, p.Name, p.Description, p.Price, p.IsFeatured, productID)
+	if r.Method == http.MethodPut {
+		// PUT replaces the whole product and must send all of it; only the
+		// key prefix and translations may be left out, meaning none.
+		body, err := io.ReadAll(r.Body)
+		var fields map[string]json.RawMessage
+		if err != nil || json.Unmarshal(body, &fields) != nil {
+			http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		missing := fieldErrors{}
+		for _, name := range productPutFields {
+			if _, ok := fields[name]; !ok {
+				missing[name] = "Field is required"
+			}
+		}
+		if len(missing) > 0 {
+			writeFieldErrors(w, "PUT needs the whole product; use PATCH to change some fields", missing, http.StatusBadRequest)
+			return
+		}
+		p = model.Product{}
+		if err := json.Unmarshal(body, &p); err != nil {
+			http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+	} else {
+		// PATCH keeps the stored value of fields the request leaves out.
+		// Lists and maps in the body replace the stored ones rather than
+		// merging into them, so options and translations can be removed.
+		options, translations := p.DurationOptions, p.Translations
+		p.DurationOptions, p.Translations = nil, nil
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		if p.DurationOptions == nil {
+			p.DurationOptions = options
+		}
+		if p.Translations == nil {
+			p.Translations = translations
+		}
+	}
+	p.ID = productID
+
+	if errs := normalizeProduct(&p); errs != nil {
+		writeFieldErrors(w, "Invalid product", errs, http.StatusBadRequest)
+		return
+	}
+	taken, err := productSlugTaken(p.Slug, p.ID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to check slug"}`, http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		writeFieldErrors(w, "Invalid product", fieldErrors{"slug": "Slug is already used by another product"}, http.StatusConflict)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE products SET name = ?, description = ?, price = ?, is_featured = ?, sort_index = ?, key_prefix = NULLIF(?, ''), duration_days = ?,
+		slug = NULLIF(?, ''), image_url = NULLIF(?, ''), currency = NULLIF(?, ''), status = ? WHERE id = ?`
+	_, err = tx.Exec(query, p.Name, p.Description, p.Price, p.IsFeatured, p.SortIndex, p.KeyPrefix, p.DurationDays, p.Slug, p.ImageURL, p.Currency, p.Status, productID)
 	if err != nil {
 		http.Error(w, `{"error":"Failed to update product"}`, http.StatusInternalServerError)
 		return
 	}
+	if err := saveProductDetails(tx, p); err != nil {
+		writeKeyError(w, err, "Failed to save product details")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
 	
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Product updated successfully"})
@@ -173,12 +357,49 @@ func AdminDeleteProductHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = database.DB.Exec("DELETE FROM products WHERE id = ?", productID)
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("DELETE FROM product_duration_options WHERE product_id = ?", productID)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM product_translations WHERE product_id = ?", productID)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM products WHERE id = ?", productID)
+	}
 	if err != nil {
 		http.Error(w, `{"error":"Failed to delete product"}`, http.StatusInternalServerError)
 		return
 	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(map[string]string{"message": "Product deleted successfully"})
+}
+
+// resetGlobalSubscription clears the global subscription, drops any freeze on
+// it and records the change in the subscription history.
+func resetGlobalSubscription(tx *sql.Tx, r *http.Request, userID int, reason string) error {
+	claims, _ := middleware.GetClaimsFromContext(r)
+	adminID, _ := strconv.Atoi(claims.Subject)
+	uid := strconv.Itoa(userID)
+
+	oldEnd, err := subscriptionEnd(tx, uid, nil)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE users SET subscription_expires_at = NULL WHERE id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE subscription_freezes SET unfrozen_at = ? WHERE user_id = ? AND product_id IS NULL AND unfrozen_at IS NULL", time.Now(), userID); err != nil {
+		return err
+	}
+	return recordSubscriptionAdjustment(tx, uid, nil, &adminID, model.SubscriptionActionReset, nil, oldEnd, nil, reason)
 }
\ No newline at end of file
@@ -39,7 +39,7 @@ func AdminGetUsersHandler(w http.ResponseWriter, r *http.Request) {
 		totalPages = 1
 	}
 
-	selectQuery := "SELECT id, username, email, role, subscription_expires_at, is_banned, hwid FROM users WHERE username LIKE ? OR email LIKE ? ORDER BY id DESC LIMIT ? OFFSET ?"
+	selectQuery := "SELECT id, username, email, role, subscription_expires_at, is_banned, hwid, trial_override FROM users WHERE username LIKE ? OR email LIKE ? ORDER BY id DESC LIMIT ? OFFSET ?"
 	rows, err := database.DB.Query(selectQuery, searchPattern, searchPattern, limit, offset)
 	if err != nil {
 		http.Error(w, `{"error":"Failed to query users"}`, http.StatusInternalServerError)
@@ -50,9 +50,9 @@ func AdminGetUsersHandler(w http.ResponseWriter, r *http.Request) {
 	users := make([]model.UserForAdmin, 0)
 	for rows.Next() {
 		var user model.UserForAdmin
-		var email, role, hwid sql.NullString
+		var email, role, hwid, trialOverride sql.NullString
 		var expiresAt sql.NullTime
-		if err := rows.Scan(&user.ID, &user.Username, &email, &role, &expiresAt, &user.IsBanned, &hwid); err != nil {
+		if err := rows.Scan(&user.ID, &user.Username, &email, &role, &expiresAt, &user.IsBanned, &hwid, &trialOverride); err != nil {
 			http.Error(w, `{"error":"Failed to scan user row"}`, http.StatusInternalServerError)
 			return
 		}
@@ -60,6 +60,7 @@ func AdminGetUsersHandler(w http.ResponseWriter, r *http.Request) {
 		if role.Valid { user.Role = role.String } else { user.Role = "user" }
 		if expiresAt.Valid { user.SubscriptionExpiresAt = &expiresAt.Time }
 		if hwid.Valid { user.Hwid = &hwid.String }
+		if trialOverride.Valid { user.TrialOverride = &trialOverride.String }
 		users = append(users, user)
 	}
 
@@ -99,7 +100,7 @@ func AdminGetKeysHandler(w http.ResponseWriter, r *http.Request) {
 		totalPages = 1
 	}
 
-	rows, err := database.DB.Query("SELECT id, key_string, duration_days, is_used, used_by_user_id, used_at FROM activation_keys ORDER BY id DESC LIMIT ? OFFSET ?", limit, offset)
+	rows, err := database.DB.Query("SELECT id, key_string, key_type, duration_days, product_id, grant_role, is_used, used_by_user_id, used_at FROM activation_keys ORDER BY id DESC LIMIT ? OFFSET ?", limit, offset)
 	if err != nil {
 		http.Error(w, `{"error":"Failed to query keys"}`, http.StatusInternalServerError)
 		return
@@ -109,10 +110,11 @@ func AdminGetKeysHandler(w http.ResponseWriter, r *http.Request) {
 	keys := make([]model.KeyForAdmin, 0)
 	for rows.Next() {
 		var key model.KeyForAdmin
-		var usedBy sql.NullInt64
+		var usedBy, productID sql.NullInt64
+		var grantRole sql.NullString
 		var usedAt sql.NullTime
 
-		if err := rows.Scan(&key.ID, &key.KeyString, &key.DurationDays, &key.IsUsed, &usedBy, &usedAt); err != nil {
+		if err := rows.Scan(&key.ID, &key.KeyString, &key.KeyType, &key.DurationDays, &productID, &grantRole, &key.IsUsed, &usedBy, &usedAt); err != nil {
 			http.Error(w, `{"error":"Failed to scan key row"}`, http.StatusInternalServerError)
 			return
 		}
@@ -123,6 +125,13 @@ func AdminGetKeysHandler(w http.ResponseWriter, r *http.Request) {
 		if usedAt.Valid {
 			key.UsedAt = &usedAt.Time
 		}
+		if productID.Valid {
+			tempID := int(productID.Int64)
+			key.ProductID = &tempID
+		}
+		if grantRole.Valid {
+			key.GrantRole = &grantRole.String
+		}
 		keys = append(keys, key)
 	}
 	
@@ -137,19 +146,62 @@ func AdminGetKeysHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func AdminCreateProductHandler(w http.ResponseWriter, r *http.Request) {
-	var p model.Product
+	// New products go to the end of the store unless a sort index is sent.
+	sortIndex, err := nextProductSortIndex()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query products"}`, http.StatusInternalServerError)
+		return
+	}
+	p := model.Product{DurationDays: 30, SortIndex: sortIndex}
 	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
 		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
 		return
 	}
 
-	query := "INSERT INTO products (name, description, price, is_featured) VALUES (?, ?, ?, ?)"
-	_, err := database.DB.Exec(query, p.Name, p.Description, p.Price, p.IsFeatured)
+	// A new product has no options yet for IDs to refer to.
+	for i := range p.DurationOptions {
+		p.DurationOptions[i].ID = 0
+	}
+	if errs := normalizeProduct(&p); errs != nil {
+		writeFieldErrors(w, "Invalid product", errs, http.StatusBadRequest)
+		return
+	}
+	taken, err := productSlugTaken(p.Slug, 0)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to check slug"}`, http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		writeFieldErrors(w, "Invalid product", fieldErrors{"slug": "Slug is already used by another product"}, http.StatusConflict)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO products (name, description, price, is_featured, sort_index, key_prefix, duration_days, slug, image_url, currency, status)
+		VALUES (?, ?, ?, ?, ?, NULLIF(?, ''), ?, NULLIF(?, ''), NULLIF(?, ''), NULLIF(?, ''), ?)`
+	res, err := tx.Exec(query, p.Name, p.Description, p.Price, p.IsFeatured, p.SortIndex, p.KeyPrefix, p.DurationDays, p.Slug, p.ImageURL, p.Currency, p.Status)
 	if err != nil {
 		http.Error(w, `{"error":"Failed to create product"}`, http.StatusInternalServerError)
 		return
 	}
+	id, _ := res.LastInsertId()
+	p.ID = int(id)
+	if err := saveProductDetails(tx, p); err != nil {
+		writeKeyError(w, err, "Failed to save product details")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"message": "Product created successfully"})
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": p.ID, "message": "Product created successfully"})
 }
\ No newline at end of file
@@ -0,0 +1,343 @@
+package handler
+
+import (
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// maxAdjustmentDays bounds the days added or removed in one adjustment, a
+// hundred years.
+const maxAdjustmentDays = 36500
+
+// AdminAdjustSubscriptionHandler applies one manual change to a user's global
+// subscription, or to a product subscription when product_id is given. The
+// action comes from the URL: add_time, remove_time, set_expiry, lifetime,
+// freeze or unfreeze.
+func AdminAdjustSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	adminID, _ := strconv.Atoi(claims.Subject)
+
+	vars := mux.Vars(r)
+	userID := vars["id"]
+	if _, err := strconv.Atoi(userID); err != nil {
+		http.Error(w, `{"error":"Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+	action := vars["action"]
+
+	var req struct {
+		ProductID *int       `json:"product_id"`
+		Days      int        `json:"days"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		Reason    string     `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, `{"error":"A reason is required"}`, http.StatusBadRequest)
+		return
+	}
+	if req.ProductID != nil {
+		if err := validateProductExists(*req.ProductID); err != nil {
+			writeKeyError(w, err, "Failed to look up product")
+			return
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	oldEnd, err := subscriptionEnd(tx, userID, req.ProductID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get current subscription"}`, http.StatusInternalServerError)
+		return
+	}
+	freezeID, remaining, frozen, err := activeFreeze(tx, userID, req.ProductID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get current subscription"}`, http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	active := oldEnd != nil && oldEnd.After(now)
+	lifetime := oldEnd != nil && !oldEnd.Before(lifetimeExpiry)
+	var newEnd *time.Time
+	var days *int
+
+	switch action {
+	case model.SubscriptionActionAddTime, model.SubscriptionActionRemoveTime:
+		if req.Days <= 0 || req.Days > maxAdjustmentDays {
+			http.Error(w, `{"error":"Days must be between 1 and 36500"}`, http.StatusBadRequest)
+			return
+		}
+		days = &req.Days
+		delta := req.Days
+		if action == model.SubscriptionActionRemoveTime {
+			delta = -delta
+		}
+		if frozen {
+			_, err = tx.Exec("UPDATE subscription_freezes SET remaining_seconds = GREATEST(remaining_seconds + ?, 0) WHERE id = ?", int64(delta)*24*60*60, freezeID)
+			break
+		}
+		if lifetime {
+			http.Error(w, `{"error":"Subscription is lifetime, set an exact expiry instead"}`, http.StatusConflict)
+			return
+		}
+		if action == model.SubscriptionActionRemoveTime && !active {
+			http.Error(w, `{"error":"User has no active subscription"}`, http.StatusConflict)
+			return
+		}
+		end := now
+		if active {
+			end = *oldEnd
+		}
+		end = addDays(end, delta)
+		if end.Before(now) {
+			end = now
+		}
+		newEnd = &end
+
+	case model.SubscriptionActionSetExpiry:
+		if req.ExpiresAt == nil {
+			http.Error(w, `{"error":"expires_at is required"}`, http.StatusBadRequest)
+			return
+		}
+		if frozen {
+			http.Error(w, `{"error":"Subscription is frozen, unfreeze it first"}`, http.StatusConflict)
+			return
+		}
+		newEnd = req.ExpiresAt
+
+	case model.SubscriptionActionLifetime:
+		if frozen {
+			http.Error(w, `{"error":"Subscription is frozen, unfreeze it first"}`, http.StatusConflict)
+			return
+		}
+		newEnd = &lifetimeExpiry
+
+	case model.SubscriptionActionFreeze:
+		if frozen {
+			http.Error(w, `{"error":"Subscription is already frozen"}`, http.StatusConflict)
+			return
+		}
+		if !active || lifetime {
+			http.Error(w, `{"error":"Only an active, time-limited subscription can be frozen"}`, http.StatusConflict)
+			return
+		}
+		_, err = tx.Exec("INSERT INTO subscription_freezes (user_id, product_id, frozen_at, remaining_seconds) VALUES (?, ?, ?, ?)",
+			userID, req.ProductID, now, int64(oldEnd.Sub(now).Seconds()))
+		newEnd = &now
+
+	case model.SubscriptionActionUnfreeze:
+		if !frozen {
+			http.Error(w, `{"error":"Subscription is not frozen"}`, http.StatusConflict)
+			return
+		}
+		_, err = tx.Exec("UPDATE subscription_freezes SET unfrozen_at = ? WHERE id = ?", now, freezeID)
+		end := time.Unix(now.Unix()+remaining, 0)
+		if end.After(lifetimeExpiry) {
+			end = lifetimeExpiry
+		}
+		newEnd = &end
+
+	default:
+		http.Error(w, `{"error":"Unknown subscription action"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to update subscription"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if newEnd != nil {
+		if err := setSubscriptionEnd(tx, userID, req.ProductID, *newEnd); err != nil {
+			http.Error(w, `{"error":"Failed to update subscription"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := recordSubscriptionAdjustment(tx, userID, req.ProductID, &adminID, action, days, oldEnd, newEnd, req.Reason); err != nil {
+		http.Error(w, `{"error":"Failed to record adjustment"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Subscription updated successfully",
+		"expires_at": newEnd,
+	})
+}
+
+func AdminGetSubscriptionHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	rows, err := database.DB.Query(`SELECT id, user_id, product_id, admin_id, action, days, old_expires_at, new_expires_at, reason, created_at
+		FROM subscription_adjustments WHERE user_id = ? ORDER BY id DESC`, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query subscription history"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := make([]model.SubscriptionAdjustment, 0)
+	for rows.Next() {
+		var a model.SubscriptionAdjustment
+		var productID, adminID, days sql.NullInt64
+		var oldEnd, newEnd sql.NullTime
+		if err := rows.Scan(&a.ID, &a.UserID, &productID, &adminID, &a.Action, &days, &oldEnd, &newEnd, &a.Reason, &a.CreatedAt); err != nil {
+			http.Error(w, `{"error":"Failed to scan adjustment row"}`, http.StatusInternalServerError)
+			return
+		}
+		if productID.Valid {
+			id := int(productID.Int64)
+			a.ProductID = &id
+		}
+		if adminID.Valid {
+			id := int(adminID.Int64)
+			a.AdminID = &id
+		}
+		if days.Valid {
+			d := int(days.Int64)
+			a.Days = &d
+		}
+		if oldEnd.Valid {
+			a.OldExpiresAt = &oldEnd.Time
+		}
+		if newEnd.Valid {
+			a.NewExpiresAt = &newEnd.Time
+		}
+		history = append(history, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// subscriptionEnd returns when the global subscription, or the product
+// subscription when productID is set, runs out. It locks the user row and
+// returns sql.ErrNoRows for an unknown user.
+func subscriptionEnd(tx *sql.Tx, userID string, productID *int) (*time.Time, error) {
+	var globalEnd sql.NullTime
+	err := tx.QueryRow("SELECT subscription_expires_at FROM users WHERE id = ? FOR UPDATE", userID).Scan(&globalEnd)
+	if err != nil {
+		return nil, err
+	}
+	if productID == nil {
+		if !globalEnd.Valid {
+			return nil, nil
+		}
+		return &globalEnd.Time, nil
+	}
+
+	var productEnd sql.NullTime
+	err = tx.QueryRow("SELECT MAX(expires_at) FROM subscriptions WHERE user_id = ? AND product_id = ?", userID, *productID).Scan(&productEnd)
+	if err != nil || !productEnd.Valid {
+		return nil, err
+	}
+	return &productEnd.Time, nil
+}
+
+// setSubscriptionEnd moves the end of a subscription. A product subscription
+// is extended with an admin row, or cut by shortening and dropping the rows
+// past the new end.
+func setSubscriptionEnd(tx *sql.Tx, userID string, productID *int, end time.Time) error {
+	if productID == nil {
+		_, err := tx.Exec("UPDATE users SET subscription_expires_at = ? WHERE id = ?", end, userID)
+		return err
+	}
+
+	current, err := subscriptionEnd(tx, userID, productID)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if current == nil || current.Before(now) {
+		current = &now
+	}
+	if end.After(*current) {
+		return insertSubscription(tx, userID, *productID, *current, end, model.SubscriptionSourceAdmin, nil)
+	}
+
+	if _, err := tx.Exec("DELETE FROM subscriptions WHERE user_id = ? AND product_id = ? AND starts_at >= ? AND expires_at > ?",
+		userID, *productID, end, now); err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE subscriptions SET expires_at = ? WHERE user_id = ? AND product_id = ? AND expires_at > ? AND expires_at > ?",
+		end, userID, *productID, end, now)
+	return err
+}
+
+// activeFreeze returns the open freeze of a subscription, if any.
+func activeFreeze(tx *sql.Tx, userID string, productID *int) (int, int64, bool, error) {
+	var id int
+	var remaining int64
+	err := tx.QueryRow("SELECT id, remaining_seconds FROM subscription_freezes WHERE user_id = ? AND product_id <=> ? AND unfrozen_at IS NULL FOR UPDATE",
+		userID, productID).Scan(&id, &remaining)
+	if err == sql.ErrNoRows {
+		return 0, 0, false, nil
+	}
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return id, remaining, true, nil
+}
+
+// addFrozenTime adds time redeemed while a subscription is frozen to its
+// remaining time instead of the (ended) subscription. It reports whether the
+// subscription was frozen.
+func addFrozenTime(tx *sql.Tx, userID string, productID *int, days int) (bool, error) {
+	id, _, frozen, err := activeFreeze(tx, userID, productID)
+	if err != nil || !frozen {
+		return false, err
+	}
+	_, err = tx.Exec("UPDATE subscription_freezes SET remaining_seconds = remaining_seconds + ? WHERE id = ?", int64(days)*24*60*60, id)
+	return err == nil, err
+}
+
+// endFreeze closes the open freeze of a subscription without giving back its
+// remaining time, for grants such as lifetime access that make it moot.
+// Unfreezing later would otherwise replace the new expiry with the frozen
+// remainder.
+func endFreeze(tx *sql.Tx, userID string, productID *int) error {
+	_, err := tx.Exec("UPDATE subscription_freezes SET unfrozen_at = ? WHERE user_id = ? AND product_id <=> ? AND unfrozen_at IS NULL",
+		time.Now(), userID, productID)
+	return err
+}
+
+func recordSubscriptionAdjustment(tx *sql.Tx, userID string, productID, adminID *int, action string, days *int, oldEnd, newEnd *time.Time, reason string) error {
+	_, err := tx.Exec(`INSERT INTO subscription_adjustments (user_id, product_id, admin_id, action, days, old_expires_at, new_expires_at, reason)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, userID, productID, adminID, action, days, oldEnd, newEnd, reason)
+	return err
+}
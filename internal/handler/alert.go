@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"html"
+	"log"
+	"sync"
+)
+
+// sentAlerts remembers the alerts already sent by this process, by key.
+var sentAlerts sync.Map
+
+// alertAdmins logs a problem that needs a person and emails it to
+// ALERT_EMAILS. Each key is alerted on once per process, so a problem hit by
+// every request does not flood the inboxes.
+func alertAdmins(key, subject, message string) {
+	if _, seen := sentAlerts.LoadOrStore(key, true); seen {
+		return
+	}
+	log.Printf("ALERT: %s: %s", subject, message)
+	for _, to := range config.Cfg.AlertEmails {
+		if err := sendEmail(to, subject, "<p>"+html.EscapeString(message)+"</p>"); err != nil {
+			log.Printf("Failed to send alert to %s: %v", to, err)
+		}
+	}
+}
@@ -11,9 +11,11 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 	"unicode/utf8"
 )
@@ -33,10 +35,27 @@ func generateOneTimeToken() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+func verifyTurnstile(token string) (bool, error) {
+	resp, err := http.PostForm("https://challenges.cloudflare.com/turnstile/v0/siteverify", url.Values{
+		"secret":   {turnstileSecretKey},
+		"response": {token},
+	})
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	var turnstileResp TurnstileResponse
+	json.Unmarshal(body, &turnstileResp)
+	return turnstileResp.Success, nil
+}
+
 func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		model.User
 		TurnstileToken string `json:"turnstileToken"`
+		ReferralCode   string `json:"referral_code"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
@@ -48,21 +67,12 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp, err := http.PostForm("https://challenges.cloudflare.com/turnstile/v0/siteverify", url.Values{
-		"secret":   {turnstileSecretKey},
-		"response": {req.TurnstileToken},
-	})
+	success, err := verifyTurnstile(req.TurnstileToken)
 	if err != nil {
 		http.Error(w, `{"error":"Failed to verify CAPTCHA"}`, http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-
-	body, _ := io.ReadAll(resp.Body)
-	var turnstileResp TurnstileResponse
-	json.Unmarshal(body, &turnstileResp)
-
-	if !turnstileResp.Success {
+	if !success {
 		http.Error(w, `{"error":"CAPTCHA verification failed, please try again"}`, http.StatusForbidden)
 		return
 	}
@@ -76,13 +86,38 @@ func RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var referrerID int64
+	if strings.TrimSpace(req.ReferralCode) != "" {
+		referrerID, err = lookupReferrer(req.ReferralCode)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Unknown referral code"}`, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error":"Failed to check referral code"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
 	hashedPassword, _ := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	ip := clientIP(r)
 	
-	query := "INSERT INTO users (username, email, password_hash, role) VALUES (?, ?, ?, 'user')"
-	if _, err := database.DB.Exec(query, req.Username, req.Email, hashedPassword); err != nil {
+	query := "INSERT INTO users (username, email, password_hash, role, registration_ip) VALUES (?, ?, ?, 'user', ?)"
+	res, err := database.DB.Exec(query, req.Username, req.Email, hashedPassword, ip)
+	if err != nil {
 		http.Error(w, `{"error":"Username or email may already exist."}`, http.StatusInternalServerError)
 		return
 	}
+	userID, _ := res.LastInsertId()
+
+	if _, err := ensureReferralCode(strconv.FormatInt(userID, 10)); err != nil {
+		log.Printf("Could not assign referral code to user %d: %v", userID, err)
+	}
+	if referrerID != 0 {
+		if err := recordReferral(referrerID, userID, ip); err != nil {
+			log.Printf("Could not record referral of user %d: %v", userID, err)
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
@@ -118,10 +153,23 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The address only feeds referral checks; a failure to record it should
+	// not stop the login.
+	if _, err := database.DB.Exec("UPDATE users SET last_login_ip = ? WHERE id = ?", clientIP(r), userID); err != nil {
+		log.Printf("Failed to record login address of user %d: %v", userID, err)
+	}
+
 	if creds.Hwid != "" {
 		if storedHwid.Valid && storedHwid.String != creds.Hwid {
-			http.Error(w, `{"error":"HWID mismatch"}`, http.StatusConflict)
-			return
+			allowed, err := bindExtraDevice(userID, creds.Hwid)
+			if err != nil {
+				http.Error(w, `{"error":"Failed to check device slots"}`, http.StatusInternalServerError)
+				return
+			}
+			if !allowed {
+				http.Error(w, `{"error":"HWID mismatch"}`, http.StatusConflict)
+				return
+			}
 		} else if !storedHwid.Valid {
 			database.DB.Exec("UPDATE users SET hwid = ? WHERE id = ?", creds.Hwid, userID)
 		}
@@ -166,6 +214,37 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// bindExtraDevice reports whether hwid may log in as an additional device of
+// the user, binding it to a free slot from an extra_device_slot key if needed.
+func bindExtraDevice(userID int, hwid string) (bool, error) {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Locking the user row serializes logins from new devices, so concurrent
+	// ones cannot take more slots than the user has.
+	var slots int
+	if err := tx.QueryRow("SELECT extra_device_slots FROM users WHERE id = ? FOR UPDATE", userID).Scan(&slots); err != nil {
+		return false, err
+	}
+	var known bool
+	var bound int
+	err = tx.QueryRow("SELECT COALESCE(SUM(hwid = ?), 0) > 0, COUNT(*) FROM user_devices WHERE user_id = ?", hwid, userID).Scan(&known, &bound)
+	if err != nil || known {
+		return known, err
+	}
+	if bound >= slots {
+		return false, nil
+	}
+
+	if _, err := tx.Exec("INSERT INTO user_devices (user_id, hwid) VALUES (?, ?)", userID, hwid); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
 func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 	claims, ok := middleware.GetClaimsFromContext(r)
 	if !ok {
@@ -178,9 +257,10 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 	var username, email string
 	var role, hwid sql.NullString
 	var subscriptionExpiresAt sql.NullTime
+	var remindersOptOut bool
 
-	query := "SELECT username, email, role, subscription_expires_at, hwid FROM users WHERE id = ?"
-	err := database.DB.QueryRow(query, userID).Scan(&username, &email, &role, &subscriptionExpiresAt, &hwid)
+	query := "SELECT username, email, role, subscription_expires_at, hwid, expiry_reminders_opt_out FROM users WHERE id = ?"
+	err := database.DB.QueryRow(query, userID).Scan(&username, &email, &role, &subscriptionExpiresAt, &hwid, &remindersOptOut)
 	if err != nil {
 		http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
 		return
@@ -192,10 +272,11 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	response := map[string]interface{}{
-		"id":       userID,
-		"username": username,
-		"email":    email,
-		"role":     finalRole,
+		"id":               userID,
+		"username":         username,
+		"email":            email,
+		"role":             finalRole,
+		"expiry_reminders": !remindersOptOut,
 	}
 
 	if subscriptionExpiresAt.Valid {
@@ -210,6 +291,13 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		response["hwid"] = nil
 	}
 
+	entitlements, err := loadEntitlements(userID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to load entitlements"}`, http.StatusInternalServerError)
+		return
+	}
+	response["entitlements"] = entitlements
+
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
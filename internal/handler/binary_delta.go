@@ -0,0 +1,324 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+// Binary deltas turn one version of a file into the next. The format is:
+//
+//	"ASDELTA1"                magic
+//	uvarint                   size of the new file
+//	[32]byte, [32]byte        SHA-256 of the old and the new file
+//	DEFLATE (RFC 1951) stream of operations:
+//	  'C' uvarint off, uvarint n   copy n bytes from the old file at off
+//	  'I' uvarint n, n bytes       insert the bytes
+//	  'E'                          end
+//
+// Matches are found rsync style: the old file is indexed by a rolling
+// checksum of fixed blocks, and matches are extended past block boundaries
+// in both directions.
+
+const (
+	deltaMagic     = "ASDELTA1"
+	deltaBlockSize = 2048
+)
+
+var errBadDelta = errors.New("malformed delta")
+
+// rollingSum is the rsync weak checksum of a window of bytes.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(window []byte) rollingSum {
+	s := rollingSum{n: uint32(len(window))}
+	for i, c := range window {
+		s.a += uint32(c)
+		s.b += uint32(len(window)-i) * uint32(c)
+	}
+	return s
+}
+
+func (s *rollingSum) roll(out, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s rollingSum) sum() uint32 { return s.a&0xffff | s.b<<16 }
+
+// deltaHeader is what a delta records about the files it joins: the size of
+// the new file and the SHA-256 of both.
+type deltaHeader struct {
+	Size   int64
+	OldSum [32]byte
+	NewSum [32]byte
+}
+
+// deltaMaxLiteral bounds the unmatched bytes makeDelta keeps in memory
+// before writing them out.
+const deltaMaxLiteral = 1 << 20
+
+// hashingReader hashes and counts what is read through it.
+type hashingReader struct {
+	r io.Reader
+	h hash.Hash
+	n int64
+}
+
+func (r *hashingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.h.Write(p[:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// makeDelta writes the delta from the old version of a file to the new one,
+// reading the new file once from start to end. The header must describe the
+// files; makeDelta fails if they turn out not to match it.
+func makeDelta(w io.Writer, h deltaHeader, old io.ReaderAt, oldSize int64, new io.Reader) error {
+	index := map[uint32][]int64{}
+	oldHash := sha256.New()
+	or := bufio.NewReaderSize(io.NewSectionReader(old, 0, oldSize), 64<<10)
+	block := make([]byte, deltaBlockSize)
+	for off := int64(0); off < oldSize; off += deltaBlockSize {
+		n, err := io.ReadFull(or, block)
+		oldHash.Write(block[:n])
+		if n == deltaBlockSize {
+			sum := newRollingSum(block).sum()
+			index[sum] = append(index[sum], off)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !bytes.Equal(oldHash.Sum(nil), h.OldSum[:]) {
+		return errors.New("old file does not match the delta header")
+	}
+
+	var scratch [binary.MaxVarintLen64]byte
+	header := append([]byte(deltaMagic), scratch[:binary.PutUvarint(scratch[:], uint64(h.Size))]...)
+	header = append(header, h.OldSum[:]...)
+	header = append(header, h.NewSum[:]...)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	fw, err := flate.NewWriter(w, flate.BestCompression)
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(fw)
+	uvarint := func(v int64) {
+		bw.Write(scratch[:binary.PutUvarint(scratch[:], uint64(v))])
+	}
+	literal := func(b []byte) {
+		if len(b) > 0 {
+			bw.WriteByte('I')
+			uvarint(int64(len(b)))
+			bw.Write(b)
+		}
+	}
+
+	src := &hashingReader{r: new, h: sha256.New()}
+	nr := bufio.NewReaderSize(src, 64<<10)
+	// buf holds the new bytes not written yet: the pending literal, buf[:p],
+	// and the window being matched, buf[p:].
+	var buf []byte
+	p := 0
+	fill := func() error {
+		for len(buf)-p < deltaBlockSize {
+			c, err := nr.ReadByte()
+			if err != nil {
+				return err
+			}
+			buf = append(buf, c)
+		}
+		return nil
+	}
+	oldBlock := make([]byte, deltaBlockSize)
+
+	var rs rollingSum
+	fresh := true
+	for {
+		if fresh {
+			if err := fill(); err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+			rs = newRollingSum(buf[p:])
+			fresh = false
+		}
+
+		matched := false
+		for _, off := range index[rs.sum()] {
+			if _, err := old.ReadAt(oldBlock, off); err != nil {
+				return err
+			}
+			if !bytes.Equal(oldBlock, buf[p:]) {
+				continue
+			}
+			start, n := p, int64(deltaBlockSize)
+			for start > 0 && off > 0 {
+				k := int64(start)
+				if k > off {
+					k = off
+				}
+				if k > deltaBlockSize {
+					k = deltaBlockSize
+				}
+				if _, err := old.ReadAt(oldBlock[:k], off-k); err != nil {
+					return err
+				}
+				j := k
+				for j > 0 && oldBlock[j-1] == buf[start-1] {
+					j, start, off, n = j-1, start-1, off-1, n+1
+				}
+				if j > 0 {
+					break
+				}
+			}
+			literal(buf[:start])
+
+			rest := bufio.NewReader(io.NewSectionReader(old, off+n, oldSize-off-n))
+			for {
+				o, err := rest.ReadByte()
+				if err != nil {
+					break
+				}
+				c, err := nr.ReadByte()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				if c != o {
+					nr.UnreadByte()
+					break
+				}
+				n++
+			}
+			bw.WriteByte('C')
+			uvarint(off)
+			uvarint(n)
+			buf, p, fresh, matched = buf[:0], 0, true, true
+			break
+		}
+		if matched {
+			continue
+		}
+
+		c, err := nr.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		rs.roll(buf[p], c)
+		buf = append(buf, c)
+		p++
+		if p >= deltaMaxLiteral {
+			literal(buf[:p])
+			buf = append(buf[:0], buf[p:]...)
+			p = 0
+		}
+	}
+	literal(buf)
+	bw.WriteByte('E')
+
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := fw.Close(); err != nil {
+		return err
+	}
+	if src.n != h.Size || !bytes.Equal(src.h.Sum(nil), h.NewSum[:]) {
+		return errors.New("new file does not match the delta header")
+	}
+	return nil
+}
+
+// applyDelta writes the new file rebuilt from the old one and a delta,
+// checking both against the hashes the delta records. What it writes is
+// only complete once it returns nil.
+func applyDelta(w io.Writer, old io.ReaderAt, oldSize int64, delta io.Reader) error {
+	r := bufio.NewReader(delta)
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != deltaMagic {
+		return errBadDelta
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errBadDelta
+	}
+	var oldSum, newSum [32]byte
+	if _, err := io.ReadFull(r, oldSum[:]); err != nil {
+		return errBadDelta
+	}
+	if _, err := io.ReadFull(r, newSum[:]); err != nil {
+		return errBadDelta
+	}
+	oldHash := sha256.New()
+	if _, err := io.Copy(oldHash, io.NewSectionReader(old, 0, oldSize)); err != nil {
+		return err
+	}
+	if !bytes.Equal(oldHash.Sum(nil), oldSum[:]) {
+		return errors.New("delta does not apply to this file")
+	}
+
+	ops := bufio.NewReader(flate.NewReader(r))
+	newHash := sha256.New()
+	out := io.MultiWriter(w, newHash)
+	var written uint64
+	for {
+		op, err := ops.ReadByte()
+		if err != nil {
+			return errBadDelta
+		}
+		switch op {
+		case 'C':
+			off, err1 := binary.ReadUvarint(ops)
+			n, err2 := binary.ReadUvarint(ops)
+			if err1 != nil || err2 != nil || off+n > uint64(oldSize) || written+n > size {
+				return errBadDelta
+			}
+			if _, err := io.Copy(out, io.NewSectionReader(old, int64(off), int64(n))); err != nil {
+				return err
+			}
+			written += n
+		case 'I':
+			n, err := binary.ReadUvarint(ops)
+			if err != nil || written+n > size {
+				return errBadDelta
+			}
+			copied, err := io.CopyN(out, ops, int64(n))
+			if err == io.EOF || (err == nil && uint64(copied) != n) {
+				return errBadDelta
+			}
+			if err != nil {
+				return err
+			}
+			written += n
+		case 'E':
+			if written != size || !bytes.Equal(newHash.Sum(nil), newSum[:]) {
+				return errors.New("delta produced the wrong file")
+			}
+			return nil
+		default:
+			return errBadDelta
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+)
+
+func deltaRoundTrip(t *testing.T, old, new []byte) []byte {
+	t.Helper()
+	h := deltaHeader{Size: int64(len(new)), OldSum: sha256.Sum256(old), NewSum: sha256.Sum256(new)}
+	var delta bytes.Buffer
+	if err := makeDelta(&delta, h, bytes.NewReader(old), int64(len(old)), bytes.NewReader(new)); err != nil {
+		t.Fatalf("makeDelta: %v", err)
+	}
+	var rebuilt bytes.Buffer
+	if err := applyDelta(&rebuilt, bytes.NewReader(old), int64(len(old)), bytes.NewReader(delta.Bytes())); err != nil {
+		t.Fatalf("applyDelta: %v", err)
+	}
+	if !bytes.Equal(rebuilt.Bytes(), new) {
+		t.Fatalf("rebuilt %d bytes, want %d", rebuilt.Len(), len(new))
+	}
+	return delta.Bytes()
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	join := func(parts ...[]byte) []byte { return bytes.Join(parts, nil) }
+	base := random(64 << 10)
+
+	tests := []struct {
+		name string
+		old  []byte
+		new  []byte
+		// small is set when the delta should be much smaller than the new
+		// file, because most of it is copied from the old one.
+		small bool
+	}{
+		{"identical", base, base, true},
+		{"appended", base, join(base, random(1000)), true},
+		{"prepended", base, join(random(1000), base), true},
+		{"inserted", base, join(base[:30000], random(500), base[30000:]), true},
+		{"inserted unaligned", base, join(base[:12345], []byte("x"), base[12345:]), true},
+		{"truncated", base, base[:40000], true},
+		{"cut from the middle", base, join(base[:10000], base[20000:]), true},
+		{"replaced", base, random(64 << 10), false},
+		{"shorter than a block", base[:100], base[:50], false},
+		{"empty old", nil, base, false},
+		{"empty new", base, nil, false},
+		{"both empty", nil, nil, false},
+		{"literal longer than the buffer", random(4 << 10), join(random(deltaMaxLiteral+3000), base[:4<<10]), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delta := deltaRoundTrip(t, tt.old, tt.new)
+			if tt.small && len(delta) > len(tt.new)/10+200 {
+				t.Errorf("delta is %d bytes for a %d byte file", len(delta), len(tt.new))
+			}
+		})
+	}
+}
+
+func TestDeltaRejects(t *testing.T) {
+	old := bytes.Repeat([]byte("astralis "), 1000)
+	new := append(append([]byte{}, old...), "patched"...)
+	h := deltaHeader{Size: int64(len(new)), OldSum: sha256.Sum256(old), NewSum: sha256.Sum256(new)}
+	var delta bytes.Buffer
+	if err := makeDelta(&delta, h, bytes.NewReader(old), int64(len(old)), bytes.NewReader(new)); err != nil {
+		t.Fatal(err)
+	}
+
+	other := append([]byte("x"), old[1:]...)
+	if err := applyDelta(&bytes.Buffer{}, bytes.NewReader(other), int64(len(other)), bytes.NewReader(delta.Bytes())); err == nil {
+		t.Errorf("delta applied to another old file")
+	}
+	truncated := delta.Bytes()[:delta.Len()-4]
+	if err := applyDelta(&bytes.Buffer{}, bytes.NewReader(old), int64(len(old)), bytes.NewReader(truncated)); err == nil {
+		t.Errorf("truncated delta applied")
+	}
+	if err := applyDelta(&bytes.Buffer{}, bytes.NewReader(old), int64(len(old)), bytes.NewReader([]byte("ASDELTA0"))); err == nil {
+		t.Errorf("delta with the wrong magic applied")
+	}
+
+	wrong := h
+	wrong.NewSum[0] ^= 1
+	if err := makeDelta(&bytes.Buffer{}, wrong, bytes.NewReader(old), int64(len(old)), bytes.NewReader(new)); err == nil {
+		t.Errorf("makeDelta accepted a new file that does not match the header")
+	}
+	wrong = h
+	wrong.OldSum[0] ^= 1
+	if err := makeDelta(&bytes.Buffer{}, wrong, bytes.NewReader(old), int64(len(old)), bytes.NewReader(new)); err == nil {
+		t.Errorf("makeDelta accepted an old file that does not match the header")
+	}
+}
@@ -0,0 +1,191 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Release files are split into content-defined chunks stored once under
+// game_files/chunks, named by their SHA-256. An edit only changes the
+// chunks around it, so a launcher that keeps the chunks of its installed
+// files downloads just the ones it is missing.
+//
+// Chunk boundaries come from a gear rolling hash: after chunkMinSize bytes,
+// a chunk ends at the first byte where hash&chunkMask is zero, or at
+// chunkMaxSize. The hash is h = h<<1 + gearTable[b], where gearTable[i] is
+// the first 8 bytes, little endian, of SHA-256 of the single byte i, so a
+// launcher can chunk its local files the same way.
+
+const (
+	chunksPath   = "chunks"
+	chunkMinSize = 256 << 10
+	chunkMaxSize = 8 << 20
+	chunkMask    = 1<<20 - 1
+)
+
+var (
+	chunkHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+	gearTable        [256]uint64
+)
+
+func init() {
+	for i := range gearTable {
+		sum := sha256.Sum256([]byte{byte(i)})
+		gearTable[i] = binary.LittleEndian.Uint64(sum[:8])
+	}
+}
+
+// FileChunk is one piece of a release file; a file is its chunks in order.
+type FileChunk struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	URL  string `json:"url"`
+}
+
+func chunksDir() string {
+	return filepath.Join(config.Cfg.GameFilesDir, chunksPath)
+}
+
+func chunkFile(hash string) string {
+	return filepath.Join(chunksDir(), hash[:2], hash)
+}
+
+// storeChunk writes a chunk to the store unless it is there already. A
+// chunk already there is checked first, so one cut short by a crash or a
+// full disk is written again. Each writer uses its own temporary file, so
+// manifests built at the same time can store the same chunk.
+func storeChunk(hash string, data []byte) error {
+	name := chunkFile(hash)
+	if ok, err := chunkStored(name, hash, int64(len(data))); err != nil || ok {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".chunk-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// chunkStored reports whether the file holds the chunk with the given hash
+// and size.
+func chunkStored(name, hash string, size int64) (bool, error) {
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() || info.Size() != size {
+		return false, nil
+	}
+	sum := sha256.New()
+	if _, err := io.Copy(sum, file); err != nil {
+		return false, err
+	}
+	return hex.EncodeToString(sum.Sum(nil)) == hash, nil
+}
+
+// hashFile returns the SHA-256 of a file and stores its chunks, in a single
+// read of the file.
+func hashFile(name string) (string, []FileChunk, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+
+	fileHash := sha256.New()
+	in := bufio.NewReaderSize(file, 1<<20)
+	chunks := []FileChunk{}
+	buf := make([]byte, 0, chunkMaxSize)
+	cut := func() error {
+		sum := sha256.Sum256(buf)
+		hash := hex.EncodeToString(sum[:])
+		if err := storeChunk(hash, buf); err != nil {
+			return err
+		}
+		chunks = append(chunks, FileChunk{Hash: hash, Size: int64(len(buf)), URL: "/api/launcher/chunks/" + hash})
+		fileHash.Write(buf)
+		buf = buf[:0]
+		return nil
+	}
+
+	var h uint64
+	for {
+		b, err := in.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		buf = append(buf, b)
+		h = h<<1 + gearTable[b]
+		if (len(buf) >= chunkMinSize && h&chunkMask == 0) || len(buf) == chunkMaxSize {
+			if err := cut(); err != nil {
+				return "", nil, err
+			}
+			h = 0
+		}
+	}
+	if len(buf) > 0 {
+		if err := cut(); err != nil {
+			return "", nil, err
+		}
+	}
+	return hex.EncodeToString(fileHash.Sum(nil)), chunks, nil
+}
+
+// GetChunkHandler serves one chunk. Chunks never change, so they may be
+// cached for good, and Range requests let launchers resume a chunk cut off
+// halfway.
+func GetChunkHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+	if !chunkHashPattern.MatchString(hash) {
+		http.Error(w, `{"error":"Invalid chunk hash"}`, http.StatusBadRequest)
+		return
+	}
+	file, err := os.Open(chunkFile(hash))
+	if err != nil {
+		http.Error(w, `{"error":"Chunk not found"}`, http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("ETag", `"`+hash+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+	http.ServeContent(w, r, "", time.Time{}, file)
+}
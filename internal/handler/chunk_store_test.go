@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func useGameFilesDir(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	saved := config.Cfg
+	config.Cfg = &config.AppConfig{GameFilesDir: dir}
+	t.Cleanup(func() { config.Cfg = saved })
+	return dir
+}
+
+func writeTestFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHashFileChunks(t *testing.T) {
+	dir := useGameFilesDir(t)
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		rng.Read(b)
+		return b
+	}
+	original := random(12 << 20)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"smaller than a chunk", random(1000)},
+		{"random", original},
+		{"repeated", bytes.Repeat([]byte{7}, 20<<20)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hash, chunks, err := hashFile(writeTestFile(t, dir, "file", tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256(tt.data)
+			if hash != hex.EncodeToString(sum[:]) {
+				t.Errorf("file hash %s, want %x", hash, sum)
+			}
+
+			var joined []byte
+			for i, ch := range chunks {
+				if ch.Size > chunkMaxSize || (ch.Size < chunkMinSize && i != len(chunks)-1) {
+					t.Errorf("chunk %d is %d bytes", i, ch.Size)
+				}
+				data, err := os.ReadFile(chunkFile(ch.Hash))
+				if err != nil {
+					t.Fatalf("chunk %d was not stored: %v", i, err)
+				}
+				chunkSum := sha256.Sum256(data)
+				if int64(len(data)) != ch.Size || hex.EncodeToString(chunkSum[:]) != ch.Hash {
+					t.Errorf("chunk %d does not match its hash and size", i)
+				}
+				joined = append(joined, data...)
+			}
+			if !bytes.Equal(joined, tt.data) {
+				t.Errorf("chunks do not make up the file")
+			}
+		})
+	}
+
+	// An edit in the middle only changes the chunks around it.
+	_, before, err := hashFile(writeTestFile(t, dir, "before", original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := append(append(append([]byte{}, original[:6<<20]...), "edit"...), original[6<<20:]...)
+	_, after, err := hashFile(writeTestFile(t, dir, "after", edited))
+	if err != nil {
+		t.Fatal(err)
+	}
+	known := map[string]bool{}
+	for _, ch := range before {
+		known[ch.Hash] = true
+	}
+	changed := 0
+	for _, ch := range after {
+		if !known[ch.Hash] {
+			changed++
+		}
+	}
+	if len(before) < 4 || changed > 2 {
+		t.Errorf("%d of %d chunks changed after a 4 byte insert", changed, len(after))
+	}
+}
+
+func TestStoreChunk(t *testing.T) {
+	useGameFilesDir(t)
+	data := bytes.Repeat([]byte("chunk"), 1000)
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	name := chunkFile(hash)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- storeChunk(hash, data)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent store: %v", err)
+		}
+	}
+
+	corruptions := map[string][]byte{
+		"truncated": data[:100],
+		"corrupt":   append([]byte("x"), data[1:]...),
+		"empty":     nil,
+	}
+	for kind, bad := range corruptions {
+		if err := os.WriteFile(name, bad, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := storeChunk(hash, data); err != nil {
+			t.Fatalf("%s: %v", kind, err)
+		}
+		if got, _ := os.ReadFile(name); !bytes.Equal(got, data) {
+			t.Errorf("%s chunk was not rewritten", kind)
+		}
+	}
+
+	leftovers, _ := filepath.Glob(filepath.Join(filepath.Dir(name), ".chunk-*"))
+	if len(leftovers) > 0 {
+		t.Errorf("temporary files left behind: %v", leftovers)
+	}
+}
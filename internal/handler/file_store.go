@@ -0,0 +1,323 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Release files are still deployed to and scanned from game_files, but
+// launchers can be sent elsewhere to download them, so the bandwidth does
+// not go through the API servers. A fileStore hands out short-lived signed
+// URLs for objects named by their path under game_files, e.g.
+// "builds/1.4.0/bin/game.exe", "chunks/ab/ab12..." or "patches/x-y.delta".
+//
+// STORAGE_BACKEND=local with DOWNLOAD_URL_SECRET signs URLs under
+// DOWNLOAD_BASE_URL, served by /api/launcher/files or any file server that
+// checks the same signature:
+//
+//	{base}/{key}?expires={unix seconds}&signature={hex HMAC-SHA256(secret, key + "\n" + expires)}
+//
+// STORAGE_BACKEND=s3 uploads the files to an S3-compatible bucket in the
+// background and hands out presigned GET URLs for those already there.
+type fileStore interface {
+	// signedURL returns a URL that fetches key until expires.
+	signedURL(key string, expires time.Time) string
+	// has reports whether the store is known to have key with the content
+	// of the given SHA-256, without asking it.
+	has(key, hash string) bool
+	// upload copies the file at key from game_files into the store, unless
+	// the store has it already with the same content. Files edited in place
+	// keep their key, so the hash is what tells the versions apart.
+	upload(key, hash string) error
+}
+
+type localStore struct {
+	baseURL string
+	secret  []byte
+}
+
+func (s *localStore) signature(key, expires string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(key + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *localStore) signedURL(key string, expires time.Time) string {
+	e := strconv.FormatInt(expires.Unix(), 10)
+	return downloadURL(s.baseURL+"/", key) + "?expires=" + e + "&signature=" + s.signature(key, e)
+}
+
+// has is always true and upload has nothing to do: the files are served
+// from game_files.
+func (s *localStore) has(key, hash string) bool {
+	return true
+}
+
+func (s *localStore) upload(key, hash string) error {
+	return nil
+}
+
+var (
+	fileStoreOnce   sync.Once
+	loadedFileStore fileStore
+)
+
+// getFileStore returns the configured store, or nil when manifests should
+// keep pointing at the API's own download route.
+func getFileStore() fileStore {
+	fileStoreOnce.Do(func() {
+		cfg := config.Cfg
+		switch cfg.StorageBackend {
+		case "s3":
+			if cfg.S3Endpoint == "" || cfg.S3Bucket == "" || cfg.S3AccessKey == "" || cfg.S3SecretKey == "" {
+				log.Println("S3 storage needs S3_ENDPOINT, S3_BUCKET, S3_ACCESS_KEY and S3_SECRET_KEY, serving launcher files from the API")
+				return
+			}
+			store, err := newS3Store()
+			if err != nil {
+				log.Printf("Invalid S3_ENDPOINT, serving launcher files from the API: %v", err)
+				return
+			}
+			loadedFileStore = store
+		case "local":
+			if cfg.DownloadURLSecret != "" {
+				loadedFileStore = &localStore{baseURL: strings.TrimSuffix(cfg.DownloadBaseURL, "/"), secret: []byte(cfg.DownloadURLSecret)}
+			}
+		default:
+			log.Printf("Unknown STORAGE_BACKEND %q, serving launcher files from the API", cfg.StorageBackend)
+		}
+	})
+	return loadedFileStore
+}
+
+// downloadURLTTL is how long the URLs in a manifest stay valid at most.
+func downloadURLTTL() time.Duration {
+	ttl := time.Duration(config.Cfg.DownloadURLTTLSeconds) * time.Second
+	if ttl < 2*time.Minute {
+		ttl = 2 * time.Minute
+	}
+	return ttl
+}
+
+func chunkKey(hash string) string {
+	return chunksPath + "/" + hash[:2] + "/" + hash
+}
+
+func patchKey(p FilePatch) string {
+	return releasePatchesPath + "/" + patchFileName(p.From, p.To)
+}
+
+// uploadManifestFiles puts every file, chunk and patch a manifest refers to
+// into the store; keyPrefix is the path of the release directory under
+// game_files. It carries on past failed uploads, returning the first error,
+// and reports how many keys were added.
+func uploadManifestFiles(store fileStore, keyPrefix string, files []GameFile) (int, error) {
+	seen := map[string]bool{}
+	added := 0
+	var firstErr error
+	put := func(key, hash string) {
+		if seen[key] || store.has(key, hash) {
+			return
+		}
+		seen[key] = true
+		if err := store.upload(key, hash); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s: %w", key, err)
+			}
+			return
+		}
+		added++
+	}
+	for _, f := range files {
+		put(keyPrefix+f.Path, f.Hash)
+		for _, ch := range f.Chunks {
+			put(chunkKey(ch.Hash), ch.Hash)
+		}
+		for _, p := range f.Patches {
+			put(patchKey(p), p.Hash)
+		}
+	}
+	return added, firstErr
+}
+
+// fileStoreSyncWake starts a sync right away rather than at the next tick;
+// see queueFileStoreSync.
+var fileStoreSyncWake = make(chan struct{}, 1)
+
+// queueFileStoreSync asks the sync job to look at the manifests now.
+func queueFileStoreSync() {
+	select {
+	case fileStoreSyncWake <- struct{}{}:
+	default:
+	}
+}
+
+// StartFileStoreSync copies the files of the cached manifests into the file
+// store in the background, when a manifest changes and every minute until
+// ctx is cancelled, so failed uploads are retried. Manifests link to the
+// store only for the files it has.
+func StartFileStoreSync(ctx context.Context) {
+	if getFileStore() == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			syncFileStore()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-fileStoreSyncWake:
+			}
+		}
+	}()
+}
+
+func syncFileStore() {
+	store := getFileStore()
+	builds := cachedManifests()
+	names := make([]string, 0, len(builds))
+	for build := range builds {
+		names = append(names, build)
+	}
+	sort.Strings(names)
+
+	for _, build := range names {
+		c := builds[build]
+		c.mu.RLock()
+		m := c.current
+		c.mu.RUnlock()
+		if m == nil {
+			continue
+		}
+		added, err := uploadManifestFiles(store, c.keyPrefix, m.Files)
+		if err != nil {
+			log.Printf("Failed to copy the files of build %q to the file store: %v", build, err)
+		}
+		if added > 0 {
+			// Drop the copy with signed URLs, so the next request links the
+			// new keys to the store.
+			m.signedMu.Lock()
+			m.signed = nil
+			m.signedMu.Unlock()
+			log.Printf("Copied %d files of build %q to the file store", added, build)
+		}
+	}
+}
+
+// withSignedURLs returns the manifest with the URLs of the keys the store
+// has, with the content the manifest lists, pointing at it; the rest keep pointing at the API. URLs expire at the
+// end of the next TTL window rather than a fixed time after the request, so
+// within a window every launcher gets the same body, and each URL is valid
+// for at least half the TTL. The ETag does not depend on the URLs.
+func (c *manifestCache) withSignedURLs(m *cachedManifest) (*cachedManifest, error) {
+	store := getFileStore()
+	if store == nil {
+		return m, nil
+	}
+	ttl := downloadURLTTL()
+	expires := time.Now().Truncate(ttl / 2).Add(ttl)
+
+	m.signedMu.Lock()
+	defer m.signedMu.Unlock()
+	if m.signed != nil && m.signed.expires.Equal(expires) {
+		return m.signed, nil
+	}
+
+	files := make([]GameFile, len(m.Files))
+	sign := func(key, hash, apiURL string) string {
+		if !store.has(key, hash) {
+			return apiURL
+		}
+		return store.signedURL(key, expires)
+	}
+	for i, f := range m.Files {
+		f.URL = sign(c.keyPrefix+f.Path, f.Hash, f.URL)
+		if len(f.Chunks) > 0 {
+			chunks := make([]FileChunk, len(f.Chunks))
+			for j, ch := range f.Chunks {
+				ch.URL = sign(chunkKey(ch.Hash), ch.Hash, ch.URL)
+				chunks[j] = ch
+			}
+			f.Chunks = chunks
+		}
+		if len(f.Patches) > 0 {
+			patches := make([]FilePatch, len(f.Patches))
+			for j, p := range f.Patches {
+				p.URL = sign(patchKey(p), p.Hash, p.URL)
+				patches[j] = p
+			}
+			f.Patches = patches
+		}
+		files[i] = f
+	}
+	body, err := json.Marshal(files)
+	if err != nil {
+		return nil, err
+	}
+
+	signed := &cachedManifest{
+		Files:     files,
+		Body:      body,
+		ETag:      m.ETag,
+		FilesHash: m.FilesHash,
+		BuiltAt:   m.BuiltAt,
+		expires:   expires,
+	}
+	m.signed = signed
+	return signed, nil
+}
+
+// SignedFileHandler serves release files by signed URL, without a JWT, for
+// the local store. Range requests are supported.
+func SignedFileHandler(w http.ResponseWriter, r *http.Request) {
+	store, ok := getFileStore().(*localStore)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/api/launcher/files/")
+	expires := r.URL.Query().Get("expires")
+	signature := r.URL.Query().Get("signature")
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || !hmac.Equal([]byte(signature), []byte(store.signature(key, expires))) {
+		http.Error(w, `{"error":"Invalid download signature"}`, http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > unix {
+		http.Error(w, `{"error":"Download link has expired","code":"link_expired"}`, http.StatusForbidden)
+		return
+	}
+
+	file, err := http.Dir(config.Cfg.GameFilesDir).Open(key)
+	if err != nil {
+		http.Error(w, `{"error":"File not found"}`, http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, `{"error":"File not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.FormatInt(unix-time.Now().Unix(), 10))
+	http.ServeContent(w, r, filepath.Base(key), info.ModTime(), file)
+}
@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryStore records uploads and fails the keys it is told to.
+type memoryStore struct {
+	stored  map[string]string
+	failing map[string]bool
+	uploads []string
+}
+
+func (s *memoryStore) signedURL(key string, expires time.Time) string { return "store:" + key }
+
+func (s *memoryStore) has(key, hash string) bool { return s.stored[key] == hash }
+
+func (s *memoryStore) upload(key, hash string) error {
+	s.uploads = append(s.uploads, key)
+	if s.failing[key] {
+		return errors.New("upload failed")
+	}
+	s.stored[key] = hash
+	return nil
+}
+
+func TestUploadManifestFiles(t *testing.T) {
+	chunk := strings.Repeat("c", 64)
+	files := []GameFile{
+		{Path: "a", Hash: "a1", Chunks: []FileChunk{{Hash: chunk}}},
+		{Path: "b", Hash: "b1", Chunks: []FileChunk{{Hash: chunk}}, Patches: []FilePatch{{From: "x", To: "y", Hash: "p1"}}},
+		{Path: "c", Hash: "c1"},
+	}
+	store := &memoryStore{
+		stored:  map[string]string{"builds/1/a": "a1"},
+		failing: map[string]bool{"builds/1/b": true},
+	}
+
+	added, err := uploadManifestFiles(store, "builds/1/", files)
+	if err == nil {
+		t.Errorf("failed upload was not reported")
+	}
+	if added != 3 {
+		t.Errorf("added %d keys, want 3", added)
+	}
+	sort.Strings(store.uploads)
+	want := []string{"builds/1/b", "builds/1/c", chunkKey(chunk), "patches/x-y.delta"}
+	sort.Strings(want)
+	if len(store.uploads) != len(want) {
+		t.Fatalf("uploaded %q, want %q", store.uploads, want)
+	}
+	for i := range want {
+		if store.uploads[i] != want[i] {
+			t.Errorf("uploaded %q, want %q", store.uploads, want)
+			break
+		}
+	}
+
+	delete(store.failing, "builds/1/b")
+	store.uploads = nil
+	added, err = uploadManifestFiles(store, "builds/1/", files)
+	if err != nil || added != 1 || len(store.uploads) != 1 {
+		t.Errorf("retry added %d keys with %v, uploading %q; want only builds/1/b", added, err, store.uploads)
+	}
+
+	// A file edited in place keeps its key but not its hash.
+	files[2].Hash = "c2"
+	store.uploads = nil
+	added, err = uploadManifestFiles(store, "builds/1/", files)
+	if err != nil || added != 1 || len(store.uploads) != 1 || store.uploads[0] != "builds/1/c" {
+		t.Errorf("edited file: added %d keys with %v, uploading %q; want builds/1/c", added, err, store.uploads)
+	}
+}
+
+func TestS3StoreUpload(t *testing.T) {
+	dir := useGameFilesDir(t)
+	sha := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+
+	// bucket keeps the body and hash header of each object, like S3 would.
+	var mu sync.Mutex
+	objects := map[string]string{}
+	hashes := map[string]string{}
+	puts := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !strings.Contains(r.URL.Query().Get("X-Amz-SignedHeaders"), "host") {
+			t.Errorf("%s %s is not presigned", r.Method, r.URL.Path)
+		}
+		switch r.Method {
+		case http.MethodHead:
+			if _, ok := objects[r.URL.Path]; !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if hashes[r.URL.Path] != "" {
+				w.Header().Set(s3HashHeader, hashes[r.URL.Path])
+			}
+		case http.MethodPut:
+			if want := s3HashHeader; !strings.Contains(r.URL.Query().Get("X-Amz-SignedHeaders"), want) {
+				t.Errorf("PUT does not sign %s", want)
+			}
+			body, _ := io.ReadAll(r.Body)
+			objects[r.URL.Path] = string(body)
+			hashes[r.URL.Path] = r.Header.Get(s3HashHeader)
+			puts++
+		}
+	}))
+	defer srv.Close()
+	newStore := func() *s3Store {
+		return &s3Store{
+			scheme:    "http",
+			host:      strings.TrimPrefix(srv.URL, "http://"),
+			pathStyle: true,
+			region:    "us-east-1",
+			bucket:    "bucket",
+			accessKey: "key",
+			secretKey: "secret",
+			client:    srv.Client(),
+		}
+	}
+	store := newStore()
+	object := "/bucket/game.exe"
+
+	steps := []struct {
+		name     string
+		content  string
+		hash     string
+		wantErr  bool
+		wantPuts int
+	}{
+		{"new file", "v1", sha("v1"), false, 1},
+		{"unchanged", "v1", sha("v1"), false, 1},
+		{"edited in place", "v2", sha("v2"), false, 2},
+		{"edited after the manifest", "v3", sha("v2"), false, 2},
+		{"changed on disk since the manifest", "v4", sha("v5"), true, 2},
+	}
+	for _, step := range steps {
+		writeTestFile(t, dir, "game.exe", []byte(step.content))
+		err := store.upload("game.exe", step.hash)
+		if (err != nil) != step.wantErr {
+			t.Errorf("%s: upload error %v", step.name, err)
+		}
+		if puts != step.wantPuts {
+			t.Errorf("%s: %d uploads, want %d", step.name, puts, step.wantPuts)
+		}
+		if !step.wantErr && !store.has("game.exe", step.hash) {
+			t.Errorf("%s: store does not have the uploaded content", step.name)
+		}
+	}
+	if objects[object] != "v2" || hashes[object] != sha("v2") {
+		t.Errorf("bucket has %q with hash %s, want v2", objects[object], hashes[object])
+	}
+	if store.has("game.exe", sha("v1")) {
+		t.Errorf("store still has the replaced content")
+	}
+
+	// A fresh process finds the object by its hash header rather than
+	// uploading it again, and replaces objects stored without one.
+	if err := newStore().upload("game.exe", sha("v2")); err != nil || puts != 2 {
+		t.Errorf("fresh store uploaded again: %d uploads, %v", puts, err)
+	}
+	hashes[object] = ""
+	writeTestFile(t, dir, "game.exe", []byte("v2"))
+	if err := newStore().upload("game.exe", sha("v2")); err != nil || puts != 3 {
+		t.Errorf("object without a hash was not replaced: %d uploads, %v", puts, err)
+	}
+}
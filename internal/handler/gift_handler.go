@@ -0,0 +1,428 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// A gift has to be confirmed within this time after it is created.
+const giftConfirmationTTL = 15 * time.Minute
+
+// GetOwnedKeysHandler lists the unused keys the user owns and can redeem or
+// gift.
+func GetOwnedKeysHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := database.DB.Query("SELECT key_string, key_type, duration_days, product_id FROM activation_keys WHERE owner_user_id = ? AND is_used = FALSE ORDER BY id DESC", claims.Subject)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query keys"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := make([]model.OwnedKey, 0)
+	for rows.Next() {
+		var key model.OwnedKey
+		var productID sql.NullInt64
+		if err := rows.Scan(&key.KeyString, &key.KeyType, &key.DurationDays, &productID); err != nil {
+			http.Error(w, `{"error":"Failed to scan key row"}`, http.StatusInternalServerError)
+			return
+		}
+		if productID.Valid {
+			id := int(productID.Int64)
+			key.ProductID = &id
+		}
+		keys = append(keys, key)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// CreateGiftHandler prepares a gift of an owned key or of subscription days.
+// Nothing moves until the sender confirms it with the code emailed to them,
+// so a stolen session alone cannot give the account's keys or time away.
+func CreateGiftHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	senderID, _ := strconv.Atoi(claims.Subject)
+
+	var req struct {
+		Recipient string `json:"recipient"`
+		Key       string `json:"key"`
+		Days      int    `json:"days"`
+		ProductID *int   `json:"product_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if (req.Key == "") == (req.Days == 0) {
+		http.Error(w, `{"error":"Send either a key or a number of days"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Days < 0 || req.Days > maxGiftDays {
+		http.Error(w, `{"error":"Days must be between 1 and 3650"}`, http.StatusBadRequest)
+		return
+	}
+
+	var recipientID int
+	var recipientBanned bool
+	err := database.DB.QueryRow("SELECT id, is_banned FROM users WHERE username = ?", strings.TrimSpace(req.Recipient)).Scan(&recipientID, &recipientBanned)
+	if err != nil || recipientBanned {
+		http.Error(w, `{"error":"Recipient not found"}`, http.StatusNotFound)
+		return
+	}
+	if recipientID == senderID {
+		http.Error(w, `{"error":"You cannot send a gift to yourself"}`, http.StatusBadRequest)
+		return
+	}
+
+	var senderEmail sql.NullString
+	if err := database.DB.QueryRow("SELECT email FROM users WHERE id = ?", senderID).Scan(&senderEmail); err != nil {
+		http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !senderEmail.Valid || senderEmail.String == "" {
+		http.Error(w, `{"error":"Add an email address to your account to send gifts"}`, http.StatusConflict)
+		return
+	}
+
+	// Cancelled and expired gifts count too, or creating and cancelling
+	// would get around the limit.
+	var recentGifts int
+	err = database.DB.QueryRow("SELECT COUNT(*) FROM gift_transfers WHERE sender_id = ? AND created_at > ?",
+		senderID, time.Now().Add(-24*time.Hour)).Scan(&recentGifts)
+	if err != nil {
+		http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if recentGifts >= config.Cfg.GiftDailyLimit {
+		http.Error(w, `{"error":"You have reached the daily gift limit","code":"gift_rate_limited"}`, http.StatusTooManyRequests)
+		return
+	}
+
+	kind := model.GiftKindDays
+	var keyID *int
+	var days *int
+	if req.Key != "" {
+		kind = model.GiftKindKey
+		var id int
+		var isUsed bool
+		var owner sql.NullInt64
+		err := database.DB.QueryRow("SELECT id, is_used, owner_user_id FROM activation_keys WHERE key_string = ?", normalizeActivationKey(req.Key)).Scan(&id, &isUsed, &owner)
+		if err != nil || isUsed || !owner.Valid || int(owner.Int64) != senderID {
+			http.Error(w, `{"error":"You do not own an unused key with that code"}`, http.StatusNotFound)
+			return
+		}
+		keyID = &id
+		req.ProductID = nil
+	} else {
+		if req.ProductID != nil {
+			if err := validateProductExists(*req.ProductID); err != nil {
+				writeKeyError(w, err, "Failed to look up product")
+				return
+			}
+		}
+		days = &req.Days
+	}
+
+	code, err := generateOneTimeToken()
+	if err != nil {
+		http.Error(w, `{"error":"Could not generate confirmation code"}`, http.StatusInternalServerError)
+		return
+	}
+	code = code[:16]
+	expiresAt := time.Now().Add(giftConfirmationTTL)
+
+	res, err := database.DB.Exec(`INSERT INTO gift_transfers (sender_id, recipient_id, kind, key_id, product_id, days, confirmation_code, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, senderID, recipientID, kind, keyID, req.ProductID, days, code, expiresAt)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to create gift"}`, http.StatusInternalServerError)
+		return
+	}
+	giftID, _ := res.LastInsertId()
+
+	body := fmt.Sprintf(`<p>You are sending gift #%d to <b>%s</b>.</p><p>Your confirmation code is <b>%s</b>. It expires in %d minutes.</p><p>If you did not start this gift, change your password.</p>`,
+		giftID, html.EscapeString(strings.TrimSpace(req.Recipient)), code, int(giftConfirmationTTL.Minutes()))
+	if err := sendEmail(senderEmail.String, "Confirm your gift", body); err != nil {
+		log.Printf("Could not send the confirmation of gift %d: %v", giftID, err)
+		database.DB.Exec("DELETE FROM gift_transfers WHERE id = ?", giftID)
+		http.Error(w, `{"error":"Could not send the confirmation email"}`, http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"gift_id":    giftID,
+		"recipient":  strings.TrimSpace(req.Recipient),
+		"kind":       kind,
+		"days":       days,
+		"product_id": req.ProductID,
+		"expires_at": expiresAt,
+		"message":    "Enter the code we emailed you to send the gift",
+	})
+}
+
+// ConfirmGiftHandler moves the key or days of a pending gift to the recipient
+// and records it in both users' history.
+func ConfirmGiftHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	senderID, _ := strconv.Atoi(claims.Subject)
+	giftID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid gift ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		ConfirmationCode string `json:"confirmation_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var recipientID int
+	var kind, status, code string
+	var keyID, productID, days sql.NullInt64
+	var expiresAt time.Time
+	err = tx.QueryRow(`SELECT recipient_id, kind, key_id, product_id, days, status, confirmation_code, expires_at
+		FROM gift_transfers WHERE id = ? AND sender_id = ? FOR UPDATE`, giftID, senderID).
+		Scan(&recipientID, &kind, &keyID, &productID, &days, &status, &code, &expiresAt)
+	if err != nil {
+		http.Error(w, `{"error":"Gift not found"}`, http.StatusNotFound)
+		return
+	}
+	if status != model.GiftPending || time.Now().After(expiresAt) {
+		http.Error(w, `{"error":"Gift is no longer pending"}`, http.StatusConflict)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(code), []byte(req.ConfirmationCode)) != 1 {
+		http.Error(w, `{"error":"Invalid confirmation code"}`, http.StatusForbidden)
+		return
+	}
+
+	// Lock both users in a fixed order so opposite gifts cannot deadlock.
+	if _, err := tx.Exec("SELECT id FROM users WHERE id IN (?, ?) ORDER BY id FOR UPDATE", senderID, recipientID); err != nil {
+		http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var senderName, recipientName string
+	tx.QueryRow("SELECT username FROM users WHERE id = ?", senderID).Scan(&senderName)
+	tx.QueryRow("SELECT username FROM users WHERE id = ?", recipientID).Scan(&recipientName)
+
+	sender, recipient := strconv.Itoa(senderID), strconv.Itoa(recipientID)
+	switch kind {
+	case model.GiftKindKey:
+		res, err := tx.Exec("UPDATE activation_keys SET owner_user_id = ? WHERE id = ? AND owner_user_id = ? AND is_used = FALSE", recipientID, keyID.Int64, senderID)
+		if err != nil {
+			http.Error(w, `{"error":"Failed to transfer key"}`, http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, `{"error":"The key is no longer available"}`, http.StatusConflict)
+			return
+		}
+
+	case model.GiftKindDays:
+		var product *int
+		if productID.Valid {
+			id := int(productID.Int64)
+			product = &id
+		}
+		giftDays := int(days.Int64)
+		if err := transferSubscriptionDays(tx, sender, recipient, product, giftDays, giftID); err != nil {
+			writeKeyError(w, err, "Failed to transfer subscription days")
+			return
+		}
+		sentReason := fmt.Sprintf("Gift #%d to %s", giftID, recipientName)
+		receivedReason := fmt.Sprintf("Gift #%d from %s", giftID, senderName)
+		if err := recordSubscriptionAdjustment(tx, sender, product, nil, model.SubscriptionActionGiftSent, &giftDays, nil, nil, sentReason); err != nil {
+			http.Error(w, `{"error":"Failed to record gift"}`, http.StatusInternalServerError)
+			return
+		}
+		if err := recordSubscriptionAdjustment(tx, recipient, product, nil, model.SubscriptionActionGiftIn, &giftDays, nil, nil, receivedReason); err != nil {
+			http.Error(w, `{"error":"Failed to record gift"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if _, err := tx.Exec("UPDATE gift_transfers SET status = ?, confirmed_at = ? WHERE id = ?", model.GiftCompleted, time.Now(), giftID); err != nil {
+		http.Error(w, `{"error":"Failed to update gift"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Gift sent to " + recipientName})
+}
+
+func CancelGiftHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	giftID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid gift ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	res, err := database.DB.Exec("UPDATE gift_transfers SET status = ? WHERE id = ? AND sender_id = ? AND status = ?",
+		model.GiftCancelled, giftID, claims.Subject, model.GiftPending)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to cancel gift"}`, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"error":"No pending gift with that ID"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Gift cancelled"})
+}
+
+// GetGiftsHandler returns the gifts the user has sent and received.
+func GetGiftsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	userID, _ := strconv.Atoi(claims.Subject)
+
+	rows, err := database.DB.Query(`SELECT g.id, g.sender_id, s.username, rc.username, g.kind, k.key_string, g.product_id, g.days, g.status, g.created_at, g.expires_at, g.confirmed_at
+		FROM gift_transfers g
+		JOIN users s ON s.id = g.sender_id
+		JOIN users rc ON rc.id = g.recipient_id
+		LEFT JOIN activation_keys k ON k.id = g.key_id
+		WHERE g.sender_id = ? OR (g.recipient_id = ? AND g.status = ?)
+		ORDER BY g.id DESC`, userID, userID, model.GiftCompleted)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query gifts"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	gifts := make([]model.GiftTransfer, 0)
+	for rows.Next() {
+		var g model.GiftTransfer
+		var senderID int
+		var keyString sql.NullString
+		var productID, days sql.NullInt64
+		var confirmedAt sql.NullTime
+		if err := rows.Scan(&g.ID, &senderID, &g.Sender, &g.Recipient, &g.Kind, &keyString, &productID, &days, &g.Status, &g.CreatedAt, &g.ExpiresAt, &confirmedAt); err != nil {
+			http.Error(w, `{"error":"Failed to scan gift row"}`, http.StatusInternalServerError)
+			return
+		}
+		g.Direction = "received"
+		if senderID == userID {
+			g.Direction = "sent"
+		} else if keyString.Valid {
+			// Only the recipient, who now owns the key, gets to see it.
+			g.KeyString = &keyString.String
+		}
+		if productID.Valid {
+			id := int(productID.Int64)
+			g.ProductID = &id
+		}
+		if days.Valid {
+			d := int(days.Int64)
+			g.Days = &d
+		}
+		if confirmedAt.Valid {
+			g.ConfirmedAt = &confirmedAt.Time
+		}
+		gifts = append(gifts, g)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(gifts)
+}
+
+// maxGiftDays is the most days one gift can move, ten years.
+const maxGiftDays = 3650
+
+// senderEndAfterGift returns where the sender's subscription ends after
+// giving days away. The sender has to keep some time left, and lifetime
+// subscriptions cannot be split.
+func senderEndAfterGift(end *time.Time, now time.Time, days int) (time.Time, error) {
+	if days <= 0 || days > maxGiftDays {
+		return time.Time{}, &keyError{http.StatusBadRequest, "Days must be between 1 and 3650"}
+	}
+	if end == nil || !end.After(now.AddDate(0, 0, days)) {
+		return time.Time{}, &keyError{http.StatusConflict, "You do not have enough subscription time left"}
+	}
+	if !end.Before(lifetimeExpiry) {
+		return time.Time{}, &keyError{http.StatusConflict, "Lifetime subscriptions cannot be gifted in days"}
+	}
+	return end.AddDate(0, 0, -days), nil
+}
+
+// transferSubscriptionDays takes days off the sender's active subscription and
+// adds them to the recipient's. Frozen subscriptions cannot be split; see
+// senderEndAfterGift for the other rules.
+func transferSubscriptionDays(tx *sql.Tx, sender, recipient string, productID *int, days, giftID int) error {
+	if _, _, frozen, err := activeFreeze(tx, sender, productID); err != nil || frozen {
+		if err != nil {
+			return err
+		}
+		return &keyError{http.StatusConflict, "Your subscription is frozen"}
+	}
+	end, err := subscriptionEnd(tx, sender, productID)
+	if err != nil {
+		return err
+	}
+	newEnd, err := senderEndAfterGift(end, time.Now(), days)
+	if err != nil {
+		return err
+	}
+	if err := setSubscriptionEnd(tx, sender, productID, newEnd); err != nil {
+		return err
+	}
+
+	if productID != nil {
+		return grantProductSubscription(tx, recipient, *productID, days, model.SubscriptionSourceGift, &giftID)
+	}
+	return extendSubscription(tx, recipient, days)
+}
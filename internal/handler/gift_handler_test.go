@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSenderEndAfterGift(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := func(t time.Time) *time.Time { return &t }
+	inYears := func(years int) *time.Time { return at(now.AddDate(years, 0, 0)) }
+
+	tests := []struct {
+		name string
+		end  *time.Time
+		days int
+		want time.Time
+		ok   bool
+	}{
+		{"keeps the rest", at(now.AddDate(0, 0, 40)), 30, now.AddDate(0, 0, 10), true},
+		{"keeps no time", at(now.AddDate(0, 0, 30)), 30, time.Time{}, false},
+		{"no subscription", nil, 1, time.Time{}, false},
+		{"zero days", inYears(1), 0, time.Time{}, false},
+		{"negative days", inYears(1), -5, time.Time{}, false},
+		{"more than the cap", inYears(20), maxGiftDays + 1, time.Time{}, false},
+		// time.Duration of this many days overflows into a negative value.
+		{"overflowing days", inYears(20), 106752, time.Time{}, false},
+		{"lifetime", at(lifetimeExpiry), 30, time.Time{}, false},
+	}
+	for _, tt := range tests {
+		got, err := senderEndAfterGift(tt.end, now, tt.days)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got error %v, want ok = %v", tt.name, err, tt.ok)
+			continue
+		}
+		if tt.ok && !got.Equal(tt.want) {
+			t.Errorf("%s: new end %v, want %v", tt.name, got, tt.want)
+		}
+		if err == nil && tt.end != nil && !got.Before(*tt.end) {
+			t.Errorf("%s: gift extended the sender's subscription to %v", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Keys use the Crockford base32 alphabet, which has no I, L, O or U, so the
+// characters people most often confuse can be mapped back when normalizing.
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+const (
+	minKeyGroupLength = 4
+	maxKeyGroupLength = 10
+	minKeyGroups      = 2
+	maxKeyGroups      = 8
+	maxKeyPrefixLen   = 8
+	// Minimum number of random characters, i.e. 80 bits of entropy.
+	minKeyRandomChars = 16
+)
+
+// legacyKeyPattern matches the hex keys issued before key formats existed.
+// They have no check character and are looked up as-is.
+var legacyKeyPattern = regexp.MustCompile(`^[0-9A-F]{8}-[0-9A-F]{8}-[0-9A-F]{8}-[0-9A-F]{8}$`)
+
+// keyFormat describes how activation keys of a batch are laid out:
+// PREFIX-XXXXX-XXXXX-...-XXXXC, where C is a Luhn mod 32 check character
+// computed over the prefix and all random characters.
+type keyFormat struct {
+	Prefix      string
+	GroupLength int
+	Groups      int
+}
+
+// resolveKeyFormat fills in the requested format from the product's default
+// prefix and the configured defaults, then validates it.
+func resolveKeyFormat(prefix string, groupLength, groups int, productID *int) (keyFormat, error) {
+	f := keyFormat{
+		Prefix:      strings.ToUpper(strings.TrimSpace(prefix)),
+		GroupLength: groupLength,
+		Groups:      groups,
+	}
+	if f.Prefix == "" && productID != nil {
+		var productPrefix sql.NullString
+		err := database.DB.QueryRow("SELECT key_prefix FROM products WHERE id = ?", *productID).Scan(&productPrefix)
+		if err != nil && err != sql.ErrNoRows {
+			return f, &keyError{http.StatusInternalServerError, "Failed to look up product key prefix"}
+		}
+		f.Prefix = productPrefix.String
+	}
+	if f.Prefix == "" {
+		f.Prefix = config.Cfg.KeyPrefix
+	}
+	if f.GroupLength == 0 {
+		f.GroupLength = config.Cfg.KeyGroupLength
+	}
+	if f.Groups == 0 {
+		f.Groups = config.Cfg.KeyGroups
+	}
+
+	if err := validateKeyPrefix(f.Prefix); err != nil {
+		return f, err
+	}
+	if f.GroupLength < minKeyGroupLength || f.GroupLength > maxKeyGroupLength {
+		return f, &keyError{http.StatusBadRequest, fmt.Sprintf("Group length must be between %d and %d", minKeyGroupLength, maxKeyGroupLength)}
+	}
+	if f.Groups < minKeyGroups || f.Groups > maxKeyGroups {
+		return f, &keyError{http.StatusBadRequest, fmt.Sprintf("Number of groups must be between %d and %d", minKeyGroups, maxKeyGroups)}
+	}
+	if f.GroupLength*f.Groups-1 < minKeyRandomChars {
+		return f, &keyError{http.StatusBadRequest, fmt.Sprintf("Keys need at least %d random characters", minKeyRandomChars)}
+	}
+	return f, nil
+}
+
+// validateKeyPrefix checks that a prefix only uses alphabet characters, so it
+// survives normalization and takes part in the checksum.
+func validateKeyPrefix(prefix string) error {
+	if len(prefix) > maxKeyPrefixLen {
+		return &keyError{http.StatusBadRequest, fmt.Sprintf("Key prefix cannot be longer than %d characters", maxKeyPrefixLen)}
+	}
+	for i := 0; i < len(prefix); i++ {
+		if strings.IndexByte(crockfordAlphabet, prefix[i]) < 0 {
+			return &keyError{http.StatusBadRequest, "Key prefix may only contain the characters " + crockfordAlphabet}
+		}
+	}
+	return nil
+}
+
+func generateActivationKey(f keyFormat) (string, error) {
+	n := f.GroupLength*f.Groups - 1
+	bytes := make([]byte, n)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+	body := make([]byte, n)
+	for i, b := range bytes {
+		// 256 is a multiple of 32, so this is uniform.
+		body[i] = crockfordAlphabet[b&31]
+	}
+	body = append(body, keyCheckChar(f.Prefix+string(body)))
+
+	groups := make([]string, 0, f.Groups+1)
+	if f.Prefix != "" {
+		groups = append(groups, f.Prefix)
+	}
+	for i := 0; i < len(body); i += f.GroupLength {
+		groups = append(groups, string(body[i:i+f.GroupLength]))
+	}
+	return strings.Join(groups, "-"), nil
+}
+
+// normalizeActivationKey upper-cases a key typed by a user, drops whitespace,
+// and maps the look-alike characters I, L and O back to the alphabet.
+func normalizeActivationKey(key string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(key) {
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		case 'I', 'L':
+			c = '1'
+		case 'O':
+			c = '0'
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// checkActivationKey reports whether a normalized key is well-formed. It is
+// run before the database lookup so typos get a distinct error.
+func checkActivationKey(key string) bool {
+	if legacyKeyPattern.MatchString(key) {
+		return true
+	}
+	chars := strings.ReplaceAll(key, "-", "")
+	if len(chars) < minKeyRandomChars+1 {
+		return false
+	}
+	for i := 0; i < len(chars); i++ {
+		if strings.IndexByte(crockfordAlphabet, chars[i]) < 0 {
+			return false
+		}
+	}
+	return keyCheckChar(chars[:len(chars)-1]) == chars[len(chars)-1]
+}
+
+// keyCheckChar computes the Luhn mod 32 check character of s, which catches
+// every single-character typo and most swaps of adjacent characters.
+func keyCheckChar(s string) byte {
+	const n = len(crockfordAlphabet)
+	factor, sum := 2, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		addend := factor * strings.IndexByte(crockfordAlphabet, s[i])
+		addend = addend/n + addend%n
+		sum += addend
+		factor = 3 - factor
+	}
+	return crockfordAlphabet[(n-sum%n)%n]
+}
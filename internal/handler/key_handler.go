@@ -5,7 +5,6 @@ import (
 	"astralis.backend/internal/middleware"
 	"database/sql"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"time"
 )
@@ -19,7 +18,8 @@ func ActivateKeyHandler(w http.ResponseWriter, r *http.Request) {
 	userID := claims.Subject
 
 	var req struct {
-		Key string `json:"key"`
+		Key            string `json:"key"`
+		TurnstileToken string `json:"turnstileToken"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
@@ -29,6 +29,20 @@ func ActivateKeyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"Key is required"}`, http.StatusBadRequest)
 		return
 	}
+	req.Key = normalizeActivationKey(req.Key)
+	ip := clientIP(r)
+
+	status, body, attemptID := redeemGuard(userID, ip, req.Key, req.TurnstileToken)
+	if status != 0 {
+		http.Error(w, body, status)
+		return
+	}
+
+	if !checkActivationKey(req.Key) {
+		finishRedeemAttempt(attemptID, redeemMalformed)
+		http.Error(w, `{"error":"This key looks like a typo, please check it and try again","code":"key_malformed"}`, http.StatusBadRequest)
+		return
+	}
 
 	tx, err := database.DB.Begin()
 	if err != nil {
@@ -37,54 +51,52 @@ func ActivateKeyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer tx.Rollback()
 
-	var keyID, durationDays int
+	var keyID int
+	var keyType string
+	var params keyParams
+	var productID sql.NullInt64
+	var grantRole sql.NullString
+	var owner sql.NullString
 	var isUsed bool
-	query := "SELECT id, duration_days, is_used FROM activation_keys WHERE key_string = ? FOR UPDATE"
-	err = tx.QueryRow(query, req.Key).Scan(&keyID, &durationDays, &isUsed)
+	query := "SELECT id, key_type, duration_days, product_id, grant_role, owner_user_id, is_used FROM activation_keys WHERE key_string = ? FOR UPDATE"
+	err = tx.QueryRow(query, req.Key).Scan(&keyID, &keyType, &params.DurationDays, &productID, &grantRole, &owner, &isUsed)
 
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, `{"error":"Invalid activation key"}`, http.StatusNotFound)
-			return
-		}
+	if err != nil && err != sql.ErrNoRows {
 		http.Error(w, `{"error":"Server error on key lookup"}`, http.StatusInternalServerError)
 		return
 	}
 
-	if isUsed {
-		http.Error(w, `{"error":"Activation key has already been used"}`, http.StatusConflict)
+	// Unknown, used and someone else's keys get the same answer, so the
+	// response does not reveal which keys exist.
+	if err == sql.ErrNoRows || isUsed || (owner.Valid && owner.String != userID) {
+		finishRedeemAttempt(attemptID, redeemInvalid)
+		http.Error(w, `{"error":"Invalid or already used activation key","code":"key_invalid"}`, http.StatusNotFound)
 		return
 	}
-	
-	var message string
-	if durationDays > 0 {
-		var currentSub sql.NullTime
-		err := tx.QueryRow("SELECT subscription_expires_at FROM users WHERE id = ?", userID).Scan(&currentSub)
-		if err != nil {
-			http.Error(w, `{"error":"Failed to get current subscription"}`, http.StatusInternalServerError)
-			return
-		}
-		
-		newExpiryDate := time.Now()
-		if currentSub.Valid && currentSub.Time.After(newExpiryDate) {
-			newExpiryDate = currentSub.Time
-		}
-		newExpiryDate = newExpiryDate.Add(time.Duration(durationDays) * 24 * time.Hour)
-		
-		_, err = tx.Exec("UPDATE users SET subscription_expires_at = ? WHERE id = ?", newExpiryDate, userID)
-		if err != nil {
-			http.Error(w, `{"error":"Failed to update user subscription"}`, http.StatusInternalServerError)
-			return
-		}
-		message = fmt.Sprintf("Subscription extended for %d days", durationDays)
+	params.KeyID = keyID
+	if productID.Valid {
+		id := int(productID.Int64)
+		params.ProductID = &id
+	}
+	if grantRole.Valid {
+		params.GrantRole = &grantRole.String
+	}
 
-	} else {
-		_, err := tx.Exec("UPDATE users SET hwid = NULL WHERE id = ?", userID)
-		if err != nil {
-			http.Error(w, `{"error":"Failed to reset HWID"}`, http.StatusInternalServerError)
+	kt, ok := keyTypes[keyType]
+	if !ok {
+		http.Error(w, `{"error":"Unsupported key type"}`, http.StatusInternalServerError)
+		return
+	}
+	message, err := kt.redeem(tx, userID, params)
+	if err != nil {
+		writeKeyError(w, err, "Failed to apply activation key")
+		return
+	}
+	if kt.paid {
+		if err := completeReferral(tx, userID); err != nil {
+			writeKeyError(w, err, "Failed to apply activation key")
 			return
 		}
-		message = "HWID has been successfully reset"
 	}
 
 	_, err = tx.Exec("UPDATE activation_keys SET is_used = TRUE, used_by_user_id = ?, used_at = ? WHERE id = ?", userID, time.Now(), keyID)
@@ -97,6 +109,7 @@ func ActivateKeyHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
 		return
 	}
+	finishRedeemAttempt(attemptID, redeemSuccess)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
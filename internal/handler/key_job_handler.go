@@ -0,0 +1,372 @@
+package handler
+
+import (
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"crypto/rand"
+	"database/sql"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxKeyJobQuantity = 100000
+	keyJobChunkSize   = 500
+	// Give up on a chunk if random keys keep colliding with existing ones.
+	maxKeyCollisionRetries = 10
+	// A claimed job is renewed after every chunk; another instance may take
+	// it over once the claim has lapsed.
+	keyJobClaimTTL = 2 * time.Minute
+)
+
+// keyJobWorkerID names this process in key_generation_jobs.claimed_by.
+var keyJobWorkerID = func() string {
+	host, _ := os.Hostname()
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}()
+
+var errKeyJobLost = errors.New("job was claimed by another instance")
+
+// isDuplicateKey reports whether err is MySQL's duplicate entry error.
+func isDuplicateKey(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
+func AdminCreateKeyJobHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	adminID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		http.Error(w, `{"error":"Invalid user ID in token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var req struct {
+		KeyType      string  `json:"key_type"`
+		DurationDays int     `json:"duration_days"`
+		ProductID    *int    `json:"product_id"`
+		GrantRole    *string `json:"grant_role"`
+		Quantity     int     `json:"quantity"`
+		Prefix       string  `json:"prefix"`
+		GroupLength  int     `json:"group_length"`
+		Groups       int     `json:"groups"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	if req.KeyType == "" {
+		req.KeyType = model.KeyTypeSubscription
+	}
+	if req.DurationDays < 0 {
+		http.Error(w, `{"error":"Duration cannot be negative"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Quantity <= 0 || req.Quantity > maxKeyJobQuantity {
+		jsonError(w, fmt.Sprintf("Quantity must be between 1 and %d", maxKeyJobQuantity), http.StatusBadRequest)
+		return
+	}
+	kt, ok := keyTypes[req.KeyType]
+	if !ok {
+		http.Error(w, `{"error":"Unknown key type"}`, http.StatusBadRequest)
+		return
+	}
+	if err := kt.validate(keyParams{DurationDays: req.DurationDays, ProductID: req.ProductID, GrantRole: req.GrantRole}); err != nil {
+		writeKeyError(w, err, "Failed to validate key parameters")
+		return
+	}
+	format, err := resolveKeyFormat(req.Prefix, req.GroupLength, req.Groups, req.ProductID)
+	if err != nil {
+		writeKeyError(w, err, "Failed to validate key format")
+		return
+	}
+
+	res, err := database.DB.Exec(
+		"INSERT INTO key_generation_jobs (status, key_type, duration_days, product_id, grant_role, key_prefix, group_length, group_count, quantity, created_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		model.KeyJobPending, req.KeyType, req.DurationDays, req.ProductID, req.GrantRole, format.Prefix, format.GroupLength, format.Groups, req.Quantity, adminID,
+	)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to create key generation job"}`, http.StatusInternalServerError)
+		return
+	}
+	jobID, _ := res.LastInsertId()
+
+	go runKeyGenerationJob(int(jobID))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"job_id":     jobID,
+		"status_url": fmt.Sprintf("/api/admin/key-jobs/%d", jobID),
+	})
+}
+
+func AdminGetKeyJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid job ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	job, err := loadKeyGenerationJob(jobID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Job not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Failed to load job"}`, http.StatusInternalServerError)
+		return
+	}
+	if job.Status == model.KeyJobCompleted {
+		exportURL := fmt.Sprintf("/api/admin/key-jobs/%d/export", job.ID)
+		job.ExportURL = &exportURL
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// AdminExportKeyJobHandler streams the keys of a finished job as CSV.
+func AdminExportKeyJobHandler(w http.ResponseWriter, r *http.Request) {
+	jobID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid job ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	job, err := loadKeyGenerationJob(jobID)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Job not found"}`, http.StatusNotFound)
+			return
+		}
+		http.Error(w, `{"error":"Failed to load job"}`, http.StatusInternalServerError)
+		return
+	}
+	if job.Status != model.KeyJobCompleted {
+		http.Error(w, `{"error":"Job has not completed yet"}`, http.StatusConflict)
+		return
+	}
+
+	rows, err := database.DB.Query("SELECT key_string, key_type, duration_days FROM activation_keys WHERE job_id = ? ORDER BY id", jobID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query keys"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="keys-job-%d.csv"`, jobID))
+
+	// The status line is gone by the time a row fails, so a failed export
+	// aborts the response; the admin gets a broken download rather than a
+	// CSV that looks complete.
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"key", "key_type", "duration_days"})
+	for rows.Next() {
+		var key, keyType string
+		var durationDays int
+		if err := rows.Scan(&key, &keyType, &durationDays); err != nil {
+			log.Printf("key job %d export: %v", jobID, err)
+			panic(http.ErrAbortHandler)
+		}
+		if err := cw.Write([]string{key, keyType, strconv.Itoa(durationDays)}); err != nil {
+			log.Printf("key job %d export: %v", jobID, err)
+			panic(http.ErrAbortHandler)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("key job %d export: %v", jobID, err)
+		panic(http.ErrAbortHandler)
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Printf("key job %d export: %v", jobID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// ResumeKeyGenerationJobs restarts jobs that were interrupted by a shutdown.
+// Each chunk is committed together with the job's progress, so a resumed job
+// continues exactly where it stopped. Jobs still claimed by a live instance
+// are left to it.
+func ResumeKeyGenerationJobs() {
+	rows, err := database.DB.Query("SELECT id FROM key_generation_jobs WHERE status IN (?, ?)", model.KeyJobPending, model.KeyJobRunning)
+	if err != nil {
+		log.Printf("Could not load unfinished key generation jobs: %v", err)
+		return
+	}
+	var jobIDs []int
+	for rows.Next() {
+		var jobID int
+		if err := rows.Scan(&jobID); err == nil {
+			jobIDs = append(jobIDs, jobID)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("Could not load unfinished key generation jobs: %v", err)
+	}
+	rows.Close()
+
+	for _, jobID := range jobIDs {
+		go runKeyGenerationJob(jobID)
+	}
+}
+
+// claimKeyGenerationJob takes or renews this instance's claim on a job. It
+// fails when the job is finished or another instance holds a live claim.
+func claimKeyGenerationJob(jobID int) (bool, error) {
+	res, err := database.DB.Exec(`
+		UPDATE key_generation_jobs SET status = ?, claimed_by = ?, claimed_until = ?
+		WHERE id = ? AND status IN (?, ?) AND (claimed_by IS NULL OR claimed_by = ? OR claimed_until < ?)`,
+		model.KeyJobRunning, keyJobWorkerID, time.Now().Add(keyJobClaimTTL),
+		jobID, model.KeyJobPending, model.KeyJobRunning, keyJobWorkerID, time.Now())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// finishKeyGenerationJob records the outcome of a job this instance holds.
+func finishKeyGenerationJob(jobID int, status string, jobErr *string) {
+	_, err := database.DB.Exec("UPDATE key_generation_jobs SET status = ?, error = ?, finished_at = ?, claimed_until = NULL WHERE id = ? AND claimed_by = ?",
+		status, jobErr, time.Now(), jobID, keyJobWorkerID)
+	if err != nil {
+		log.Printf("key job %d: could not mark it %s: %v", jobID, status, err)
+	}
+}
+
+func loadKeyGenerationJob(jobID int) (*model.KeyGenerationJob, error) {
+	var job model.KeyGenerationJob
+	var productID sql.NullInt64
+	var grantRole, jobErr sql.NullString
+	var finishedAt sql.NullTime
+
+	query := "SELECT id, status, key_type, duration_days, product_id, grant_role, key_prefix, group_length, group_count, quantity, generated, error, created_by, created_at, finished_at FROM key_generation_jobs WHERE id = ?"
+	err := database.DB.QueryRow(query, jobID).Scan(&job.ID, &job.Status, &job.KeyType, &job.DurationDays, &productID, &grantRole,
+		&job.KeyPrefix, &job.GroupLength, &job.Groups, &job.Quantity, &job.Generated, &jobErr, &job.CreatedBy, &job.CreatedAt, &finishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if productID.Valid {
+		id := int(productID.Int64)
+		job.ProductID = &id
+	}
+	if grantRole.Valid {
+		job.GrantRole = &grantRole.String
+	}
+	if jobErr.Valid {
+		job.Error = &jobErr.String
+	}
+	if finishedAt.Valid {
+		job.FinishedAt = &finishedAt.Time
+	}
+	return &job, nil
+}
+
+func runKeyGenerationJob(jobID int) {
+	job, err := loadKeyGenerationJob(jobID)
+	if err != nil {
+		log.Printf("key job %d: could not load: %v", jobID, err)
+		return
+	}
+
+	for job.Generated < job.Quantity {
+		claimed, err := claimKeyGenerationJob(jobID)
+		if err != nil {
+			log.Printf("key job %d: could not claim: %v", jobID, err)
+			return
+		}
+		if !claimed {
+			return
+		}
+
+		n := job.Quantity - job.Generated
+		if n > keyJobChunkSize {
+			n = keyJobChunkSize
+		}
+		if err := generateKeyChunk(job, n); err == errKeyJobLost {
+			log.Printf("key job %d: taken over by another instance", jobID)
+			return
+		} else if err != nil {
+			log.Printf("key job %d failed: %v", jobID, err)
+			message := err.Error()
+			finishKeyGenerationJob(jobID, model.KeyJobFailed, &message)
+			return
+		}
+		job.Generated += n
+	}
+
+	finishKeyGenerationJob(jobID, model.KeyJobCompleted, nil)
+}
+
+// generateKeyChunk inserts n new keys for the job in one transaction. If a
+// key collides with an existing key_string the insert fails as a whole and
+// is retried with fresh keys; any other error fails the chunk. Progress is
+// only counted while this instance still holds the job.
+func generateKeyChunk(job *model.KeyGenerationJob, n int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	format := keyFormat{Prefix: job.KeyPrefix, GroupLength: job.GroupLength, Groups: job.Groups}
+	for attempt := 0; ; attempt++ {
+		if attempt >= maxKeyCollisionRetries {
+			return fmt.Errorf("too many key collisions")
+		}
+
+		placeholders := make([]string, 0, n)
+		args := make([]interface{}, 0, n*6)
+		for i := 0; i < n; i++ {
+			key, err := generateActivationKey(format)
+			if err != nil {
+				return err
+			}
+			placeholders = append(placeholders, "(?, ?, ?, ?, ?, ?)")
+			args = append(args, key, job.KeyType, job.DurationDays, job.ProductID, job.GrantRole, job.ID)
+		}
+
+		query := "INSERT INTO activation_keys (key_string, key_type, duration_days, product_id, grant_role, job_id) VALUES " + strings.Join(placeholders, ", ")
+		_, err := tx.Exec(query, args...)
+		if err == nil {
+			break
+		}
+		if !isDuplicateKey(err) {
+			return err
+		}
+	}
+
+	res, err := tx.Exec("UPDATE key_generation_jobs SET generated = generated + ? WHERE id = ? AND claimed_by = ?", n, job.ID, keyJobWorkerID)
+	if err != nil {
+		return err
+	}
+	if updated, err := res.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return errKeyJobLost
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,245 @@
+package handler
+
+import (
+	"astralis.backend/internal/model"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// lifetimeExpiry is stored in users.subscription_expires_at for lifetime access.
+var lifetimeExpiry = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+
+// maxKeyDurationDays is the longest a subscription key may last, ten years.
+const maxKeyDurationDays = 3650
+
+// addDays moves t by whole days, stopping at lifetimeExpiry.
+func addDays(t time.Time, days int) time.Time {
+	t = t.AddDate(0, 0, days)
+	if t.After(lifetimeExpiry) {
+		return lifetimeExpiry
+	}
+	return t
+}
+
+// keyParams holds the type-specific columns of an activation key.
+type keyParams struct {
+	KeyID        int
+	DurationDays int
+	ProductID    *int
+	GrantRole    *string
+}
+
+// keyError is returned by a key type's validate or redeem to send a specific
+// status and message back to the client.
+type keyError struct {
+	Status  int
+	Message string
+}
+
+func (e *keyError) Error() string { return e.Message }
+
+// keyTypeHandler describes how keys of one type are created and redeemed.
+// New key effects are added by registering another handler; ActivateKeyHandler
+// does not need to know about them.
+type keyTypeHandler struct {
+	// validate checks the admin's parameters before keys are generated.
+	validate func(p keyParams) error
+	// redeem applies the key to the user inside the redeem transaction and
+	// returns the message shown to the user.
+	redeem func(tx *sql.Tx, userID string, p keyParams) (string, error)
+	// paid marks keys that grant access users pay for. Redeeming one
+	// completes the redeemer's referral.
+	paid bool
+}
+
+var keyTypes = map[string]keyTypeHandler{}
+
+func registerKeyType(name string, h keyTypeHandler) {
+	keyTypes[name] = h
+}
+
+func init() {
+	// Subscription and lifetime keys bound to a product extend that product's
+	// subscription; unbound keys extend the global one.
+	registerKeyType(model.KeyTypeSubscription, keyTypeHandler{
+		paid: true,
+		validate: func(p keyParams) error {
+			if p.DurationDays <= 0 {
+				return &keyError{http.StatusBadRequest, "Subscription keys need a positive duration"}
+			}
+			if p.DurationDays > maxKeyDurationDays {
+				return &keyError{http.StatusBadRequest, fmt.Sprintf("Subscription keys can last at most %d days", maxKeyDurationDays)}
+			}
+			if p.ProductID != nil {
+				return validateProductExists(*p.ProductID)
+			}
+			return nil
+		},
+		redeem: func(tx *sql.Tx, userID string, p keyParams) (string, error) {
+			if p.ProductID != nil {
+				err := grantProductSubscription(tx, userID, *p.ProductID, p.DurationDays, model.SubscriptionSourceKey, &p.KeyID)
+				if err != nil {
+					return "", err
+				}
+				return fmt.Sprintf("Product subscription extended for %d days", p.DurationDays), nil
+			}
+			if err := extendSubscription(tx, userID, p.DurationDays); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("Subscription extended for %d days", p.DurationDays), nil
+		},
+	})
+
+	registerKeyType(model.KeyTypeHwidReset, keyTypeHandler{
+		validate: func(p keyParams) error { return nil },
+		redeem: func(tx *sql.Tx, userID string, p keyParams) (string, error) {
+			if _, err := tx.Exec("UPDATE users SET hwid = NULL WHERE id = ?", userID); err != nil {
+				return "", &keyError{http.StatusInternalServerError, "Failed to reset HWID"}
+			}
+			if _, err := tx.Exec("DELETE FROM user_devices WHERE user_id = ?", userID); err != nil {
+				return "", &keyError{http.StatusInternalServerError, "Failed to reset HWID"}
+			}
+			return "HWID has been successfully reset", nil
+		},
+	})
+
+	registerKeyType(model.KeyTypeLifetime, keyTypeHandler{
+		paid: true,
+		validate: func(p keyParams) error {
+			if p.ProductID != nil {
+				return validateProductExists(*p.ProductID)
+			}
+			return nil
+		},
+		redeem: func(tx *sql.Tx, userID string, p keyParams) (string, error) {
+			if p.ProductID != nil {
+				err := grantProductLifetime(tx, userID, *p.ProductID, model.SubscriptionSourceKey, &p.KeyID)
+				if err != nil {
+					return "", err
+				}
+				return "Lifetime access to the product activated", nil
+			}
+			if _, err := tx.Exec("SELECT id FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+				return "", &keyError{http.StatusInternalServerError, "Failed to update user subscription"}
+			}
+			if err := endFreeze(tx, userID, nil); err != nil {
+				return "", &keyError{http.StatusInternalServerError, "Failed to update user subscription"}
+			}
+			_, err := tx.Exec("UPDATE users SET subscription_expires_at = ? WHERE id = ?", lifetimeExpiry, userID)
+			if err != nil {
+				return "", &keyError{http.StatusInternalServerError, "Failed to update user subscription"}
+			}
+			return "Lifetime access activated", nil
+		},
+	})
+
+	registerKeyType(model.KeyTypeProductUnlock, keyTypeHandler{
+		paid: true,
+		validate: func(p keyParams) error {
+			if p.ProductID == nil {
+				return &keyError{http.StatusBadRequest, "Product unlock keys need a product_id"}
+			}
+			return validateProductExists(*p.ProductID)
+		},
+		redeem: func(tx *sql.Tx, userID string, p keyParams) (string, error) {
+			if p.ProductID == nil {
+				return "", &keyError{http.StatusInternalServerError, "Key has no product"}
+			}
+			var unlocked bool
+			err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM subscriptions WHERE user_id = ? AND product_id = ? AND expires_at >= ?)",
+				userID, *p.ProductID, lifetimeExpiry).Scan(&unlocked)
+			if err != nil {
+				return "", &keyError{http.StatusInternalServerError, "Failed to unlock product"}
+			}
+			if unlocked {
+				return "", &keyError{http.StatusConflict, "Product is already unlocked"}
+			}
+			err = grantProductLifetime(tx, userID, *p.ProductID, model.SubscriptionSourceKey, &p.KeyID)
+			if err != nil {
+				return "", err
+			}
+			return "Product unlocked", nil
+		},
+	})
+
+	registerKeyType(model.KeyTypeRoleGrant, keyTypeHandler{
+		validate: func(p keyParams) error {
+			if p.GrantRole == nil || *p.GrantRole == "" {
+				return &keyError{http.StatusBadRequest, "Role grant keys need a grant_role"}
+			}
+			switch *p.GrantRole {
+			case model.RoleUser, model.RoleTester:
+				return nil
+			case model.RoleAdmin:
+				return &keyError{http.StatusBadRequest, "The admin role cannot be granted by key"}
+			}
+			return &keyError{http.StatusBadRequest, "Unknown role " + *p.GrantRole}
+		},
+		redeem: func(tx *sql.Tx, userID string, p keyParams) (string, error) {
+			if p.GrantRole == nil {
+				return "", &keyError{http.StatusInternalServerError, "Key has no role"}
+			}
+			// Never downgrade an admin who redeems a role key.
+			_, err := tx.Exec("UPDATE users SET role = ? WHERE id = ? AND (role IS NULL OR role <> 'admin')", *p.GrantRole, userID)
+			if err != nil {
+				return "", &keyError{http.StatusInternalServerError, "Failed to grant role"}
+			}
+			return fmt.Sprintf("Role %s granted", *p.GrantRole), nil
+		},
+	})
+
+	registerKeyType(model.KeyTypeExtraDeviceSlot, keyTypeHandler{
+		validate: func(p keyParams) error { return nil },
+		redeem: func(tx *sql.Tx, userID string, p keyParams) (string, error) {
+			_, err := tx.Exec("UPDATE users SET extra_device_slots = extra_device_slots + 1 WHERE id = ?", userID)
+			if err != nil {
+				return "", &keyError{http.StatusInternalServerError, "Failed to add device slot"}
+			}
+			return "An extra device slot has been added", nil
+		},
+	})
+}
+
+// extendSubscription adds days to the user's subscription, counting from the
+// current expiry if it is still in the future.
+func extendSubscription(tx *sql.Tx, userID string, days int) error {
+	if frozen, err := addFrozenTime(tx, userID, nil, days); err != nil || frozen {
+		if err != nil {
+			return &keyError{http.StatusInternalServerError, "Failed to get current subscription"}
+		}
+		return nil
+	}
+
+	var currentSub sql.NullTime
+	err := tx.QueryRow("SELECT subscription_expires_at FROM users WHERE id = ? FOR UPDATE", userID).Scan(&currentSub)
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to get current subscription"}
+	}
+	if currentSub.Valid && !currentSub.Time.Before(lifetimeExpiry) {
+		return nil
+	}
+
+	newExpiryDate := time.Now()
+	if currentSub.Valid && currentSub.Time.After(newExpiryDate) {
+		newExpiryDate = currentSub.Time
+	}
+	newExpiryDate = addDays(newExpiryDate, days)
+
+	_, err = tx.Exec("UPDATE users SET subscription_expires_at = ? WHERE id = ?", newExpiryDate, userID)
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to update user subscription"}
+	}
+	return nil
+}
+
+// writeKeyError sends err to the client, using its status and message when it
+// is a *keyError.
+func writeKeyError(w http.ResponseWriter, err error, fallback string) {
+	if ke, ok := err.(*keyError); ok {
+		jsonError(w, ke.Message, ke.Status)
+		return
+	}
+	jsonError(w, fallback, http.StatusInternalServerError)
+}
@@ -1,63 +1,292 @@
 package handler
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
-	"io"
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/middleware"
+	"bufio"
+	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
+// optionalFilesList names the file in the release directory that lists the
+// optional files, one glob per line. A pattern ending in a slash covers
+// everything under that directory. Dotfiles are never put in the manifest.
+const optionalFilesList = ".optional"
+
 type GameFile struct {
-	Path string `json:"path"`
-	Hash string `json:"hash"`
-	Size int64  `json:"size"`
+	Path     string      `json:"path"`
+	Hash     string      `json:"hash"`
+	Size     int64       `json:"size"`
+	URL      string      `json:"url"`
+	Mode     string      `json:"mode"`
+	Optional bool        `json:"optional,omitempty"`
+	Chunks   []FileChunk `json:"chunks,omitempty"`
+	// Patches lead from older versions of the file to this one; see
+	// patchChains.
+	Patches []FilePatch `json:"patches,omitempty"`
+}
+
+// FilePatch is a binary delta from one version of a file to another.
+type FilePatch struct {
+	From string `json:"from"`
+	To   string `json:"to"`
 	URL  string `json:"url"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
 }
 
-func GetManifestHandler(w http.ResponseWriter, r *http.Request) {
-	filePath := "./game_files/client.zip"
-	
-	file, err := os.Open(filePath)
+// readOptionalPatterns loads the optional file patterns of a release
+// directory. A release without the list has no optional files.
+func readOptionalPatterns(dir string) ([]string, error) {
+	file, err := os.Open(filepath.Join(dir, optionalFilesList))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
-		log.Printf("ОШИБКА: Не могу открыть файл для манифеста: %v", err)
-		http.Error(w, `{"error":"Файл на сервере не найден"}`, http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 	defer file.Close()
 
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		log.Printf("ОШИБКА: Не могу посчитать хеш файла: %v", err)
-		http.Error(w, `{"error":"Ошибка чтения файла на сервере"}`, http.StatusInternalServerError)
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, strings.TrimPrefix(line, "/"))
+	}
+	return patterns, scanner.Err()
+}
+
+func matchesOptional(rel string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "/") {
+			if strings.HasPrefix(rel, pattern) {
+				return true
+			}
+			continue
+		}
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isReservedGameFilesDir reports whether a directory holds release data
+// rather than game files, so the flat game_files manifest leaves it out.
+func isReservedGameFilesDir(name string) bool {
+	return name == releaseBuildsDir() || name == releasePatchesDir() || name == chunksDir()
+}
+
+// downloadURL is where the launcher fetches a file of a release from;
+// urlBase is the download path of the release directory.
+func downloadURL(urlBase, rel string) string {
+	segments := strings.Split(rel, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return urlBase + strings.Join(segments, "/")
+}
+
+// fileStamp identifies one version of a file on disk without reading it.
+type fileStamp struct {
+	Size    int64
+	ModTime int64
+}
+
+type hashedFile struct {
+	Stamp  fileStamp
+	Hash   string
+	Chunks []FileChunk
+}
+
+// buildManifest walks a release directory and describes every regular file
+// in it, sorted by path. Symlinks and dotfiles are skipped. Files whose size
+// and modification time match an entry in known are not hashed again; the
+// returned map holds the hashes for the next build.
+func buildManifest(dir, urlBase string, known map[string]hashedFile) ([]GameFile, map[string]hashedFile, error) {
+	patterns, err := readOptionalPatterns(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest := []GameFile{}
+	hashes := map[string]hashedFile{}
+	err = filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name != dir && (strings.HasPrefix(d.Name(), ".") || isReservedGameFilesDir(name)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		stamp := fileStamp{Size: info.Size(), ModTime: info.ModTime().UnixNano()}
+		hf, ok := known[rel]
+		if !ok || hf.Stamp != stamp {
+			hash, chunks, err := hashFile(name)
+			if err != nil {
+				return err
+			}
+			hf = hashedFile{Stamp: stamp, Hash: hash, Chunks: chunks}
+		}
+		hashes[rel] = hf
+
+		manifest = append(manifest, GameFile{
+			Path:     rel,
+			Hash:     hf.Hash,
+			Chunks:   hf.Chunks,
+			Size:     info.Size(),
+			URL:      downloadURL(urlBase, rel),
+			Mode:     fmt.Sprintf("%04o", info.Mode().Perm()),
+			Optional: matchesOptional(rel, patterns),
+		})
+		return nil
+	})
+	return manifest, hashes, err
+}
+
+// GetManifestHandler serves the cached manifest of the release the user
+// gets on the channel asked for, stable by default. Launchers that send the
+// manifest's ETag back in If-None-Match get a 304 while nothing changed.
+func GetManifestHandler(w http.ResponseWriter, r *http.Request) {
+	channel, rel, err := resolveLauncherRelease(r)
+	if err == nil {
+		err = checkLauncherVersion(r, rel)
+	}
+	if err != nil {
+		writeKeyError(w, err, "Failed to look up release")
 		return
 	}
-	hash := hex.EncodeToString(hasher.Sum(nil))
+	build := ""
+	if rel != nil {
+		build = rel.Build
+	}
 
-	fileInfo, err := file.Stat()
+	cache := manifestFor(build)
+	m, err := cache.get()
 	if err != nil {
-		log.Printf("ОШИБКА: Не могу получить информацию о файле: %v", err)
-		http.Error(w, `{"error":"Ошибка чтения файла на сервере"}`, http.StatusInternalServerError)
+		log.Printf("ОШИБКА: Не могу собрать манифест канала %s: %v", channel.Name, err)
+		http.Error(w, `{"error":"Ошибка чтения файлов на сервере"}`, http.StatusInternalServerError)
 		return
 	}
-	size := fileInfo.Size()
+	if rel != nil {
+		verifyReleaseManifest(rel, m)
+		w.Header().Set("X-Release-Version", rel.Version)
+		if rel.MinLauncherVersion != nil {
+			w.Header().Set("X-Min-Launcher-Version", *rel.MinLauncherVersion)
+		}
+	}
 
-	manifest := []GameFile{
-		{
-			Path: "client.zip",
-			Hash: hash,
-			Size: size,
-			URL:  "/api/launcher/download/client.zip",
-		},
+	if err := setManifestSignature(w, channel.Name, rel, m); err != nil {
+		writeKeyError(w, err, "Failed to sign manifest")
+		return
+	}
+	m, err = cache.withSignedURLs(m)
+	if err != nil {
+		log.Printf("Failed to sign the download URLs of channel %s: %v", channel.Name, err)
+		http.Error(w, `{"error":"Failed to prepare download links"}`, http.StatusInternalServerError)
+		return
 	}
 
+	w.Header().Set("X-Release-Channel", channel.Name)
+	w.Header().Set("ETag", m.ETag)
+	w.Header().Set("Cache-Control", "no-cache")
+	if etagMatches(r.Header.Get("If-None-Match"), m.ETag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(manifest)
+	w.Write(m.Body)
+}
+
+// validDownloadKey reports whether a path under game_files may be asked
+// for at all: no empty, dot or dot-prefixed segments.
+func validDownloadKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || strings.HasPrefix(segment, ".") {
+			return false
+		}
+	}
+	return true
 }
 
+// DownloadFileHandler serves a file from game_files, but only one listed in
+// the manifest of a release the user gets on a channel they may use, or a
+// patch such a manifest lists.
 func DownloadFileHandler(w http.ResponseWriter, r *http.Request) {
-	fs := http.StripPrefix("/api/launcher/download/", http.FileServer(http.Dir("./game_files/")))
-	fs.ServeHTTP(w, r)
-}
\ No newline at end of file
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/api/launcher/download/")
+	if !validDownloadKey(key) {
+		http.Error(w, `{"error":"File not found"}`, http.StatusNotFound)
+		return
+	}
+
+	builds, err := userReleaseBuilds(claims.Subject)
+	if err != nil {
+		writeKeyError(w, err, "Failed to look up releases")
+		return
+	}
+	listed := false
+	for _, build := range builds {
+		m, err := manifestFor(build).get()
+		if err != nil {
+			log.Printf("Failed to build the manifest of build %q: %v", build, err)
+			continue
+		}
+		if m.Keys[key] {
+			listed = true
+			break
+		}
+	}
+	if !listed {
+		http.Error(w, `{"error":"File not found"}`, http.StatusNotFound)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(config.Cfg.GameFilesDir, filepath.FromSlash(key)))
+	if err != nil {
+		http.Error(w, `{"error":"File not found"}`, http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.Error(w, `{"error":"File not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, path.Base(key), info.ModTime(), file)
+}
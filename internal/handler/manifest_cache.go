@@ -0,0 +1,291 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cachedManifest is a built manifest together with its encoded body, so
+// requests never touch the release directory. ETag covers the whole body
+// but the URLs, FilesHash only the path, hash and size of each file; see
+// manifestETag and filesHash.
+type cachedManifest struct {
+	Files     []GameFile
+	Body      []byte
+	ETag      string
+	FilesHash string
+	BuiltAt   time.Time
+	// Keys holds the paths under game_files of the files and patches the
+	// manifest lists, the only ones DownloadFileHandler serves.
+	Keys map[string]bool
+
+	// signed is the copy with signed store URLs for the current window,
+	// valid until expires; see withSignedURLs. signatures holds the online
+	// signature of the manifest by channel; see onlineManifestSignature.
+	signedMu   sync.Mutex
+	signed     *cachedManifest
+	expires    time.Time
+	signatures map[string]*manifestSignature
+}
+
+// manifestCache keeps the manifest of one release directory. Rebuilding it
+// only stats files; a file is hashed again only when its size or
+// modification time changes.
+type manifestCache struct {
+	dir         string
+	urlBase     string
+	keyPrefix   string
+	withPatches bool
+
+	buildMu sync.Mutex
+	hashes  map[string]hashedFile
+
+	mu      sync.RWMutex
+	current *cachedManifest
+}
+
+var (
+	manifestCachesMu sync.Mutex
+	manifestCaches   = map[string]*manifestCache{}
+)
+
+// manifestFor returns the manifest cache of a build; the empty build is the
+// flat game_files directory.
+func manifestFor(build string) *manifestCache {
+	manifestCachesMu.Lock()
+	defer manifestCachesMu.Unlock()
+	c, ok := manifestCaches[build]
+	if !ok {
+		c = &manifestCache{dir: config.Cfg.GameFilesDir, urlBase: "/api/launcher/download/"}
+		if build != "" {
+			c.dir = filepath.Join(releaseBuildsDir(), build)
+			c.urlBase += releaseBuildsPath + "/" + build + "/"
+			c.keyPrefix = releaseBuildsPath + "/" + build + "/"
+			c.withPatches = true
+		}
+		manifestCaches[build] = c
+	}
+	return c
+}
+
+// cachedManifests returns every manifest cache built so far, by build.
+func cachedManifests() map[string]*manifestCache {
+	manifestCachesMu.Lock()
+	defer manifestCachesMu.Unlock()
+	caches := make(map[string]*manifestCache, len(manifestCaches))
+	for build, c := range manifestCaches {
+		caches[build] = c
+	}
+	return caches
+}
+
+// get returns the cached manifest, building it on first use.
+func (c *manifestCache) get() (*cachedManifest, error) {
+	c.mu.RLock()
+	m := c.current
+	c.mu.RUnlock()
+	if m != nil {
+		return m, nil
+	}
+	m, _, err := c.refresh()
+	return m, err
+}
+
+// refresh rescans the release directory and reports whether the manifest
+// changed since the last scan.
+func (c *manifestCache) refresh() (*cachedManifest, bool, error) {
+	c.buildMu.Lock()
+	defer c.buildMu.Unlock()
+
+	files, hashes, err := buildManifest(c.dir, c.urlBase, c.hashes)
+	if err != nil {
+		return nil, false, err
+	}
+	if c.withPatches {
+		edges, err := loadPatchEdges()
+		if err != nil {
+			return nil, false, err
+		}
+		for i, f := range files {
+			files[i].Patches = patchChains(edges[f.Path], f.Hash, f.Size)
+		}
+	}
+	body, err := json.Marshal(files)
+	if err != nil {
+		return nil, false, err
+	}
+
+	c.mu.RLock()
+	current := c.current
+	c.mu.RUnlock()
+	if current != nil && bytes.Equal(current.Body, body) {
+		c.hashes = hashes
+		return current, false, nil
+	}
+	c.hashes = hashes
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.current = &cachedManifest{
+		Files:     files,
+		Body:      body,
+		ETag:      manifestETag(files),
+		FilesHash: filesHash(files),
+		BuiltAt:   time.Now(),
+		Keys:      manifestDownloadKeys(c.keyPrefix, files),
+	}
+	// The new files are copied to the file store in the background; until
+	// then the manifest sends launchers to the API for them.
+	queueFileStoreSync()
+	return c.current, true, nil
+}
+
+// manifestDownloadKeys returns the paths under game_files of the files and patches
+// in a manifest; keyPrefix is the path of the release directory.
+func manifestDownloadKeys(keyPrefix string, files []GameFile) map[string]bool {
+	keys := make(map[string]bool, len(files))
+	for _, f := range files {
+		keys[keyPrefix+f.Path] = true
+		for _, p := range f.Patches {
+			keys[patchKey(p)] = true
+		}
+	}
+	return keys
+}
+
+// filesHash is the SHA-256, in hex, of the canonical list of a manifest's
+// files: one line per file, in path order, of the quoted path, the hash and
+// the size. It is what a release records when published, so it must not
+// change with the JSON encoding of GameFile, the URLs, chunks or patches.
+func filesHash(files []GameFile) string {
+	h := sha256.New()
+	for _, f := range files {
+		fmt.Fprintf(h, "%s %s %d\n", strconv.Quote(f.Path), f.Hash, f.Size)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// manifestETag is the ETag of a manifest: a hash of its files, chunks and
+// patches without their URLs, which change with every signing window while
+// the files stay the same. A 304 thus only says the files are unchanged; a
+// launcher that has to download something and finds its links expired
+// fetches the manifest again without If-None-Match.
+func manifestETag(files []GameFile) string {
+	bare := make([]GameFile, len(files))
+	for i, f := range files {
+		f.URL = ""
+		if len(f.Chunks) > 0 {
+			chunks := make([]FileChunk, len(f.Chunks))
+			for j, ch := range f.Chunks {
+				ch.URL = ""
+				chunks[j] = ch
+			}
+			f.Chunks = chunks
+		}
+		if len(f.Patches) > 0 {
+			patches := make([]FilePatch, len(f.Patches))
+			for j, p := range f.Patches {
+				p.URL = ""
+				patches[j] = p
+			}
+			f.Patches = patches
+		}
+		bare[i] = f
+	}
+	body, _ := json.Marshal(bare)
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header names the ETag.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshManifests rescans every cached build and returns the builds whose
+// manifest changed.
+func refreshManifests() ([]string, error) {
+	changed := []string{}
+	for build, c := range cachedManifests() {
+		_, ok, err := c.refresh()
+		if err != nil {
+			return changed, fmt.Errorf("build %q: %w", build, err)
+		}
+		if ok {
+			changed = append(changed, build)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// StartManifestWatcher builds the manifests of the releases channels serve
+// at startup and then polls the release directories for changes, so files
+// copied in by a deploy show up without a restart.
+func StartManifestWatcher(ctx context.Context) {
+	builds, err := activeReleaseBuilds()
+	for _, build := range builds {
+		if err == nil {
+			_, _, err = manifestFor(build).refresh()
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to build the launcher manifests: %v", err)
+	}
+
+	interval := time.Duration(config.Cfg.ManifestScanSeconds) * time.Second
+	if interval <= 0 {
+		log.Println("Launcher manifest watcher is disabled, use /api/admin/launcher/rescan after publishing")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if changed, err := refreshManifests(); err != nil {
+				log.Printf("Failed to rescan the launcher files: %v", err)
+			} else if len(changed) > 0 {
+				log.Printf("Launcher files changed, manifests rebuilt: %v", changed)
+			}
+		}
+	}()
+}
+
+// AdminRescanManifestHandler rebuilds the manifests right away, for use
+// after publishing a release.
+func AdminRescanManifestHandler(w http.ResponseWriter, r *http.Request) {
+	changed, err := refreshManifests()
+	if err != nil {
+		log.Printf("Failed to rescan the launcher files: %v", err)
+		http.Error(w, `{"error":"Failed to rescan launcher files"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"changed": changed})
+}
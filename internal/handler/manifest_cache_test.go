@@ -0,0 +1,90 @@
+package handler
+
+import "testing"
+
+func TestFilesHash(t *testing.T) {
+	files := []GameFile{
+		{Path: "bin/game.exe", Hash: "aa", Size: 10, URL: "/a", Mode: "0755"},
+		{Path: "data/pak0.pak", Hash: "bb", Size: 20, URL: "/b", Mode: "0644"},
+	}
+	base := filesHash(files)
+	if len(base) != 64 {
+		t.Fatalf("hash %q is not 64 hex digits", base)
+	}
+
+	// Fields that are not part of the file contents leave the hash alone.
+	decorated := []GameFile{files[0], files[1]}
+	decorated[0].URL = "https://cdn.example/bin/game.exe?signature=x"
+	decorated[0].Chunks = []FileChunk{{Hash: "cc", Size: 10}}
+	decorated[1].Patches = []FilePatch{{From: "dd", To: "bb", Size: 3}}
+	decorated[1].Mode = "0600"
+	decorated[1].Optional = true
+	if got := filesHash(decorated); got != base {
+		t.Errorf("URLs, chunks, patches, mode and optional changed the hash")
+	}
+
+	changes := map[string]func(f []GameFile){
+		"path":    func(f []GameFile) { f[0].Path = "bin/game2.exe" },
+		"hash":    func(f []GameFile) { f[1].Hash = "bc" },
+		"size":    func(f []GameFile) { f[1].Size = 21 },
+		"removed": nil,
+	}
+	for name, change := range changes {
+		changed := []GameFile{files[0], files[1]}
+		if change == nil {
+			changed = changed[:1]
+		} else {
+			change(changed)
+		}
+		if filesHash(changed) == base {
+			t.Errorf("changing the %s did not change the hash", name)
+		}
+	}
+
+	// A path cannot be crafted to look like two entries.
+	joined := []GameFile{{Path: "a\" aa 10\n\"b", Hash: "bb", Size: 20}}
+	split := []GameFile{{Path: "a", Hash: "aa", Size: 10}, {Path: "b", Hash: "bb", Size: 20}}
+	if filesHash(joined) == filesHash(split) {
+		t.Error("a path with quotes and a newline collides with two files")
+	}
+}
+
+func TestManifestETag(t *testing.T) {
+	files := []GameFile{
+		{Path: "bin/game.exe", Hash: "aa", Size: 10, URL: "/api/launcher/download/bin/game.exe",
+			Chunks: []FileChunk{{Hash: "cc", Size: 10, URL: "/api/launcher/chunks/cc"}}},
+		{Path: "data/pak0.pak", Hash: "bb", Size: 20, URL: "/api/launcher/download/data/pak0.pak",
+			Patches: []FilePatch{{From: "dd", To: "bb", Size: 3, URL: "/api/launcher/download/patches/dd-bb.delta"}}},
+	}
+	base := manifestETag(files)
+
+	signed := []GameFile{files[0], files[1]}
+	signed[0].URL = "https://cdn.example/bin/game.exe?X-Amz-Signature=1"
+	signed[0].Chunks = []FileChunk{{Hash: "cc", Size: 10, URL: "https://cdn.example/chunks/cc/cc?X-Amz-Signature=1"}}
+	signed[1].Patches = []FilePatch{{From: "dd", To: "bb", Size: 3, URL: "https://cdn.example/patches/dd-bb.delta?X-Amz-Signature=1"}}
+	if got := manifestETag(signed); got != base {
+		t.Errorf("signed URLs changed the ETag")
+	}
+	if files[0].Chunks[0].URL == "" || files[1].Patches[0].URL == "" {
+		t.Errorf("manifestETag cleared the URLs of the manifest itself")
+	}
+
+	changes := map[string]func(f []GameFile){
+		"hash":    func(f []GameFile) { f[0].Hash = "ab" },
+		"chunk":   func(f []GameFile) { f[0].Chunks = []FileChunk{{Hash: "ce", Size: 10}} },
+		"patch":   func(f []GameFile) { f[1].Patches = nil },
+		"mode":    func(f []GameFile) { f[1].Mode = "0755" },
+		"removed": nil,
+	}
+	for name, change := range changes {
+		changed := []GameFile{files[0], files[1]}
+		if change == nil {
+			changed = changed[:1]
+		} else {
+			change(changed)
+		}
+		if manifestETag(changed) == base {
+			t.Errorf("%s did not change the ETag", name)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/model"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Manifests are signed with Ed25519 over a canonical envelope that binds the
+// files to the release version, the channel and a validity window, so an
+// old manifest cannot be replayed to force a downgrade:
+//
+//	astralis-manifest 1
+//	version "1.4.0"
+//	channel "stable"
+//	issued_at 1700000000
+//	expires_at 1700604800
+//	"bin/game.exe" <sha256> <size> 0755 false
+//	...
+//
+// with one line per file in path order of the quoted path, the hash, the
+// size, the mode and whether the file is optional, each line ending in a
+// newline. URLs are left out, so they can be signed per request by the
+// file store without touching the manifest signature.
+//
+// The signature, the ID of the key that made it and the window are sent in
+// the X-Manifest-Signature, X-Manifest-Key-Id, X-Manifest-Issued-At and
+// X-Manifest-Expires-At headers, next to X-Release-Version and
+// X-Release-Channel. The launcher rebuilds the envelope from those and the
+// body, checks it against the public keys it pins, and rejects it when it
+// has expired, is for another channel, or was issued before the last
+// manifest it accepted.
+//
+// A release can be signed offline with cmd/manifest-sign and the signature
+// uploaded per channel; otherwise the server signs with MANIFEST_SIGNING_KEY
+// if set.
+
+const manifestEnvelopeHeader = "astralis-manifest 1\n"
+
+type manifestKeys struct {
+	signer   ed25519.PrivateKey
+	signerID string
+	trusted  map[string]ed25519.PublicKey
+}
+
+var (
+	manifestKeysOnce   sync.Once
+	loadedManifestKeys manifestKeys
+)
+
+// manifestKeyID names a public key by the start of its SHA-256.
+func manifestKeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// getManifestKeys parses the signing key, a base64 Ed25519 seed or private
+// key, and the trusted public keys from the config once.
+func getManifestKeys() *manifestKeys {
+	manifestKeysOnce.Do(func() {
+		k := &loadedManifestKeys
+		k.trusted = map[string]ed25519.PublicKey{}
+
+		if config.Cfg.ManifestSigningKey != "" {
+			raw, err := base64.StdEncoding.DecodeString(config.Cfg.ManifestSigningKey)
+			switch {
+			case err == nil && len(raw) == ed25519.SeedSize:
+				k.signer = ed25519.NewKeyFromSeed(raw)
+			case err == nil && len(raw) == ed25519.PrivateKeySize:
+				k.signer = ed25519.PrivateKey(raw)
+			default:
+				log.Println("MANIFEST_SIGNING_KEY is not a base64 Ed25519 key, manifests will not be signed online")
+			}
+			if k.signer != nil {
+				pub := k.signer.Public().(ed25519.PublicKey)
+				k.signerID = manifestKeyID(pub)
+				k.trusted[k.signerID] = pub
+			}
+		}
+		for _, encoded := range config.Cfg.ManifestPublicKeys {
+			raw, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil || len(raw) != ed25519.PublicKeySize {
+				log.Printf("Ignoring invalid manifest public key %q", encoded)
+				continue
+			}
+			k.trusted[manifestKeyID(raw)] = ed25519.PublicKey(raw)
+		}
+	})
+	return &loadedManifestKeys
+}
+
+// manifestSignatureTTL is how long a manifest signature stays valid.
+func manifestSignatureTTL() time.Duration {
+	days := config.Cfg.ManifestSignatureDays
+	if days < 1 {
+		days = 1
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// manifestEnvelope returns the bytes a manifest signature covers.
+func manifestEnvelope(version, channel string, issuedAt, expiresAt time.Time, files []GameFile) []byte {
+	var b bytes.Buffer
+	b.WriteString(manifestEnvelopeHeader)
+	fmt.Fprintf(&b, "version %s\nchannel %s\nissued_at %d\nexpires_at %d\n",
+		strconv.Quote(version), strconv.Quote(channel), issuedAt.Unix(), expiresAt.Unix())
+	for _, f := range files {
+		fmt.Fprintf(&b, "%s %s %d %s %t\n", strconv.Quote(f.Path), f.Hash, f.Size, f.Mode, f.Optional)
+	}
+	return b.Bytes()
+}
+
+// manifestSignature is a signature of a manifest envelope.
+type manifestSignature struct {
+	Signature string
+	KeyID     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+var errUntrustedManifestSignature = errors.New("signature does not match any trusted manifest key")
+
+// verifyManifestSignature checks a detached signature against the trusted
+// keys and returns the ID of the key that made it.
+func verifyManifestSignature(trusted map[string]ed25519.PublicKey, envelope []byte, signature string) (string, error) {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return "", errUntrustedManifestSignature
+	}
+	for id, pub := range trusted {
+		if ed25519.Verify(pub, envelope, sig) {
+			return id, nil
+		}
+	}
+	return "", errUntrustedManifestSignature
+}
+
+// onlineManifestSignature signs the envelope of a manifest with the online
+// key, if there is one. Signatures are issued at the start of the hour, so
+// within the hour every launcher on the channel gets the same one; they are
+// kept on the manifest until the hour is over.
+func onlineManifestSignature(version, channel string, m *cachedManifest) *manifestSignature {
+	k := getManifestKeys()
+	if k.signer == nil {
+		return nil
+	}
+	issuedAt := time.Now().Truncate(time.Hour)
+
+	m.signedMu.Lock()
+	defer m.signedMu.Unlock()
+	if s, ok := m.signatures[channel]; ok && s.IssuedAt.Equal(issuedAt) {
+		return s
+	}
+	expiresAt := issuedAt.Add(manifestSignatureTTL())
+	s := &manifestSignature{
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(k.signer, manifestEnvelope(version, channel, issuedAt, expiresAt, m.Files))),
+		KeyID:     k.signerID,
+		IssuedAt:  issuedAt,
+		ExpiresAt: expiresAt,
+	}
+	if m.signatures == nil {
+		m.signatures = map[string]*manifestSignature{}
+	}
+	m.signatures[channel] = s
+	return s
+}
+
+// offlineManifestSignature returns the uploaded signature of a release on a
+// channel if it is still valid and matches the release's files.
+func offlineManifestSignature(rel *model.Release, channel string, m *cachedManifest) (*manifestSignature, error) {
+	var s manifestSignature
+	err := database.DB.QueryRow("SELECT signature, key_id, issued_at, expires_at FROM release_signatures WHERE release_id = ? AND channel = ?",
+		rel.ID, channel).Scan(&s.Signature, &s.KeyID, &s.IssuedAt, &s.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !time.Now().Before(s.ExpiresAt) {
+		return nil, nil
+	}
+	envelope := manifestEnvelope(rel.Version, channel, s.IssuedAt, s.ExpiresAt, m.Files)
+	if _, err := verifyManifestSignature(getManifestKeys().trusted, envelope, s.Signature); err != nil {
+		return nil, nil
+	}
+	return &s, nil
+}
+
+// setManifestSignature adds the signature headers for a manifest served on
+// a channel: the release's offline signature for the channel while it is
+// valid, else an online one. It fails when signatures are required and
+// there is none.
+func setManifestSignature(w http.ResponseWriter, channel string, rel *model.Release, m *cachedManifest) error {
+	version := ""
+	var s *manifestSignature
+	if rel != nil {
+		version = rel.Version
+		var err error
+		s, err = offlineManifestSignature(rel, channel, m)
+		if err != nil {
+			log.Printf("Failed to look up the signature of release %s on %s: %v", rel.Version, channel, err)
+		}
+	}
+	if s == nil {
+		s = onlineManifestSignature(version, channel, m)
+	}
+	if s == nil {
+		if config.Cfg.ManifestRequireSignature {
+			return &keyError{http.StatusServiceUnavailable, "This release has not been signed yet"}
+		}
+		return nil
+	}
+	w.Header().Set("X-Manifest-Signature", s.Signature)
+	w.Header().Set("X-Manifest-Key-Id", s.KeyID)
+	w.Header().Set("X-Manifest-Issued-At", strconv.FormatInt(s.IssuedAt.Unix(), 10))
+	w.Header().Set("X-Manifest-Expires-At", strconv.FormatInt(s.ExpiresAt.Unix(), 10))
+	return nil
+}
+
+// GetManifestKeysHandler lists the public keys manifests may be signed
+// with, for building launchers. Launchers should pin them rather than fetch
+// them at runtime.
+func GetManifestKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := map[string]string{}
+	for id, pub := range getManifestKeys().trusted {
+		keys[id] = base64.StdEncoding.EncodeToString(pub)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+// releaseManifest returns the manifest of a release, checked against the
+// one it was published with.
+func releaseManifest(version string) (*model.Release, *cachedManifest, error) {
+	rel, err := loadReleaseByVersion(database.DB, version)
+	if err == sql.ErrNoRows {
+		return nil, nil, &keyError{http.StatusNotFound, "Release not found"}
+	}
+	if err != nil {
+		return nil, nil, &keyError{http.StatusInternalServerError, "Failed to look up release"}
+	}
+	m, err := manifestFor(rel.Build).get()
+	if err != nil {
+		log.Printf("Failed to build the manifest of release %s: %v", rel.Version, err)
+		return nil, nil, &keyError{http.StatusInternalServerError, "Failed to read release files"}
+	}
+	if releaseFilesChanged(&rel, m) {
+		return nil, nil, &keyError{http.StatusConflict, "Release files changed after publishing"}
+	}
+	return &rel, m, nil
+}
+
+// signingChannel checks the channel a release is to be signed for.
+func signingChannel(name string) error {
+	if name == "" {
+		return &keyError{http.StatusBadRequest, "Name the channel the signature is for"}
+	}
+	_, err := loadReleaseChannel(database.DB, name)
+	if err == sql.ErrNoRows {
+		return &keyError{http.StatusNotFound, "Unknown release channel"}
+	}
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to look up release channel"}
+	}
+	return nil
+}
+
+// AdminGetReleaseManifestHandler returns the envelope to sign offline for a
+// release on ?channel=, valid from now for ?days= days, by default
+// MANIFEST_SIGNATURE_DAYS. The window is also in the X-Manifest-Issued-At
+// and X-Manifest-Expires-At headers, to be sent back with the signature.
+func AdminGetReleaseManifestHandler(w http.ResponseWriter, r *http.Request) {
+	rel, m, err := releaseManifest(mux.Vars(r)["version"])
+	if err != nil {
+		writeKeyError(w, err, "Failed to get release manifest")
+		return
+	}
+	channel := r.URL.Query().Get("channel")
+	if err := signingChannel(channel); err != nil {
+		writeKeyError(w, err, "Failed to look up release channel")
+		return
+	}
+	ttl := manifestSignatureTTL()
+	if days := r.URL.Query().Get("days"); days != "" {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 1 || n > 366 {
+			http.Error(w, `{"error":"days must be between 1 and 366"}`, http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(n) * 24 * time.Hour
+	}
+	issuedAt := time.Now().Truncate(time.Second)
+	expiresAt := issuedAt.Add(ttl)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Manifest-Issued-At", strconv.FormatInt(issuedAt.Unix(), 10))
+	w.Header().Set("X-Manifest-Expires-At", strconv.FormatInt(expiresAt.Unix(), 10))
+	w.Write(manifestEnvelope(rel.Version, channel, issuedAt, expiresAt, m.Files))
+}
+
+// AdminSignReleaseHandler stores an offline signature of a release's
+// envelope on a channel after checking it against the trusted public keys.
+func AdminSignReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Channel   string `json:"channel"`
+		IssuedAt  int64  `json:"issued_at"`
+		ExpiresAt int64  `json:"expires_at"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Signature == "" || req.IssuedAt == 0 || req.ExpiresAt == 0 {
+		http.Error(w, `{"error":"Send the channel, issued_at, expires_at and the base64 signature of the release envelope"}`, http.StatusBadRequest)
+		return
+	}
+	issuedAt, expiresAt := time.Unix(req.IssuedAt, 0), time.Unix(req.ExpiresAt, 0)
+	if !expiresAt.After(time.Now()) || !expiresAt.After(issuedAt) {
+		http.Error(w, `{"error":"The signature has already expired"}`, http.StatusUnprocessableEntity)
+		return
+	}
+
+	rel, m, err := releaseManifest(mux.Vars(r)["version"])
+	if err != nil {
+		writeKeyError(w, err, "Failed to get release manifest")
+		return
+	}
+	if err := signingChannel(req.Channel); err != nil {
+		writeKeyError(w, err, "Failed to look up release channel")
+		return
+	}
+	envelope := manifestEnvelope(rel.Version, req.Channel, issuedAt, expiresAt, m.Files)
+	keyID, err := verifyManifestSignature(getManifestKeys().trusted, envelope, req.Signature)
+	if err != nil {
+		http.Error(w, `{"error":"Signature does not match the envelope or a trusted key"}`, http.StatusUnprocessableEntity)
+		return
+	}
+
+	_, err = database.DB.Exec(`INSERT INTO release_signatures (release_id, channel, signature, key_id, issued_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE signature = VALUES(signature), key_id = VALUES(key_id), issued_at = VALUES(issued_at), expires_at = VALUES(expires_at)`,
+		rel.ID, req.Channel, req.Signature, keyID, issuedAt, expiresAt)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to save signature"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Release signed", "key_id": keyID})
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifestEnvelope(t *testing.T) {
+	issued := time.Unix(1700000000, 0)
+	expires := issued.Add(7 * 24 * time.Hour)
+	files := []GameFile{
+		{Path: "bin/game.exe", Hash: "aa", Size: 10, URL: "/a", Mode: "0755"},
+		{Path: "data/my pak.pak", Hash: "bb", Size: 20, URL: "/b", Mode: "0644", Optional: true},
+	}
+	want := "astralis-manifest 1\n" +
+		"version \"1.4.0\"\n" +
+		"channel \"stable\"\n" +
+		"issued_at 1700000000\n" +
+		"expires_at 1700604800\n" +
+		"\"bin/game.exe\" aa 10 0755 false\n" +
+		"\"data/my pak.pak\" bb 20 0644 true\n"
+	base := manifestEnvelope("1.4.0", "stable", issued, expires, files)
+	if string(base) != want {
+		t.Fatalf("envelope is\n%s\nwant\n%s", base, want)
+	}
+
+	signedURLs := []GameFile{files[0], files[1]}
+	signedURLs[0].URL = "https://cdn.example/bin/game.exe?signature=x"
+	if got := manifestEnvelope("1.4.0", "stable", issued, expires, signedURLs); string(got) != want {
+		t.Errorf("URLs changed the envelope")
+	}
+
+	tests := []struct {
+		name     string
+		envelope []byte
+	}{
+		{"version", manifestEnvelope("1.3.0", "stable", issued, expires, files)},
+		{"channel", manifestEnvelope("1.4.0", "beta", issued, expires, files)},
+		{"issued_at", manifestEnvelope("1.4.0", "stable", issued.Add(time.Second), expires, files)},
+		{"expires_at", manifestEnvelope("1.4.0", "stable", issued, expires.Add(time.Second), files)},
+		{"files", manifestEnvelope("1.4.0", "stable", issued, expires, files[:1])},
+		{"mode", manifestEnvelope("1.4.0", "stable", issued, expires, []GameFile{files[0], {Path: "data/my pak.pak", Hash: "bb", Size: 20, Mode: "0755", Optional: true}})},
+		{"optional", manifestEnvelope("1.4.0", "stable", issued, expires, []GameFile{files[0], {Path: "data/my pak.pak", Hash: "bb", Size: 20, Mode: "0644"}})},
+		{"injected line", manifestEnvelope("1.4.0\"\nchannel \"beta", "stable", issued, expires, files)},
+	}
+	for _, tt := range tests {
+		if string(tt.envelope) == want {
+			t.Errorf("%s did not change the envelope", tt.name)
+		}
+	}
+	if !strings.HasSuffix(want, "\n") {
+		t.Errorf("envelope does not end in a newline")
+	}
+}
+
+func TestVerifyManifestSignature(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted := map[string]ed25519.PublicKey{manifestKeyID(pub): pub}
+
+	issued := time.Unix(1700000000, 0)
+	envelope := manifestEnvelope("1.4.0", "stable", issued, issued.Add(time.Hour), []GameFile{{Path: "a", Hash: "aa", Size: 1}})
+	replayed := manifestEnvelope("1.3.0", "stable", issued, issued.Add(time.Hour), []GameFile{{Path: "a", Hash: "aa", Size: 1}})
+	sign := func(key ed25519.PrivateKey, msg []byte) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(key, msg))
+	}
+
+	tests := []struct {
+		name      string
+		envelope  []byte
+		signature string
+		wantID    string
+	}{
+		{"trusted key", envelope, sign(priv, envelope), manifestKeyID(pub)},
+		{"other envelope", replayed, sign(priv, envelope), ""},
+		{"untrusted key", envelope, sign(otherPriv, envelope), ""},
+		{"not base64", envelope, "not a signature", ""},
+		{"short", envelope, base64.StdEncoding.EncodeToString([]byte("short")), ""},
+		{"empty", envelope, "", ""},
+	}
+	for _, tt := range tests {
+		id, err := verifyManifestSignature(trusted, tt.envelope, tt.signature)
+		if tt.wantID == "" {
+			if err == nil {
+				t.Errorf("%s: signature accepted by key %s", tt.name, id)
+			}
+			continue
+		}
+		if err != nil || id != tt.wantID {
+			t.Errorf("%s: got key %q, %v; want %q", tt.name, id, err, tt.wantID)
+		}
+	}
+
+	if manifestKeyID(pub) == manifestKeyID(otherPub) {
+		t.Errorf("different keys share an ID")
+	}
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/model"
+	"context"
+	"log"
+	"time"
+)
+
+// orderExpiryGrace is how long past its expiry an order is kept pending, for
+// webhooks that are still on their way.
+const orderExpiryGrace = 10 * time.Minute
+
+// orderExpiry is how long a pending order may be paid. It is kept within what
+// Stripe allows for a checkout session, half an hour to a day.
+func orderExpiry() time.Duration {
+	ttl := time.Duration(config.Cfg.OrderExpiryMinutes) * time.Minute
+	if ttl < 30*time.Minute {
+		ttl = 30 * time.Minute
+	}
+	if ttl > 24*time.Hour {
+		ttl = 24 * time.Hour
+	}
+	return ttl
+}
+
+// StartOrderExpiry cancels pending orders that were never paid, every few
+// minutes until ctx is cancelled, so the promo code uses they hold are
+// given back.
+func StartOrderExpiry(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(5 * time.Minute)
+		defer ticker.Stop()
+		for {
+			expirePendingOrders()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func expirePendingOrders() {
+	rows, err := database.DB.Query("SELECT id FROM orders WHERE status = ? AND created_at < ? LIMIT 500",
+		model.OrderPending, time.Now().Add(-orderExpiry()-orderExpiryGrace))
+	if err != nil {
+		log.Printf("Could not look up expired orders: %v", err)
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	for _, id := range ids {
+		if err := expireOrder(id); err != nil {
+			log.Printf("Could not expire order %d: %v", id, err)
+		}
+	}
+}
+
+// expireOrder cancels one order if it is still pending. A payment reported
+// for it afterwards marks it for refund.
+func expireOrder(orderID int) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	if err := tx.QueryRow("SELECT status FROM orders WHERE id = ? FOR UPDATE", orderID).Scan(&status); err != nil {
+		return err
+	}
+	if status != model.OrderPending {
+		return nil
+	}
+	if err := releasePromoCode(tx, orderID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE orders SET status = ? WHERE id = ?", model.OrderCanceled, orderID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
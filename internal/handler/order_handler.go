@@ -0,0 +1,622 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// freeOrderProvider marks orders a promo code made free, and
+// walletOrderProvider orders paid from the buyer's balance. Neither reaches a
+// payment provider.
+const (
+	freeOrderProvider   = "free"
+	walletOrderProvider = "wallet"
+)
+
+const orderColumns = "o.id, o.user_id, o.product_id, o.amount, o.discount, pc.code, o.currency, o.duration_days, o.delivery, o.status, o.provider, o.payment_url, k.key_string, o.created_at, o.paid_at"
+
+func scanOrder(row interface{ Scan(...interface{}) error }) (model.Order, error) {
+	var o model.Order
+	var paymentURL, keyString, promoCode sql.NullString
+	var productID sql.NullInt64
+	var paidAt sql.NullTime
+	err := row.Scan(&o.ID, &o.UserID, &productID, &o.Amount, &o.Discount, &promoCode, &o.Currency, &o.DurationDays, &o.Delivery, &o.Status, &o.Provider, &paymentURL, &keyString, &o.CreatedAt, &paidAt)
+	if productID.Valid {
+		id := int(productID.Int64)
+		o.ProductID = &id
+	}
+	if paymentURL.Valid && o.Status == model.OrderPending {
+		o.PaymentURL = &paymentURL.String
+	}
+	if keyString.Valid {
+		o.KeyString = &keyString.String
+	}
+	if promoCode.Valid {
+		o.PromoCode = &promoCode.String
+	}
+	if paidAt.Valid {
+		o.PaidAt = &paidAt.Time
+	}
+	return o, err
+}
+
+// CreateOrderHandler starts the purchase of a product and returns the URL the
+// buyer pays at. The order is fulfilled when the provider's webhook reports
+// the payment. Orders paid from the wallet, or made free by a promo code, are
+// fulfilled right away.
+func CreateOrderHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	userID, _ := strconv.Atoi(claims.Subject)
+
+	var req struct {
+		ProductID        int    `json:"product_id"`
+		Delivery         string `json:"delivery"`
+		PromoCode        string `json:"promo_code"`
+		PayWith          string `json:"pay_with"`
+		DurationOptionID *int   `json:"duration_option_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.PayWith != "" && req.PayWith != walletOrderProvider {
+		http.Error(w, `{"error":"pay_with must be wallet or empty"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Delivery == "" {
+		req.Delivery = model.OrderDeliverySubscription
+	}
+	if req.Delivery != model.OrderDeliverySubscription && req.Delivery != model.OrderDeliveryKey {
+		http.Error(w, `{"error":"Delivery must be subscription or key"}`, http.StatusBadRequest)
+		return
+	}
+
+	offer, err := lookupProductOffer(req.ProductID, req.DurationOptionID)
+	if err != nil {
+		writeKeyError(w, err, "Failed to look up product")
+		return
+	}
+	price := offer.Price
+	order := model.Order{UserID: userID, ProductID: &req.ProductID, Currency: offer.Currency, DurationDays: offer.DurationDays, Delivery: req.Delivery, Status: model.OrderPending}
+	if req.PayWith == walletOrderProvider && offer.Currency != config.Cfg.PaymentCurrency {
+		http.Error(w, `{"error":"This product cannot be paid from the balance"}`, http.StatusConflict)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var promoCodeID *int
+	if code := normalizePromoCode(req.PromoCode); code != "" {
+		discount, id, err := applyPromoCode(tx, code, userID, req.ProductID, price, true)
+		if err != nil {
+			writeKeyError(w, err, "Failed to apply promo code")
+			return
+		}
+		if _, err := tx.Exec("UPDATE promo_codes SET uses = uses + 1 WHERE id = ?", id); err != nil {
+			http.Error(w, `{"error":"Failed to apply promo code"}`, http.StatusInternalServerError)
+			return
+		}
+		order.Discount = discount
+		order.PromoCode = &code
+		promoCodeID = &id
+	}
+	order.Amount = price - order.Discount
+
+	providerName, provider, ok := activePaymentProvider()
+	switch {
+	case order.Amount == 0:
+		providerName = freeOrderProvider
+	case req.PayWith == walletOrderProvider:
+		providerName = walletOrderProvider
+	case !ok:
+		http.Error(w, `{"error":"Payments are not available right now"}`, http.StatusServiceUnavailable)
+		return
+	}
+	order.Provider = providerName
+
+	res, err := tx.Exec("INSERT INTO orders (user_id, product_id, amount, discount, promo_code_id, currency, duration_days, delivery, status, provider) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		order.UserID, order.ProductID, order.Amount, order.Discount, promoCodeID, order.Currency, order.DurationDays, order.Delivery, order.Status, order.Provider)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to create order"}`, http.StatusInternalServerError)
+		return
+	}
+	orderID, _ := res.LastInsertId()
+	order.ID = int(orderID)
+	order.CreatedAt = time.Now()
+
+	if order.Provider == walletOrderProvider {
+		// A retried request carrying the same Idempotency-Key finds its
+		// ledger transaction already posted and is not charged twice.
+		key := fmt.Sprintf("order:%d", order.ID)
+		if r.Header.Get("Idempotency-Key") != "" {
+			key = requestIdempotencyKey(r, "purchase:"+claims.Subject)
+		}
+		applied, err := transferWallet(tx, claims.Subject, model.WalletAccountSales, key, model.LedgerKindPurchase, fmt.Sprintf("order:%d", order.ID), nil, -int64(order.Amount))
+		if err != nil {
+			writeKeyError(w, err, "Failed to pay from balance")
+			return
+		}
+		if !applied {
+			tx.Rollback()
+			replayWalletOrder(w, key, claims.Subject)
+			return
+		}
+		if err := completeReferral(tx, claims.Subject); err != nil {
+			writeKeyError(w, err, "Failed to fulfill order")
+			return
+		}
+	}
+	if order.Provider == freeOrderProvider || order.Provider == walletOrderProvider {
+		if err := fulfillOrder(tx, order); err != nil {
+			writeKeyError(w, err, "Failed to fulfill order")
+			return
+		}
+		now := time.Now()
+		if _, err := tx.Exec("UPDATE orders SET status = ?, paid_at = ? WHERE id = ?", model.OrderPaid, now, order.ID); err != nil {
+			http.Error(w, `{"error":"Failed to update order"}`, http.StatusInternalServerError)
+			return
+		}
+		order.Status = model.OrderPaid
+		order.PaidAt = &now
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if order.Status == model.OrderPending {
+		if err := startOrderPayment(provider, &order, offer.Name); err != nil {
+			writeKeyError(w, err, "Failed to start payment")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(order)
+}
+
+// replayWalletOrder answers a retried wallet purchase with the order the
+// first request created, found through the ledger transaction posted under
+// the same idempotency key.
+func replayWalletOrder(w http.ResponseWriter, idempotencyKey, userID string) {
+	var reference sql.NullString
+	err := database.DB.QueryRow("SELECT reference FROM ledger_transactions WHERE idempotency_key = ?", idempotencyKey).Scan(&reference)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up the original order"}`, http.StatusInternalServerError)
+		return
+	}
+	var orderID int
+	if _, err := fmt.Sscanf(reference.String, "order:%d", &orderID); err != nil {
+		http.Error(w, `{"error":"This Idempotency-Key was already used for another request"}`, http.StatusConflict)
+		return
+	}
+
+	row := database.DB.QueryRow("SELECT "+orderColumns+" FROM orders o LEFT JOIN activation_keys k ON k.id = o.key_id LEFT JOIN promo_codes pc ON pc.id = o.promo_code_id WHERE o.id = ? AND o.user_id = ?", orderID, userID)
+	order, err := scanOrder(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"This Idempotency-Key was already used for another request"}`, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get order"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// productOffer is what buying a product, or one of its duration options,
+// costs and gives.
+type productOffer struct {
+	Name         string
+	Price        int
+	DurationDays int
+	Currency     string
+}
+
+// lookupProductOffer prices a product, or the given duration option of it.
+// Only active products can be bought.
+func lookupProductOffer(productID int, durationOptionID *int) (productOffer, error) {
+	var o productOffer
+	var status string
+	var currency sql.NullString
+	err := database.DB.QueryRow("SELECT name, price, duration_days, currency, status FROM products WHERE id = ?", productID).Scan(
+		&o.Name, &o.Price, &o.DurationDays, &currency, &status)
+	if err == sql.ErrNoRows {
+		return o, &keyError{http.StatusNotFound, "Product not found"}
+	}
+	if err != nil {
+		return o, &keyError{http.StatusInternalServerError, "Failed to look up product"}
+	}
+	if status != model.ProductActive {
+		return o, &keyError{http.StatusConflict, "This product is not available yet"}
+	}
+	o.Currency = productCurrency(model.Product{Currency: currency.String})
+
+	if durationOptionID != nil {
+		err = database.DB.QueryRow("SELECT duration_days, price FROM product_duration_options WHERE id = ? AND product_id = ?",
+			*durationOptionID, productID).Scan(&o.DurationDays, &o.Price)
+		if err == sql.ErrNoRows {
+			return o, &keyError{http.StatusBadRequest, "Unknown duration option"}
+		}
+		if err != nil {
+			return o, &keyError{http.StatusInternalServerError, "Failed to look up product"}
+		}
+	}
+	if o.Price <= 0 {
+		return o, &keyError{http.StatusConflict, "This product is not for sale"}
+	}
+	return o, nil
+}
+
+// startOrderPayment creates the provider payment for a saved order and stores
+// where the buyer pays. An order the provider refuses is marked failed.
+func startOrderPayment(provider paymentProvider, order *model.Order, description string) error {
+	paymentID, paymentURL, err := provider.createPayment(*order, description)
+	if err != nil {
+		log.Printf("Could not create %s payment for order %d: %v", order.Provider, order.ID, err)
+		releasePromoCode(database.DB, order.ID)
+		database.DB.Exec("UPDATE orders SET status = ? WHERE id = ?", model.OrderFailed, order.ID)
+		return &keyError{http.StatusBadGateway, "Payment provider is unavailable, please try again later"}
+	}
+	_, err = database.DB.Exec("UPDATE orders SET provider_payment_id = ?, payment_url = ? WHERE id = ?", paymentID, paymentURL, order.ID)
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to save payment"}
+	}
+	order.PaymentURL = &paymentURL
+	return nil
+}
+
+// TopUpWalletHandler starts a payment that adds to the user's balance once
+// the provider confirms it.
+func TopUpWalletHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	userID, _ := strconv.Atoi(claims.Subject)
+
+	providerName, provider, ok := activePaymentProvider()
+	if !ok {
+		http.Error(w, `{"error":"Payments are not available right now"}`, http.StatusServiceUnavailable)
+		return
+	}
+
+	var req struct {
+		Amount int `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Amount <= 0 {
+		http.Error(w, `{"error":"Amount must be positive"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Amount > config.Cfg.WalletTopUpMax {
+		http.Error(w, fmt.Sprintf(`{"error":"Amount cannot be more than %d"}`, config.Cfg.WalletTopUpMax), http.StatusBadRequest)
+		return
+	}
+
+	order := model.Order{UserID: userID, Amount: req.Amount, Currency: config.Cfg.PaymentCurrency, Delivery: model.OrderDeliveryBalance, Status: model.OrderPending, Provider: providerName}
+	res, err := database.DB.Exec("INSERT INTO orders (user_id, product_id, amount, currency, duration_days, delivery, status, provider) VALUES (?, NULL, ?, ?, 0, ?, ?, ?)",
+		order.UserID, order.Amount, order.Currency, order.Delivery, order.Status, order.Provider)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to create order"}`, http.StatusInternalServerError)
+		return
+	}
+	orderID, _ := res.LastInsertId()
+	order.ID = int(orderID)
+	order.CreatedAt = time.Now()
+
+	if err := startOrderPayment(provider, &order, "Balance top-up"); err != nil {
+		writeKeyError(w, err, "Failed to start payment")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(order)
+}
+
+func GetOrdersHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := database.DB.Query("SELECT "+orderColumns+" FROM orders o LEFT JOIN activation_keys k ON k.id = o.key_id LEFT JOIN promo_codes pc ON pc.id = o.promo_code_id WHERE o.user_id = ? ORDER BY o.id DESC", claims.Subject)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query orders"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	orders := make([]model.Order, 0)
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			http.Error(w, `{"error":"Failed to scan order row"}`, http.StatusInternalServerError)
+			return
+		}
+		orders = append(orders, o)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(orders)
+}
+
+func GetOrderHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	orderID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid order ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	row := database.DB.QueryRow("SELECT "+orderColumns+" FROM orders o LEFT JOIN activation_keys k ON k.id = o.key_id LEFT JOIN promo_codes pc ON pc.id = o.promo_code_id WHERE o.id = ? AND o.user_id = ?", orderID, claims.Subject)
+	order, err := scanOrder(row)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Order not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get order"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(order)
+}
+
+// PaymentWebhookHandler receives payment notifications. Providers retry
+// until they get a 2xx, so events we have already handled or do not need are
+// acknowledged too.
+func PaymentWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	providerName := mux.Vars(r)["provider"]
+	provider, ok := paymentProviders[providerName]
+	if !ok {
+		http.Error(w, `{"error":"Unknown payment provider"}`, http.StatusNotFound)
+		return
+	}
+
+	event, err := provider.parseWebhook(r)
+	if err == errInvalidWebhookSignature {
+		http.Error(w, `{"error":"Invalid signature"}`, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Invalid webhook payload"}`, http.StatusBadRequest)
+		return
+	}
+
+	if event.Status != "" {
+		if err := applyPaymentEvent(providerName, event); err != nil {
+			writeKeyError(w, err, "Failed to process payment")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "ok"})
+}
+
+// applyPaymentEvent moves a pending order to the status reported by the
+// provider, fulfilling it when paid. Each event is applied at most once.
+// Payments for orders that already failed or were canceled are marked
+// paid_needs_refund.
+func applyPaymentEvent(providerName string, event *paymentEvent) error {
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Server error"}
+	}
+	defer tx.Rollback()
+
+	var order model.Order
+	var productID sql.NullInt64
+	err = tx.QueryRow("SELECT id, user_id, product_id, amount, duration_days, delivery, status FROM orders WHERE provider = ? AND provider_payment_id = ? FOR UPDATE",
+		providerName, event.PaymentID).Scan(&order.ID, &order.UserID, &productID, &order.Amount, &order.DurationDays, &order.Delivery, &order.Status)
+	if err == sql.ErrNoRows {
+		return &keyError{http.StatusNotFound, "Order not found"}
+	}
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to get order"}
+	}
+	if productID.Valid {
+		id := int(productID.Int64)
+		order.ProductID = &id
+	}
+
+	res, err := tx.Exec("INSERT IGNORE INTO payment_events (provider, event_id, order_id, status) VALUES (?, ?, ?, ?)",
+		providerName, event.ID, order.ID, event.Status)
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to record payment event"}
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return tx.Commit()
+	}
+	if order.Status != model.OrderPending {
+		// The buyer was charged for an order we already gave up on. Nothing
+		// is issued for it; it is set aside to be refunded.
+		if event.Status == model.OrderPaid && (order.Status == model.OrderFailed || order.Status == model.OrderCanceled) {
+			log.Printf("Order %d was paid through %s after it was %s, marking it for refund", order.ID, providerName, order.Status)
+			_, err = tx.Exec("UPDATE orders SET status = ?, paid_at = ? WHERE id = ?", model.OrderPaidNeedsRefund, time.Now(), order.ID)
+			if err != nil {
+				return &keyError{http.StatusInternalServerError, "Failed to update order"}
+			}
+		}
+		return tx.Commit()
+	}
+
+	if event.Status == model.OrderPaid {
+		if err := fulfillOrder(tx, order); err != nil {
+			return err
+		}
+		if order.Delivery != model.OrderDeliveryBalance {
+			if err := completeReferral(tx, strconv.Itoa(order.UserID)); err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("UPDATE orders SET status = ?, paid_at = ? WHERE id = ?", model.OrderPaid, time.Now(), order.ID)
+	} else {
+		if err := releasePromoCode(tx, order.ID); err != nil {
+			return &keyError{http.StatusInternalServerError, "Failed to update order"}
+		}
+		_, err = tx.Exec("UPDATE orders SET status = ? WHERE id = ?", event.Status, order.ID)
+	}
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to update order"}
+	}
+	return tx.Commit()
+}
+
+// fulfillOrder issues what a paid order bought: time on the buyer's product
+// subscription, an activation key for the product owned by the buyer, or
+// balance in the buyer's wallet.
+func fulfillOrder(tx *sql.Tx, order model.Order) error {
+	userID := strconv.Itoa(order.UserID)
+
+	if order.Delivery == model.OrderDeliveryBalance {
+		ref := fmt.Sprintf("order:%d", order.ID)
+		_, err := transferWallet(tx, userID, model.WalletAccountPayments, ref, model.LedgerKindTopUp, ref, nil, int64(order.Amount))
+		return err
+	}
+	if order.Delivery == model.OrderDeliverySubscription {
+		if order.DurationDays == 0 {
+			return grantProductLifetime(tx, userID, *order.ProductID, model.SubscriptionSourceOrder, &order.ID)
+		}
+		return grantProductSubscription(tx, userID, *order.ProductID, order.DurationDays, model.SubscriptionSourceOrder, &order.ID)
+	}
+
+	keyType := model.KeyTypeSubscription
+	if order.DurationDays == 0 {
+		keyType = model.KeyTypeLifetime
+	}
+	format, err := resolveKeyFormat("", 0, 0, order.ProductID)
+	if err != nil {
+		return err
+	}
+	for {
+		newKey, err := generateActivationKey(format)
+		if err != nil {
+			return &keyError{http.StatusInternalServerError, "Failed to generate key"}
+		}
+		res, err := tx.Exec("INSERT IGNORE INTO activation_keys (key_string, key_type, duration_days, product_id, owner_user_id) VALUES (?, ?, ?, ?, ?)",
+			newKey, keyType, order.DurationDays, order.ProductID, order.UserID)
+		if err != nil {
+			return &keyError{http.StatusInternalServerError, "Failed to save key to database"}
+		}
+		// A collision with an existing key inserts nothing; just try again.
+		if n, _ := res.RowsAffected(); n == 1 {
+			keyID, _ := res.LastInsertId()
+			_, err = tx.Exec("UPDATE orders SET key_id = ? WHERE id = ?", keyID, order.ID)
+			if err != nil {
+				return &keyError{http.StatusInternalServerError, "Failed to update order"}
+			}
+			return nil
+		}
+	}
+}
+
+// FakeCheckoutHandler shows the fake provider's payment page. It only exists
+// while PAYMENT_PROVIDER=fake.
+func FakeCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Cfg.PaymentProvider != "fake" {
+		http.NotFound(w, r)
+		return
+	}
+	paymentID := r.URL.Query().Get("payment_id")
+
+	var orderID, amount int
+	var currency string
+	err := database.DB.QueryRow("SELECT id, amount, currency FROM orders WHERE provider = 'fake' AND provider_payment_id = ?", paymentID).Scan(&orderID, &amount, &currency)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><meta charset="UTF-8"><title>Fake checkout</title></head>
+<body style="font-family: sans-serif; text-align: center; padding: 40px;">
+	<h1>Order #%d</h1>
+	<p>%d %s</p>
+	<form method="POST">
+		<input type="hidden" name="payment_id" value="%s">
+		<button name="status" value="%s">Pay</button>
+		<button name="status" value="%s">Decline</button>
+		<button name="status" value="%s">Cancel</button>
+	</form>
+</body>
+</html>`, orderID, amount, html.EscapeString(currency), html.EscapeString(paymentID), model.OrderPaid, model.OrderFailed, model.OrderCanceled)
+}
+
+// FakeCheckoutSubmitHandler sends the signed webhook a real provider would
+// after the buyer acts on the checkout page, then returns the buyer to the
+// site.
+func FakeCheckoutSubmitHandler(w http.ResponseWriter, r *http.Request) {
+	if config.Cfg.PaymentProvider != "fake" {
+		http.NotFound(w, r)
+		return
+	}
+	paymentID := r.FormValue("payment_id")
+
+	var orderID int
+	err := database.DB.QueryRow("SELECT id FROM orders WHERE provider = 'fake' AND provider_payment_id = ?", paymentID).Scan(&orderID)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	body, _ := json.Marshal(fakeWebhook{ID: "evt_" + hex.EncodeToString(b), PaymentID: paymentID, Status: r.FormValue("status")})
+	req, _ := http.NewRequest("POST", config.Cfg.PublicURL+"/api/payments/webhook/fake", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Fake-Signature", signFakeWebhook(body))
+	resp, err := (&http.Client{Timeout: 15 * time.Second}).Do(req)
+	if err != nil {
+		http.Error(w, "Could not deliver webhook: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+	resp.Body.Close()
+
+	result := "success"
+	if r.FormValue("status") != model.OrderPaid {
+		result = "cancel"
+	}
+	http.Redirect(w, r, orderReturnURL(orderID, result), http.StatusSeeOther)
+}
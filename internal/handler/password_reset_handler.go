@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"golang.org/x/crypto/bcrypt"
+	"log"
 	"net/http"
 	"time"
 	"unicode/utf8"
@@ -23,6 +24,32 @@ func generateResetToken() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+// sendEmail delivers an HTML email through the Resend API.
+func sendEmail(to, subject, html string) error {
+	payload := map[string]string{
+		"from":    config.Cfg.EmailSender,
+		"to":      to,
+		"subject": subject,
+		"html":    html,
+	}
+	jsonPayload, _ := json.Marshal(payload)
+
+	emailReq, _ := http.NewRequest("POST", "https://api.resend.com/emails", bytes.NewBuffer(jsonPayload))
+	emailReq.Header.Set("Authorization", "Bearer "+config.Cfg.ResendApiKey)
+	emailReq.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(emailReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("resend responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
 func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		Email string `json:"email"`
@@ -90,24 +117,8 @@ func ForgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
 		</html>
 	`, username, resetLink, resetLink, resetLink)
 
-	payload := map[string]string{
-		"from":    config.Cfg.EmailSender,
-		"to":      req.Email,
-		"subject": "Восстановление доступа к аккаунту Astralis",
-		"html":    emailHTML,
-	}
-	jsonPayload, _ := json.Marshal(payload)
-
-	emailReq, _ := http.NewRequest("POST", "https://api.resend.com/emails", bytes.NewBuffer(jsonPayload))
-	emailReq.Header.Set("Authorization", "Bearer "+config.Cfg.ResendApiKey)
-	emailReq.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(emailReq)
-	if err != nil || resp.StatusCode >= 400 {
-		// Production: log this error. For now, we do nothing.
-	} else {
-		defer resp.Body.Close()
+	if err := sendEmail(req.Email, "Восстановление доступа к аккаунту Astralis", emailHTML); err != nil {
+		log.Printf("Could not send password reset email: %v", err)
 	}
 
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/model"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const webhookTolerance = 5 * time.Minute
+
+var errInvalidWebhookSignature = errors.New("invalid webhook signature")
+
+// paymentEvent is a verified webhook event. Status is the order status the
+// event moves the order to, or empty for events that do not concern us.
+type paymentEvent struct {
+	ID        string
+	PaymentID string
+	Status    string
+}
+
+// paymentProvider is implemented by each payment service orders can be paid
+// through.
+type paymentProvider interface {
+	// createPayment registers the order with the provider and returns the
+	// provider's payment ID and the URL the buyer pays at.
+	createPayment(order model.Order, productName string) (string, string, error)
+	// parseWebhook verifies the signature of a webhook request and decodes
+	// the event it carries.
+	parseWebhook(r *http.Request) (*paymentEvent, error)
+}
+
+var paymentProviders = map[string]paymentProvider{}
+
+func registerPaymentProvider(name string, p paymentProvider) {
+	paymentProviders[name] = p
+}
+
+func init() {
+	registerPaymentProvider("stripe", stripeProvider{})
+}
+
+// EnableFakePayments registers the fake provider. It is only called when
+// PAYMENT_PROVIDER=fake, so its webhooks are refused everywhere else.
+func EnableFakePayments() {
+	registerPaymentProvider("fake", fakeProvider{})
+}
+
+// activePaymentProvider returns the provider new orders are paid through.
+func activePaymentProvider() (string, paymentProvider, bool) {
+	name := config.Cfg.PaymentProvider
+	p, ok := paymentProviders[name]
+	return name, p, ok
+}
+
+func orderReturnURL(orderID int, result string) string {
+	return fmt.Sprintf("%s/orders/%d?result=%s", config.Cfg.SiteURL, orderID, result)
+}
+
+// stripeProvider takes payments through Stripe Checkout. Product prices are
+// in whole currency units and are sent to Stripe in hundredths.
+type stripeProvider struct{}
+
+func (stripeProvider) createPayment(order model.Order, productName string) (string, string, error) {
+	form := url.Values{}
+	form.Set("mode", "payment")
+	form.Set("client_reference_id", strconv.Itoa(order.ID))
+	form.Set("metadata[order_id]", strconv.Itoa(order.ID))
+	form.Set("line_items[0][quantity]", "1")
+	form.Set("line_items[0][price_data][currency]", strings.ToLower(order.Currency))
+	form.Set("line_items[0][price_data][unit_amount]", strconv.Itoa(order.Amount*100))
+	form.Set("line_items[0][price_data][product_data][name]", productName)
+	form.Set("success_url", orderReturnURL(order.ID, "success"))
+	form.Set("cancel_url", orderReturnURL(order.ID, "cancel"))
+	form.Set("expires_at", strconv.FormatInt(time.Now().Add(orderExpiry()).Unix(), 10))
+
+	req, err := http.NewRequest("POST", "https://api.stripe.com/v1/checkout/sessions", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+config.Cfg.StripeSecretKey)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Idempotency-Key", fmt.Sprintf("order-%d", order.ID))
+
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	var session struct {
+		ID    string `json:"id"`
+		URL   string `json:"url"`
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&session); err != nil {
+		return "", "", err
+	}
+	if resp.StatusCode >= 400 || session.ID == "" {
+		if session.Error != nil {
+			return "", "", fmt.Errorf("stripe: %s", session.Error.Message)
+		}
+		return "", "", fmt.Errorf("stripe: unexpected status %d", resp.StatusCode)
+	}
+	return session.ID, session.URL, nil
+}
+
+// parseWebhook checks the Stripe-Signature header, an HMAC-SHA256 of
+// "timestamp.body" keyed with the endpoint's signing secret.
+func (stripeProvider) parseWebhook(r *http.Request) (*paymentEvent, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			signatures = append(signatures, kv[1])
+		}
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || config.Cfg.StripeWebhookSecret == "" {
+		return nil, errInvalidWebhookSignature
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > webhookTolerance || age < -webhookTolerance {
+		return nil, errInvalidWebhookSignature
+	}
+	mac := hmac.New(sha256.New, []byte(config.Cfg.StripeWebhookSecret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	valid := false
+	for _, sig := range signatures {
+		if hmac.Equal([]byte(sig), []byte(expected)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, errInvalidWebhookSignature
+	}
+
+	var event struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID            string `json:"id"`
+				PaymentStatus string `json:"payment_status"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+
+	e := &paymentEvent{ID: event.ID, PaymentID: event.Data.Object.ID}
+	switch event.Type {
+	case "checkout.session.completed":
+		// Delayed payment methods complete the session before the money
+		// arrives; those are settled by async_payment_succeeded.
+		if event.Data.Object.PaymentStatus == "paid" {
+			e.Status = model.OrderPaid
+		}
+	case "checkout.session.async_payment_succeeded":
+		e.Status = model.OrderPaid
+	case "checkout.session.async_payment_failed":
+		e.Status = model.OrderFailed
+	case "checkout.session.expired":
+		e.Status = model.OrderCanceled
+	}
+	return e, nil
+}
+
+// fakeProvider stands in for a real payment service during development. Its
+// checkout page lives on this server and its webhooks are signed with
+// FAKE_PAYMENT_SECRET in the X-Fake-Signature header. It is only available
+// while PAYMENT_PROVIDER=fake.
+type fakeProvider struct{}
+
+type fakeWebhook struct {
+	ID        string `json:"id"`
+	PaymentID string `json:"payment_id"`
+	Status    string `json:"status"`
+}
+
+func (fakeProvider) createPayment(order model.Order, productName string) (string, string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	paymentID := "fake_" + hex.EncodeToString(b)
+	return paymentID, config.Cfg.PublicURL + "/api/payments/fake/checkout?payment_id=" + paymentID, nil
+}
+
+func (fakeProvider) parseWebhook(r *http.Request) (*paymentEvent, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if config.Cfg.PaymentProvider != "fake" || config.Cfg.FakePaymentSecret == "" || !hmac.Equal([]byte(r.Header.Get("X-Fake-Signature")), []byte(signFakeWebhook(body))) {
+		return nil, errInvalidWebhookSignature
+	}
+
+	var event fakeWebhook
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, err
+	}
+	e := &paymentEvent{ID: event.ID, PaymentID: event.PaymentID}
+	switch event.Status {
+	case model.OrderPaid, model.OrderCanceled, model.OrderFailed:
+		e.Status = event.Status
+	}
+	return e, nil
+}
+
+func signFakeWebhook(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(config.Cfg.FakePaymentSecret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -1,14 +1,264 @@
 package handler
 
 import (
+	"astralis.backend/internal/config"
 	"astralis.backend/internal/database"
 	"astralis.backend/internal/model"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	maxProductImageSize = 5 << 20
+	maxProductNameLen   = 255
 )
 
+var productSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+// productImageTypes maps the image types admins may upload to file extensions.
+var productImageTypes = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+}
+
+const productColumns = "id, name, description, price, is_featured, sort_index, COALESCE(key_prefix, ''), duration_days, COALESCE(slug, ''), COALESCE(image_url, ''), COALESCE(currency, ''), status"
+
+func scanProduct(row interface{ Scan(...interface{}) error }) (model.Product, error) {
+	var p model.Product
+	err := row.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.IsFeatured, &p.SortIndex, &p.KeyPrefix, &p.DurationDays, &p.Slug, &p.ImageURL, &p.Currency, &p.Status)
+	p.DurationOptions = []model.ProductDurationOption{}
+	return p, err
+}
+
+// productCurrency is the currency a product is sold in.
+func productCurrency(p model.Product) string {
+	if p.Currency != "" {
+		return p.Currency
+	}
+	return config.Cfg.PaymentCurrency
+}
+
+// attachProductDetails loads the duration options, and translations if asked
+// for, of the given products.
+func attachProductDetails(products []model.Product, withTranslations bool) error {
+	byID := map[int]*model.Product{}
+	for i := range products {
+		byID[products[i].ID] = &products[i]
+	}
+
+	rows, err := database.DB.Query("SELECT id, product_id, duration_days, price FROM product_duration_options ORDER BY sort_index, id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var o model.ProductDurationOption
+		var productID int
+		if err := rows.Scan(&o.ID, &productID, &o.DurationDays, &o.Price); err != nil {
+			return err
+		}
+		if p, ok := byID[productID]; ok {
+			p.DurationOptions = append(p.DurationOptions, o)
+		}
+	}
+	if err := rows.Err(); err != nil || !withTranslations {
+		return err
+	}
+
+	rows, err = database.DB.Query("SELECT product_id, language, name, description FROM product_translations")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var productID int
+		var language string
+		var t model.ProductTranslation
+		if err := rows.Scan(&productID, &language, &t.Name, &t.Description); err != nil {
+			return err
+		}
+		if p, ok := byID[productID]; ok {
+			if p.Translations == nil {
+				p.Translations = map[string]model.ProductTranslation{}
+			}
+			p.Translations[language] = t
+		}
+	}
+	return rows.Err()
+}
+
+// loadProduct returns one product with its duration options and translations.
+func loadProduct(productID int) (model.Product, error) {
+	p, err := scanProduct(database.DB.QueryRow("SELECT "+productColumns+" FROM products WHERE id = ?", productID))
+	if err != nil {
+		return p, err
+	}
+	products := []model.Product{p}
+	err = attachProductDetails(products, true)
+	return products[0], err
+}
+
+// acceptedLanguages returns the primary language tags of an Accept-Language
+// header, most preferred first.
+func acceptedLanguages(header string) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" || lang == "*" {
+			continue
+		}
+		if dash := strings.Index(lang, "-"); dash > 0 {
+			lang = lang[:dash]
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, weighted{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	result := make([]string, 0, len(langs))
+	for _, l := range langs {
+		result = append(result, l.lang)
+	}
+	return result
+}
+
+// publicProduct prepares a product for the storefront: its name and
+// description in the best language the client accepts, and no admin fields.
+// It returns the language served, or "" when the product has no translation
+// the client accepts and keeps its own name and description.
+func publicProduct(p model.Product, langs []string) (model.Product, string) {
+	served := ""
+	for _, lang := range langs {
+		if t, ok := p.Translations[lang]; ok {
+			p.Name, p.Description = t.Name, t.Description
+			served = lang
+			break
+		}
+	}
+	p.Translations = nil
+	p.KeyPrefix = ""
+	p.Currency = productCurrency(p)
+	return p, served
+}
+
+// setContentLanguage describes the languages of a storefront response, which
+// depends on the Accept-Language header.
+func setContentLanguage(w http.ResponseWriter, served []string) {
+	w.Header().Add("Vary", "Accept-Language")
+	seen := map[string]bool{}
+	langs := []string{}
+	for _, lang := range served {
+		if lang != "" && !seen[lang] {
+			seen[lang] = true
+			langs = append(langs, lang)
+		}
+	}
+	if len(langs) > 0 {
+		w.Header().Set("Content-Language", strings.Join(langs, ", "))
+	}
+}
+
+// GetProductsHandler lists the products shown in the store, which leaves out
+// hidden ones.
 func GetProductsHandler(w http.ResponseWriter, r *http.Request) {
-	rows, err := database.DB.Query("SELECT id, name, description, price, is_featured, sort_index FROM products ORDER BY sort_index ASC")
+	rows, err := database.DB.Query("SELECT "+productColumns+" FROM products WHERE status <> ? ORDER BY sort_index ASC", model.ProductHidden)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query products"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	products := make([]model.Product, 0)
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			http.Error(w, `{"error":"Failed to scan product row"}`, http.StatusInternalServerError)
+			return
+		}
+		products = append(products, p)
+	}
+	rows.Close()
+
+	if err := attachProductDetails(products, true); err != nil {
+		http.Error(w, `{"error":"Failed to query products"}`, http.StatusInternalServerError)
+		return
+	}
+	langs := acceptedLanguages(r.Header.Get("Accept-Language"))
+	served := make([]string, len(products))
+	for i := range products {
+		products[i], served[i] = publicProduct(products[i], langs)
+	}
+
+	setContentLanguage(w, served)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(products)
+}
+
+// GetProductHandler returns one visible product by slug or ID. A slug wins
+// over an ID that happens to look the same.
+func GetProductHandler(w http.ResponseWriter, r *http.Request) {
+	ref := mux.Vars(r)["slug"]
+	var productID int
+	err := database.DB.QueryRow("SELECT id FROM products WHERE slug = ? AND status <> ?", ref, model.ProductHidden).Scan(&productID)
+	if err == sql.ErrNoRows {
+		if id, convErr := strconv.Atoi(ref); convErr == nil {
+			err = database.DB.QueryRow("SELECT id FROM products WHERE id = ? AND status <> ?", id, model.ProductHidden).Scan(&productID)
+		}
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Product not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get product"}`, http.StatusInternalServerError)
+		return
+	}
+	p, err := loadProduct(productID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get product"}`, http.StatusInternalServerError)
+		return
+	}
+
+	p, served := publicProduct(p, acceptedLanguages(r.Header.Get("Accept-Language")))
+	setContentLanguage(w, []string{served})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
+
+// AdminGetProductsHandler lists every product, hidden ones included, with
+// all of its translations.
+func AdminGetProductsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query("SELECT " + productColumns + " FROM products ORDER BY sort_index ASC")
 	if err != nil {
 		http.Error(w, `{"error":"Failed to query products"}`, http.StatusInternalServerError)
 		return
@@ -17,14 +267,318 @@ func GetProductsHandler(w http.ResponseWriter, r *http.Request) {
 
 	products := make([]model.Product, 0)
 	for rows.Next() {
-		var p model.Product
-		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Price, &p.IsFeatured, &p.SortIndex); err != nil {
+		p, err := scanProduct(rows)
+		if err != nil {
 			http.Error(w, `{"error":"Failed to scan product row"}`, http.StatusInternalServerError)
 			return
 		}
 		products = append(products, p)
 	}
+	rows.Close()
+
+	if err := attachProductDetails(products, true); err != nil {
+		http.Error(w, `{"error":"Failed to query products"}`, http.StatusInternalServerError)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(products)
-}
\ No newline at end of file
+}
+
+// normalizeProduct cleans up the fields of a product an admin sent and
+// checks them, returning what is wrong with each field that fails.
+func normalizeProduct(p *model.Product) fieldErrors {
+	errs := fieldErrors{}
+
+	p.Name = strings.TrimSpace(p.Name)
+	if p.Name == "" {
+		errs["name"] = "Name is required"
+	} else if len(p.Name) > maxProductNameLen {
+		errs["name"] = fmt.Sprintf("Name cannot be longer than %d characters", maxProductNameLen)
+	}
+	if p.Price < 0 {
+		errs["price"] = "Price cannot be negative"
+	}
+	if p.SortIndex < 0 {
+		errs["sort_index"] = "Sort index cannot be negative"
+	}
+	if p.DurationDays < 0 {
+		errs["duration_days"] = "Duration cannot be negative"
+	}
+
+	p.KeyPrefix = strings.ToUpper(strings.TrimSpace(p.KeyPrefix))
+	if err := validateKeyPrefix(p.KeyPrefix); err != nil {
+		errs["key_prefix"] = err.Error()
+	}
+	p.Slug = strings.ToLower(strings.TrimSpace(p.Slug))
+	if p.Slug != "" && (len(p.Slug) > 64 || !productSlugPattern.MatchString(p.Slug)) {
+		errs["slug"] = "Slug may only contain lowercase letters, digits and single dashes"
+	}
+	p.Currency = strings.ToUpper(strings.TrimSpace(p.Currency))
+	if p.Currency != "" && len(p.Currency) != 3 {
+		errs["currency"] = "Currency must be a three-letter code"
+	}
+	if p.Status == "" {
+		p.Status = model.ProductActive
+	}
+	if p.Status != model.ProductActive && p.Status != model.ProductHidden && p.Status != model.ProductComingSoon {
+		errs["status"] = "Status must be active, hidden or coming_soon"
+	}
+
+	if p.DurationOptions == nil {
+		p.DurationOptions = []model.ProductDurationOption{}
+	}
+	for i, o := range p.DurationOptions {
+		if o.DurationDays < 0 || o.Price <= 0 {
+			errs[fmt.Sprintf("duration_options[%d]", i)] = "Duration options need a non-negative duration and a positive price"
+		}
+	}
+	for lang, t := range p.Translations {
+		if len(lang) < 2 || len(lang) > 8 || strings.TrimSpace(t.Name) == "" {
+			errs["translations."+lang] = "Translations need a language code and a name"
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// nextProductSortIndex is the sort index that puts a new product last.
+func nextProductSortIndex() (int, error) {
+	var next int
+	err := database.DB.QueryRow("SELECT COALESCE(MAX(sort_index) + 1, 0) FROM products").Scan(&next)
+	return next, err
+}
+
+// saveProductDetails replaces the duration options and translations of a
+// product with the ones in p. Options that carry the ID of an existing option
+// are updated in place, so they keep their ID; those left out are deleted.
+func saveProductDetails(tx *sql.Tx, p model.Product) error {
+	rows, err := tx.Query("SELECT id FROM product_duration_options WHERE product_id = ? FOR UPDATE", p.ID)
+	if err != nil {
+		return err
+	}
+	existing := map[int]bool{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[id] = true
+	}
+	rows.Close()
+
+	kept := map[int]bool{}
+	for i, o := range p.DurationOptions {
+		if o.ID == 0 {
+			if _, err := tx.Exec("INSERT INTO product_duration_options (product_id, duration_days, price, sort_index) VALUES (?, ?, ?, ?)",
+				p.ID, o.DurationDays, o.Price, i); err != nil {
+				return err
+			}
+			continue
+		}
+		if !existing[o.ID] {
+			return &keyError{http.StatusBadRequest, fmt.Sprintf("Unknown duration option %d", o.ID)}
+		}
+		if kept[o.ID] {
+			return &keyError{http.StatusBadRequest, fmt.Sprintf("Duration option %d is listed twice", o.ID)}
+		}
+		kept[o.ID] = true
+		if _, err := tx.Exec("UPDATE product_duration_options SET duration_days = ?, price = ?, sort_index = ? WHERE id = ?",
+			o.DurationDays, o.Price, i, o.ID); err != nil {
+			return err
+		}
+	}
+	for id := range existing {
+		if kept[id] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM product_duration_options WHERE id = ?", id); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM product_translations WHERE product_id = ?", p.ID); err != nil {
+		return err
+	}
+	for lang, t := range p.Translations {
+		if _, err := tx.Exec("INSERT INTO product_translations (product_id, language, name, description) VALUES (?, ?, ?, ?)",
+			p.ID, strings.ToLower(lang), t.Name, t.Description); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// productSlugTaken reports whether another product already uses the slug.
+func productSlugTaken(slug string, productID int) (bool, error) {
+	if slug == "" {
+		return false, nil
+	}
+	var taken bool
+	err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE slug = ? AND id <> ?)", slug, productID).Scan(&taken)
+	return taken, err
+}
+
+// AdminUploadProductImageHandler stores an uploaded image for a product and
+// points the product's image_url at it.
+func AdminUploadProductImageHandler(w http.ResponseWriter, r *http.Request) {
+	productID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid product ID"}`, http.StatusBadRequest)
+		return
+	}
+	if err := validateProductExists(productID); err != nil {
+		writeKeyError(w, err, "Failed to look up product")
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxProductImageSize+1<<20)
+	file, _, err := r.FormFile("image")
+	if err != nil {
+		http.Error(w, `{"error":"Send the image as the image field of a multipart form, up to 5 MB"}`, http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxProductImageSize+1))
+	if err != nil || len(data) > maxProductImageSize {
+		http.Error(w, `{"error":"Image must be at most 5 MB"}`, http.StatusBadRequest)
+		return
+	}
+	ext, ok := productImageTypes[http.DetectContentType(data)]
+	if !ok {
+		http.Error(w, `{"error":"Image must be a PNG, JPEG, WebP or GIF"}`, http.StatusBadRequest)
+		return
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	name := "product-" + strconv.Itoa(productID) + "-" + hex.EncodeToString(b) + ext
+	dir := filepath.Join(config.Cfg.UploadDir, "products")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		http.Error(w, `{"error":"Failed to save image"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		http.Error(w, `{"error":"Failed to save image"}`, http.StatusInternalServerError)
+		return
+	}
+
+	imageURL := config.Cfg.PublicURL + "/api/uploads/products/" + name
+	if _, err := database.DB.Exec("UPDATE products SET image_url = ? WHERE id = ?", imageURL, productID); err != nil {
+		http.Error(w, `{"error":"Failed to update product"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"image_url": imageURL})
+}
+
+// filesOnly is a file system that hides directories, so a file server on it
+// does not list them.
+type filesOnly struct {
+	http.FileSystem
+}
+
+func (fs filesOnly) Open(name string) (http.File, error) {
+	f, err := fs.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		f.Close()
+		return nil, os.ErrNotExist
+	}
+	return f, nil
+}
+
+func UploadsHandler(w http.ResponseWriter, r *http.Request) {
+	fs := http.StripPrefix("/api/uploads/", http.FileServer(filesOnly{http.Dir(config.Cfg.UploadDir)}))
+	fs.ServeHTTP(w, r)
+}
+
+// AdminReorderProductsHandler sets the store order of products. The listed
+// products come first, in the order given; any left out keep their relative
+// order after them.
+func AdminReorderProductsHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ProductIDs []int `json:"product_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.ProductIDs) == 0 {
+		writeFieldErrors(w, "Invalid product order", fieldErrors{"product_ids": "List at least one product"}, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, sort_index FROM products ORDER BY sort_index, id FOR UPDATE")
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query products"}`, http.StatusInternalServerError)
+		return
+	}
+	var current []int
+	sortIndex := map[int]int{}
+	for rows.Next() {
+		var id, idx int
+		if err := rows.Scan(&id, &idx); err != nil {
+			rows.Close()
+			http.Error(w, `{"error":"Failed to scan product row"}`, http.StatusInternalServerError)
+			return
+		}
+		current = append(current, id)
+		sortIndex[id] = idx
+	}
+	rows.Close()
+
+	listed := map[int]bool{}
+	for i, id := range req.ProductIDs {
+		field := fmt.Sprintf("product_ids[%d]", i)
+		if _, ok := sortIndex[id]; !ok {
+			writeFieldErrors(w, "Invalid product order", fieldErrors{field: fmt.Sprintf("Product %d does not exist", id)}, http.StatusBadRequest)
+			return
+		}
+		if listed[id] {
+			writeFieldErrors(w, "Invalid product order", fieldErrors{field: fmt.Sprintf("Product %d is listed twice", id)}, http.StatusBadRequest)
+			return
+		}
+		listed[id] = true
+	}
+
+	order := append([]int{}, req.ProductIDs...)
+	for _, id := range current {
+		if !listed[id] {
+			order = append(order, id)
+		}
+	}
+	for i, id := range order {
+		if sortIndex[id] == i {
+			continue
+		}
+		if _, err := tx.Exec("UPDATE products SET sort_index = ? WHERE id = ?", i, id); err != nil {
+			http.Error(w, `{"error":"Failed to reorder products"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": "Products reordered successfully", "product_ids": order})
+}
@@ -0,0 +1,468 @@
+package handler
+
+import (
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func normalizePromoCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// applyPromoCode checks that the user may use a promo code on a product and
+// returns the discount off price together with the code's ID. With forUpdate
+// the code row is locked, so its usage limits hold against concurrent orders.
+func applyPromoCode(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, code string, userID, productID, price int, forUpdate bool) (int, int, error) {
+	lock := ""
+	if forUpdate {
+		lock = " FOR UPDATE"
+	}
+
+	var p model.PromoCode
+	var maxUses, maxUsesPerUser sql.NullInt64
+	var validFrom, validUntil sql.NullTime
+	err := q.QueryRow(`SELECT id, discount_type, discount_value, max_uses, max_uses_per_user, uses, valid_from, valid_until, is_active
+		FROM promo_codes WHERE code = ?`+lock, normalizePromoCode(code)).Scan(
+		&p.ID, &p.DiscountType, &p.DiscountValue, &maxUses, &maxUsesPerUser, &p.Uses, &validFrom, &validUntil, &p.IsActive)
+	if err == sql.ErrNoRows || (err == nil && !p.IsActive) {
+		return 0, 0, &keyError{http.StatusNotFound, "Promo code not found"}
+	}
+	if err != nil {
+		return 0, 0, &keyError{http.StatusInternalServerError, "Failed to look up promo code"}
+	}
+
+	now := time.Now()
+	if validFrom.Valid && now.Before(validFrom.Time) {
+		return 0, 0, &keyError{http.StatusConflict, "Promo code is not active yet"}
+	}
+	if validUntil.Valid && !now.Before(validUntil.Time) {
+		return 0, 0, &keyError{http.StatusConflict, "Promo code has expired"}
+	}
+
+	var restricted, matches int
+	err = q.QueryRow("SELECT COUNT(*), COALESCE(SUM(product_id = ?), 0) FROM promo_code_products WHERE promo_code_id = ?", productID, p.ID).Scan(&restricted, &matches)
+	if err != nil {
+		return 0, 0, &keyError{http.StatusInternalServerError, "Failed to look up promo code"}
+	}
+	if restricted > 0 && matches == 0 {
+		return 0, 0, &keyError{http.StatusConflict, "Promo code does not apply to this product"}
+	}
+
+	if maxUses.Valid && int64(p.Uses) >= maxUses.Int64 {
+		return 0, 0, &keyError{http.StatusConflict, "Promo code has been used up"}
+	}
+	if maxUsesPerUser.Valid {
+		var used int64
+		// Pending orders only hold the code until they expire.
+		err = q.QueryRow("SELECT COUNT(*) FROM orders WHERE promo_code_id = ? AND user_id = ? AND (status = ? OR (status = ? AND created_at > ?))",
+			p.ID, userID, model.OrderPaid, model.OrderPending, now.Add(-orderExpiry())).Scan(&used)
+		if err != nil {
+			return 0, 0, &keyError{http.StatusInternalServerError, "Failed to look up promo code"}
+		}
+		if used >= maxUsesPerUser.Int64 {
+			return 0, 0, &keyError{http.StatusConflict, "You have already used this promo code"}
+		}
+	}
+
+	discount := p.DiscountValue
+	if p.DiscountType == model.PromoDiscountPercent {
+		discount = price * p.DiscountValue / 100
+	}
+	if discount > price {
+		discount = price
+	}
+	return discount, p.ID, nil
+}
+
+// releasePromoCode gives back the use an unpaid order held on its promo code.
+func releasePromoCode(db interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}, orderID int) error {
+	_, err := db.Exec("UPDATE promo_codes p JOIN orders o ON o.promo_code_id = p.id SET p.uses = p.uses - 1 WHERE o.id = ? AND p.uses > 0", orderID)
+	return err
+}
+
+// QuoteOrderHandler prices a product for the user before checkout, with the
+// discount of an optional promo code applied.
+func QuoteOrderHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	userID, _ := strconv.Atoi(claims.Subject)
+
+	var req struct {
+		ProductID        int    `json:"product_id"`
+		PromoCode        string `json:"promo_code"`
+		DurationOptionID *int   `json:"duration_option_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	offer, err := lookupProductOffer(req.ProductID, req.DurationOptionID)
+	if err != nil {
+		writeKeyError(w, err, "Failed to look up product")
+		return
+	}
+	quote := model.OrderQuote{ProductID: req.ProductID, Price: offer.Price, DurationDays: offer.DurationDays, Currency: offer.Currency}
+
+	if code := normalizePromoCode(req.PromoCode); code != "" {
+		quote.Discount, _, err = applyPromoCode(database.DB, code, userID, req.ProductID, quote.Price, false)
+		if err != nil {
+			writeKeyError(w, err, "Failed to apply promo code")
+			return
+		}
+		quote.PromoCode = &code
+	}
+	quote.Amount = quote.Price - quote.Discount
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
+
+// promoCodeRequest is the body of promo code create and update requests.
+// Fields left out of an update keep their value.
+type promoCodeRequest struct {
+	Code           *string    `json:"code"`
+	DiscountType   *string    `json:"discount_type"`
+	DiscountValue  *int       `json:"discount_value"`
+	MaxUses        *int       `json:"max_uses"`
+	MaxUsesPerUser *int       `json:"max_uses_per_user"`
+	ValidFrom      *time.Time `json:"valid_from"`
+	ValidUntil     *time.Time `json:"valid_until"`
+	IsActive       *bool      `json:"is_active"`
+	ProductIDs     *[]int     `json:"product_ids"`
+}
+
+// merge applies the request on top of p and validates the result.
+func (req promoCodeRequest) merge(p *model.PromoCode) error {
+	if req.Code != nil {
+		p.Code = normalizePromoCode(*req.Code)
+	}
+	if req.DiscountType != nil {
+		p.DiscountType = *req.DiscountType
+	}
+	if req.DiscountValue != nil {
+		p.DiscountValue = *req.DiscountValue
+	}
+	if req.MaxUses != nil {
+		p.MaxUses = req.MaxUses
+	}
+	if req.MaxUsesPerUser != nil {
+		p.MaxUsesPerUser = req.MaxUsesPerUser
+	}
+	if req.ValidFrom != nil {
+		p.ValidFrom = req.ValidFrom
+	}
+	if req.ValidUntil != nil {
+		p.ValidUntil = req.ValidUntil
+	}
+	if req.IsActive != nil {
+		p.IsActive = *req.IsActive
+	}
+	if req.ProductIDs != nil {
+		p.ProductIDs = *req.ProductIDs
+	}
+
+	if p.Code == "" || len(p.Code) > 64 {
+		return &keyError{http.StatusBadRequest, "Code must be between 1 and 64 characters"}
+	}
+	switch p.DiscountType {
+	case model.PromoDiscountPercent:
+		if p.DiscountValue < 1 || p.DiscountValue > 100 {
+			return &keyError{http.StatusBadRequest, "Percent discount must be between 1 and 100"}
+		}
+	case model.PromoDiscountFixed:
+		if p.DiscountValue < 1 {
+			return &keyError{http.StatusBadRequest, "Fixed discount must be positive"}
+		}
+	default:
+		return &keyError{http.StatusBadRequest, "Discount type must be percent or fixed"}
+	}
+	if (p.MaxUses != nil && *p.MaxUses < 0) || (p.MaxUsesPerUser != nil && *p.MaxUsesPerUser < 0) {
+		return &keyError{http.StatusBadRequest, "Usage limits cannot be negative"}
+	}
+	if p.ValidFrom != nil && p.ValidUntil != nil && !p.ValidUntil.After(*p.ValidFrom) {
+		return &keyError{http.StatusBadRequest, "valid_until must be after valid_from"}
+	}
+	for _, productID := range p.ProductIDs {
+		if err := validateProductExists(productID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func savePromoCodeProducts(tx *sql.Tx, p model.PromoCode) error {
+	if _, err := tx.Exec("DELETE FROM promo_code_products WHERE promo_code_id = ?", p.ID); err != nil {
+		return err
+	}
+	for _, productID := range p.ProductIDs {
+		if _, err := tx.Exec("INSERT IGNORE INTO promo_code_products (promo_code_id, product_id) VALUES (?, ?)", p.ID, productID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func AdminGetPromoCodesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(`SELECT id, code, discount_type, discount_value, max_uses, max_uses_per_user, uses, valid_from, valid_until, is_active, created_at
+		FROM promo_codes ORDER BY id DESC`)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query promo codes"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	promoCodes := make([]model.PromoCode, 0)
+	for rows.Next() {
+		var p model.PromoCode
+		var maxUses, maxUsesPerUser sql.NullInt64
+		var validFrom, validUntil sql.NullTime
+		if err := rows.Scan(&p.ID, &p.Code, &p.DiscountType, &p.DiscountValue, &maxUses, &maxUsesPerUser, &p.Uses, &validFrom, &validUntil, &p.IsActive, &p.CreatedAt); err != nil {
+			http.Error(w, `{"error":"Failed to scan promo code row"}`, http.StatusInternalServerError)
+			return
+		}
+		if maxUses.Valid {
+			n := int(maxUses.Int64)
+			p.MaxUses = &n
+		}
+		if maxUsesPerUser.Valid {
+			n := int(maxUsesPerUser.Int64)
+			p.MaxUsesPerUser = &n
+		}
+		if validFrom.Valid {
+			p.ValidFrom = &validFrom.Time
+		}
+		if validUntil.Valid {
+			p.ValidUntil = &validUntil.Time
+		}
+		p.ProductIDs = []int{}
+		promoCodes = append(promoCodes, p)
+	}
+	rows.Close()
+	byID := map[int]*model.PromoCode{}
+	for i := range promoCodes {
+		byID[promoCodes[i].ID] = &promoCodes[i]
+	}
+
+	rows, err = database.DB.Query("SELECT promo_code_id, product_id FROM promo_code_products ORDER BY product_id")
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query promo codes"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var promoCodeID, productID int
+		if err := rows.Scan(&promoCodeID, &productID); err != nil {
+			http.Error(w, `{"error":"Failed to scan promo code row"}`, http.StatusInternalServerError)
+			return
+		}
+		if p, ok := byID[promoCodeID]; ok {
+			p.ProductIDs = append(p.ProductIDs, productID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(promoCodes)
+}
+
+func AdminCreatePromoCodeHandler(w http.ResponseWriter, r *http.Request) {
+	var req promoCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	p := model.PromoCode{IsActive: true}
+	if err := req.merge(&p); err != nil {
+		writeKeyError(w, err, "Invalid promo code")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM promo_codes WHERE code = ?)", p.Code).Scan(&exists); err != nil {
+		http.Error(w, `{"error":"Failed to create promo code"}`, http.StatusInternalServerError)
+		return
+	}
+	if exists {
+		http.Error(w, `{"error":"A promo code with this code already exists"}`, http.StatusConflict)
+		return
+	}
+
+	res, err := tx.Exec(`INSERT INTO promo_codes (code, discount_type, discount_value, max_uses, max_uses_per_user, valid_from, valid_until, is_active)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`, p.Code, p.DiscountType, p.DiscountValue, p.MaxUses, p.MaxUsesPerUser, p.ValidFrom, p.ValidUntil, p.IsActive)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to create promo code"}`, http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+	p.ID = int(id)
+	if err := savePromoCodeProducts(tx, p); err != nil {
+		http.Error(w, `{"error":"Failed to save promo code products"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": p.ID, "message": "Promo code created successfully"})
+}
+
+func AdminUpdatePromoCodeHandler(w http.ResponseWriter, r *http.Request) {
+	promoCodeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid promo code ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req promoCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	p := model.PromoCode{ID: promoCodeID}
+	var maxUses, maxUsesPerUser sql.NullInt64
+	var validFrom, validUntil sql.NullTime
+	err = tx.QueryRow(`SELECT code, discount_type, discount_value, max_uses, max_uses_per_user, valid_from, valid_until, is_active
+		FROM promo_codes WHERE id = ? FOR UPDATE`, promoCodeID).Scan(
+		&p.Code, &p.DiscountType, &p.DiscountValue, &maxUses, &maxUsesPerUser, &validFrom, &validUntil, &p.IsActive)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Promo code not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get promo code"}`, http.StatusInternalServerError)
+		return
+	}
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		p.MaxUses = &n
+	}
+	if maxUsesPerUser.Valid {
+		n := int(maxUsesPerUser.Int64)
+		p.MaxUsesPerUser = &n
+	}
+	if validFrom.Valid {
+		p.ValidFrom = &validFrom.Time
+	}
+	if validUntil.Valid {
+		p.ValidUntil = &validUntil.Time
+	}
+	if req.Code != nil && normalizePromoCode(*req.Code) != p.Code {
+		http.Error(w, `{"error":"The code itself cannot be changed"}`, http.StatusBadRequest)
+		return
+	}
+	if err := req.merge(&p); err != nil {
+		writeKeyError(w, err, "Invalid promo code")
+		return
+	}
+
+	_, err = tx.Exec(`UPDATE promo_codes SET discount_type = ?, discount_value = ?, max_uses = ?, max_uses_per_user = ?, valid_from = ?, valid_until = ?, is_active = ?
+		WHERE id = ?`, p.DiscountType, p.DiscountValue, p.MaxUses, p.MaxUsesPerUser, p.ValidFrom, p.ValidUntil, p.IsActive, p.ID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to update promo code"}`, http.StatusInternalServerError)
+		return
+	}
+	if req.ProductIDs != nil {
+		if err := savePromoCodeProducts(tx, p); err != nil {
+			http.Error(w, `{"error":"Failed to save promo code products"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Promo code updated successfully"})
+}
+
+// AdminDeletePromoCodeHandler deletes a promo code no order has used, and
+// deactivates it otherwise so past orders keep pointing at it.
+func AdminDeletePromoCodeHandler(w http.ResponseWriter, r *http.Request) {
+	promoCodeID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid promo code ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// Orders lock the code row before they take it, so none can start using
+	// it between the check and the delete.
+	var exists int
+	err = tx.QueryRow("SELECT 1 FROM promo_codes WHERE id = ? FOR UPDATE", promoCodeID).Scan(&exists)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Promo code not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to delete promo code"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var used bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM orders WHERE promo_code_id = ?)", promoCodeID).Scan(&used); err != nil {
+		http.Error(w, `{"error":"Failed to delete promo code"}`, http.StatusInternalServerError)
+		return
+	}
+	if used {
+		_, err = tx.Exec("UPDATE promo_codes SET is_active = FALSE WHERE id = ?", promoCodeID)
+	} else {
+		_, err = tx.Exec("DELETE FROM promo_code_products WHERE promo_code_id = ?", promoCodeID)
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM promo_codes WHERE id = ?", promoCodeID)
+		}
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to delete promo code"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Promo code deleted successfully"})
+}
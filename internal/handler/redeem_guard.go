@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/model"
+	"encoding/json"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outcomes recorded in key_redeem_attempts. An attempt that passed the
+// guard is pending until the key has been checked.
+const (
+	redeemPending        = "pending"
+	redeemSuccess        = "success"
+	redeemInvalid        = "invalid"
+	redeemMalformed      = "malformed"
+	redeemBlocked        = "blocked"
+	redeemCaptchaMissing = "captcha_missing"
+	redeemCaptchaFailed  = "captcha_failed"
+)
+
+// failedRedeemResults are the outcomes that count towards blocking and CAPTCHA
+// escalation.
+const failedRedeemResults = "'invalid', 'malformed', 'captcha_failed'"
+
+// uncountedRedeemResults are refusals that do not count as attempts, so a
+// client retrying while limited, or asked for a CAPTCHA it has not shown yet,
+// does not extend its own limit.
+const uncountedRedeemResults = "'blocked', 'captcha_missing'"
+
+// clientIP returns the address of the caller. Proxy headers are only trusted
+// when the server is configured to sit behind a reverse proxy.
+func clientIP(r *http.Request) string {
+	if config.Cfg.TrustProxy {
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			return ip
+		}
+		if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+			return strings.TrimSpace(strings.Split(fwd, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// redeemGuard decides whether a redeem attempt may proceed and records it.
+// The user's and the IP's lock rows are held while attempts are counted and
+// the new one is inserted, so concurrent attempts cannot all slip under a
+// limit. When the attempt may not proceed, it returns the HTTP status and
+// error body to send; otherwise the status is 0 and attemptID names the
+// pending attempt to finish with finishRedeemAttempt.
+func redeemGuard(userID, ip, key, turnstileToken string) (status int, body string, attemptID int64) {
+	cfg := config.Cfg
+	windowStart := time.Now().Add(-time.Duration(cfg.RedeemWindowMinutes) * time.Minute)
+	blockStart := time.Now().Add(-time.Duration(cfg.RedeemBlockMinutes) * time.Minute)
+
+	// Turnstile is asked before any lock is taken; the answer is only used
+	// if the attempt turns out to need a CAPTCHA.
+	captchaPassed := false
+	if turnstileToken != "" {
+		ok, err := verifyTurnstile(turnstileToken)
+		if err != nil {
+			return http.StatusInternalServerError, `{"error":"Failed to verify CAPTCHA"}`, 0
+		}
+		captchaPassed = ok
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		return http.StatusInternalServerError, `{"error":"Server error"}`, 0
+	}
+	defer tx.Rollback()
+
+	for _, scope := range []string{"user:" + userID, "ip:" + ip} {
+		if _, err := tx.Exec("INSERT IGNORE INTO redeem_guard_locks (scope) VALUES (?)", scope); err != nil {
+			log.Printf("Could not lock redeem attempts: %v", err)
+			return http.StatusInternalServerError, `{"error":"Server error"}`, 0
+		}
+		var locked string
+		if err := tx.QueryRow("SELECT scope FROM redeem_guard_locks WHERE scope = ? FOR UPDATE", scope).Scan(&locked); err != nil {
+			log.Printf("Could not lock redeem attempts: %v", err)
+			return http.StatusInternalServerError, `{"error":"Server error"}`, 0
+		}
+	}
+
+	var userAttempts, ipAttempts, userFailures, ipFailures int
+	err = tx.QueryRow(`
+		SELECT
+			COALESCE(SUM(user_id = ? AND created_at > ? AND result NOT IN (`+uncountedRedeemResults+`)), 0),
+			COALESCE(SUM(ip = ? AND created_at > ? AND result NOT IN (`+uncountedRedeemResults+`)), 0),
+			COALESCE(SUM(user_id = ? AND result IN (`+failedRedeemResults+`)), 0),
+			COALESCE(SUM(ip = ? AND result IN (`+failedRedeemResults+`)), 0)
+		FROM key_redeem_attempts
+		WHERE (user_id = ? OR ip = ?) AND created_at > ?`,
+		userID, windowStart, ip, windowStart, userID, ip, userID, ip, blockStart,
+	).Scan(&userAttempts, &ipAttempts, &userFailures, &ipFailures)
+	if err != nil {
+		log.Printf("Could not check redeem attempts: %v", err)
+		return http.StatusInternalServerError, `{"error":"Server error"}`, 0
+	}
+
+	failures := userFailures
+	if ipFailures > failures {
+		failures = ipFailures
+	}
+	result := redeemPending
+	switch {
+	case failures >= cfg.RedeemBlockAfter:
+		status, body, result = http.StatusTooManyRequests, `{"error":"Too many invalid keys, activation is temporarily blocked","code":"redeem_blocked"}`, redeemBlocked
+	case userAttempts >= cfg.RedeemUserLimit || ipAttempts >= cfg.RedeemIPLimit:
+		status, body, result = http.StatusTooManyRequests, `{"error":"Too many activation attempts, please try again later","code":"redeem_rate_limited"}`, redeemBlocked
+	case failures >= cfg.RedeemCaptchaAfter && turnstileToken == "":
+		status, body, result = http.StatusForbidden, `{"error":"CAPTCHA verification required","code":"captcha_required"}`, redeemCaptchaMissing
+	case failures >= cfg.RedeemCaptchaAfter && !captchaPassed:
+		status, body, result = http.StatusForbidden, `{"error":"CAPTCHA verification failed, please try again","code":"captcha_required"}`, redeemCaptchaFailed
+	}
+
+	if len(key) > 64 {
+		key = key[:64]
+	}
+	res, err := tx.Exec("INSERT INTO key_redeem_attempts (user_id, ip, key_attempted, result) VALUES (?, ?, ?, ?)", userID, ip, key, result)
+	if err == nil {
+		attemptID, err = res.LastInsertId()
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Could not log redeem attempt: %v", err)
+		return http.StatusInternalServerError, `{"error":"Server error"}`, 0
+	}
+	return status, body, attemptID
+}
+
+// finishRedeemAttempt records the outcome of an attempt that passed the
+// guard. It runs outside the redeem transaction, so failed attempts are kept
+// even though their transaction is rolled back.
+func finishRedeemAttempt(attemptID int64, result string) {
+	_, err := database.DB.Exec("UPDATE key_redeem_attempts SET result = ? WHERE id = ?", result, attemptID)
+	if err != nil {
+		log.Printf("Could not log redeem attempt: %v", err)
+	}
+}
+
+// maxKeyAttemptsPageSize caps the limit parameter of attempt listings.
+const maxKeyAttemptsPageSize = 100
+
+func AdminGetKeyAttemptsHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	if limit > maxKeyAttemptsPageSize {
+		limit = maxKeyAttemptsPageSize
+	}
+	offset := (page - 1) * limit
+
+	where := "WHERE 1 = 1"
+	args := []interface{}{}
+	if userID := query.Get("user_id"); userID != "" {
+		where += " AND user_id = ?"
+		args = append(args, userID)
+	}
+	if ip := query.Get("ip"); ip != "" {
+		where += " AND ip = ?"
+		args = append(args, ip)
+	}
+	if query.Get("failed_only") == "true" {
+		where += " AND result IN (" + failedRedeemResults + ", '" + redeemBlocked + "')"
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM key_redeem_attempts "+where, args...).Scan(&total); err != nil {
+		http.Error(w, `{"error":"Failed to count attempts"}`, http.StatusInternalServerError)
+		return
+	}
+	totalPages := int(math.Ceil(float64(total) / float64(limit)))
+
+	rows, err := database.DB.Query("SELECT id, user_id, ip, key_attempted, result, created_at FROM key_redeem_attempts "+where+" ORDER BY id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query attempts"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	attempts := make([]model.KeyRedeemAttempt, 0)
+	for rows.Next() {
+		var a model.KeyRedeemAttempt
+		if err := rows.Scan(&a.ID, &a.UserID, &a.IP, &a.KeyAttempted, &a.Result, &a.CreatedAt); err != nil {
+			http.Error(w, `{"error":"Failed to scan attempt row"}`, http.StatusInternalServerError)
+			return
+		}
+		attempts = append(attempts, a)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.PaginatedKeyAttemptsResponse{
+		Attempts:    attempts,
+		TotalPages:  totalPages,
+		CurrentPage: page,
+	})
+}
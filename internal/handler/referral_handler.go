@@ -0,0 +1,326 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const referralCodeLength = 8
+
+// ensureReferralCode returns the user's referral code, assigning one first
+// if the user does not have one yet.
+func ensureReferralCode(userID string) (string, error) {
+	var code sql.NullString
+	if err := database.DB.QueryRow("SELECT referral_code FROM users WHERE id = ?", userID).Scan(&code); err != nil {
+		return "", err
+	}
+	if code.Valid {
+		return code.String, nil
+	}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		b := make([]byte, referralCodeLength)
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for i := range b {
+			b[i] = crockfordAlphabet[b[i]&31]
+		}
+		// The unique index rejects a code another user already has; a
+		// concurrent request may also have assigned one in the meantime.
+		database.DB.Exec("UPDATE users SET referral_code = ? WHERE id = ? AND referral_code IS NULL", string(b), userID)
+		if err := database.DB.QueryRow("SELECT referral_code FROM users WHERE id = ?", userID).Scan(&code); err != nil {
+			return "", err
+		}
+		if code.Valid {
+			return code.String, nil
+		}
+	}
+	return "", fmt.Errorf("could not assign a referral code to user %s", userID)
+}
+
+// recordReferral links a newly registered user to the owner of the referral
+// code. A referral from an address the referrer also uses is flagged for
+// review: it may be a self-referral, or just two people behind one NAT.
+func recordReferral(referrerID, referredID int64, ip string) error {
+	var sameIP bool
+	err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ? AND (registration_ip = ? OR last_login_ip = ?))",
+		referrerID, ip, ip).Scan(&sameIP)
+	if err != nil {
+		return err
+	}
+	reviewReason := sql.NullString{}
+	if sameIP {
+		reviewReason = sql.NullString{String: model.ReferralRejectSameIP, Valid: true}
+	}
+	_, err = database.DB.Exec("INSERT INTO referrals (referrer_id, referred_id, status, review_reason) VALUES (?, ?, ?, ?)",
+		referrerID, referredID, model.ReferralPending, reviewReason)
+	return err
+}
+
+// selfReferralReason reports whether two accounts share a device or an
+// address, which suggests one person referred themselves.
+func selfReferralReason(tx *sql.Tx, referrerID int, referredID string) (string, error) {
+	var shared bool
+	err := tx.QueryRow(`SELECT EXISTS(
+		SELECT 1 FROM (SELECT hwid FROM users WHERE id = ? AND hwid IS NOT NULL UNION SELECT hwid FROM user_devices WHERE user_id = ?) a
+		JOIN (SELECT hwid FROM users WHERE id = ? AND hwid IS NOT NULL UNION SELECT hwid FROM user_devices WHERE user_id = ?) b ON a.hwid = b.hwid)`,
+		referrerID, referrerID, referredID, referredID).Scan(&shared)
+	if err != nil || shared {
+		return model.ReferralRejectSameHWID, err
+	}
+
+	err = tx.QueryRow(`SELECT EXISTS(
+		SELECT 1 FROM (SELECT registration_ip AS ip FROM users WHERE id = ? UNION SELECT last_login_ip FROM users WHERE id = ? UNION SELECT ip FROM key_redeem_attempts WHERE user_id = ?) a
+		JOIN (SELECT registration_ip AS ip FROM users WHERE id = ? UNION SELECT last_login_ip FROM users WHERE id = ? UNION SELECT ip FROM key_redeem_attempts WHERE user_id = ?) b ON a.ip = b.ip)`,
+		referrerID, referrerID, referrerID, referredID, referredID, referredID).Scan(&shared)
+	if err != nil || shared {
+		return model.ReferralRejectSameIP, err
+	}
+	return "", nil
+}
+
+// completeReferral settles the pending referral of a user who has just paid
+// for access, giving the referrer bonus days on the global subscription. A
+// shared device rejects the referral; a shared address holds it for an admin
+// to review. It does nothing for users without a pending referral.
+func completeReferral(tx *sql.Tx, referredID string) error {
+	if config.Cfg.ReferralRewardDays <= 0 {
+		return nil
+	}
+
+	var referralID, referrerID int
+	var reviewReason sql.NullString
+	err := tx.QueryRow("SELECT id, referrer_id, review_reason FROM referrals WHERE referred_id = ? AND status = ? FOR UPDATE",
+		referredID, model.ReferralPending).Scan(&referralID, &referrerID, &reviewReason)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to look up referral"}
+	}
+
+	reason, err := selfReferralReason(tx, referrerID, referredID)
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to check referral"}
+	}
+	if reason == model.ReferralRejectSameHWID {
+		_, err = tx.Exec("UPDATE referrals SET status = ?, reject_reason = ?, completed_at = ? WHERE id = ?",
+			model.ReferralRejected, reason, time.Now(), referralID)
+		if err != nil {
+			return &keyError{http.StatusInternalServerError, "Failed to update referral"}
+		}
+		return nil
+	}
+	if reason == "" && reviewReason.Valid {
+		reason = reviewReason.String
+	}
+	if reason != "" {
+		_, err = tx.Exec("UPDATE referrals SET status = ?, review_reason = ? WHERE id = ?", model.ReferralReview, reason, referralID)
+		if err != nil {
+			return &keyError{http.StatusInternalServerError, "Failed to update referral"}
+		}
+		return nil
+	}
+	return rewardReferral(tx, referralID, referrerID, referredID)
+}
+
+// rewardReferral gives the referrer their bonus days and closes the referral.
+func rewardReferral(tx *sql.Tx, referralID, referrerID int, referredID string) error {
+	days := config.Cfg.ReferralRewardDays
+	referrer := fmt.Sprint(referrerID)
+	if err := extendSubscription(tx, referrer, days); err != nil {
+		return err
+	}
+	if err := recordSubscriptionAdjustment(tx, referrer, nil, nil, model.SubscriptionActionReferral, &days, nil, nil, "Referral bonus for user "+referredID); err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to record adjustment"}
+	}
+	_, err := tx.Exec("UPDATE referrals SET status = ?, reward_days = ?, completed_at = ? WHERE id = ?",
+		model.ReferralRewarded, days, time.Now(), referralID)
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to update referral"}
+	}
+	return nil
+}
+
+func lookupReferrer(code string) (int64, error) {
+	var referrerID int64
+	err := database.DB.QueryRow("SELECT id FROM users WHERE referral_code = ?", strings.ToUpper(strings.TrimSpace(code))).Scan(&referrerID)
+	return referrerID, err
+}
+
+// GetReferralStatsHandler returns the user's referral code and how the users
+// they invited are doing.
+func GetReferralStatsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+
+	code, err := ensureReferralCode(claims.Subject)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get referral code"}`, http.StatusInternalServerError)
+		return
+	}
+	stats := model.ReferralStats{ReferralCode: code, RewardDays: config.Cfg.ReferralRewardDays, Referrals: []model.Referral{}}
+
+	rows, err := database.DB.Query(`SELECT u.username, r.status, r.reward_days, r.created_at, r.completed_at
+		FROM referrals r JOIN users u ON u.id = r.referred_id WHERE r.referrer_id = ? ORDER BY r.id DESC`, claims.Subject)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query referrals"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ref model.Referral
+		var rewardDays sql.NullInt64
+		var completedAt sql.NullTime
+		if err := rows.Scan(&ref.Username, &ref.Status, &rewardDays, &ref.CreatedAt, &completedAt); err != nil {
+			http.Error(w, `{"error":"Failed to scan referral row"}`, http.StatusInternalServerError)
+			return
+		}
+		if rewardDays.Valid {
+			d := int(rewardDays.Int64)
+			ref.RewardDays = &d
+			stats.DaysEarned += d
+		}
+		if completedAt.Valid {
+			ref.CompletedAt = &completedAt.Time
+		}
+		switch ref.Status {
+		case model.ReferralPending, model.ReferralReview:
+			stats.Pending++
+		case model.ReferralRewarded:
+			stats.Rewarded++
+		case model.ReferralRejected:
+			stats.Rejected++
+		}
+		stats.Referrals = append(stats.Referrals, ref)
+	}
+	stats.Invited = len(stats.Referrals)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// AdminGetReferralsHandler lists referrals, by default those held for
+// review. ?status= picks another status.
+func AdminGetReferralsHandler(w http.ResponseWriter, r *http.Request) {
+	status := r.URL.Query().Get("status")
+	if status == "" {
+		status = model.ReferralReview
+	}
+
+	rows, err := database.DB.Query(`SELECT r.id, r.referrer_id, a.username, r.referred_id, b.username, r.status, r.review_reason, r.reject_reason, r.reward_days, r.created_at, r.completed_at
+		FROM referrals r JOIN users a ON a.id = r.referrer_id JOIN users b ON b.id = r.referred_id
+		WHERE r.status = ? ORDER BY r.id DESC LIMIT 500`, status)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query referrals"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	referrals := make([]model.AdminReferral, 0)
+	for rows.Next() {
+		var ref model.AdminReferral
+		var reviewReason, rejectReason sql.NullString
+		var rewardDays sql.NullInt64
+		var completedAt sql.NullTime
+		if err := rows.Scan(&ref.ID, &ref.ReferrerID, &ref.Referrer, &ref.ReferredID, &ref.Referred, &ref.Status,
+			&reviewReason, &rejectReason, &rewardDays, &ref.CreatedAt, &completedAt); err != nil {
+			http.Error(w, `{"error":"Failed to scan referral row"}`, http.StatusInternalServerError)
+			return
+		}
+		if reviewReason.Valid {
+			ref.ReviewReason = &reviewReason.String
+		}
+		if rejectReason.Valid {
+			ref.RejectReason = &rejectReason.String
+		}
+		if rewardDays.Valid {
+			d := int(rewardDays.Int64)
+			ref.RewardDays = &d
+		}
+		if completedAt.Valid {
+			ref.CompletedAt = &completedAt.Time
+		}
+		referrals = append(referrals, ref)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(referrals)
+}
+
+// AdminReviewReferralHandler settles a referral held for review: "approve"
+// rewards the referrer, "reject" closes it without a reward.
+func AdminReviewReferralHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	referralID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid referral ID"}`, http.StatusBadRequest)
+		return
+	}
+	action := vars["action"]
+	if action != "approve" && action != "reject" {
+		http.Error(w, `{"error":"Action must be approve or reject"}`, http.StatusBadRequest)
+		return
+	}
+	if action == "approve" && config.Cfg.ReferralRewardDays <= 0 {
+		http.Error(w, `{"error":"Referral rewards are disabled"}`, http.StatusConflict)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var referrerID, referredID int
+	var status string
+	err = tx.QueryRow("SELECT referrer_id, referred_id, status FROM referrals WHERE id = ? FOR UPDATE", referralID).Scan(&referrerID, &referredID, &status)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Referral not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get referral"}`, http.StatusInternalServerError)
+		return
+	}
+	if status != model.ReferralReview {
+		http.Error(w, `{"error":"Referral is not awaiting review"}`, http.StatusConflict)
+		return
+	}
+
+	if action == "approve" {
+		err = rewardReferral(tx, referralID, referrerID, strconv.Itoa(referredID))
+	} else {
+		_, err = tx.Exec("UPDATE referrals SET status = ?, reject_reason = ?, completed_at = ? WHERE id = ?",
+			model.ReferralRejected, model.ReferralRejectAdmin, time.Now(), referralID)
+	}
+	if err != nil {
+		writeKeyError(w, err, "Failed to update referral")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Referral updated successfully"})
+}
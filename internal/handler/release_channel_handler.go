@@ -0,0 +1,459 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// releaseBuildsPath is the directory under game_files that holds one
+// directory per build.
+const releaseBuildsPath = "builds"
+
+var (
+	releaseChannelPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,31}$`)
+	releaseBuildPattern   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+)
+
+func releaseBuildsDir() string {
+	return filepath.Join(config.Cfg.GameFilesDir, releaseBuildsPath)
+}
+
+// validateReleaseBuild checks that a build has been uploaded.
+func validateReleaseBuild(build string) error {
+	if !releaseBuildPattern.MatchString(build) {
+		return &keyError{http.StatusBadRequest, "Build names may only contain letters, digits, dots, dashes and underscores"}
+	}
+	info, err := os.Stat(filepath.Join(releaseBuildsDir(), build))
+	if err != nil || !info.IsDir() {
+		return &keyError{http.StatusNotFound, "Build " + build + " has not been uploaded to " + releaseBuildsDir()}
+	}
+	return nil
+}
+
+const releaseChannelColumns = `c.name, c.release_id, r.version, r.build, c.allowed_roles, c.rollout_release_id, ro.version, c.rollout_percent, c.updated_at
+	FROM release_channels c LEFT JOIN releases r ON r.id = c.release_id LEFT JOIN releases ro ON ro.id = c.rollout_release_id`
+
+func scanReleaseChannel(row interface{ Scan(...interface{}) error }) (model.ReleaseChannel, error) {
+	var ch model.ReleaseChannel
+	var releaseID, rolloutID sql.NullInt64
+	var version, build, roles, rolloutVersion sql.NullString
+	var rolloutPercent int
+	err := row.Scan(&ch.Name, &releaseID, &version, &build, &roles, &rolloutID, &rolloutVersion, &rolloutPercent, &ch.UpdatedAt)
+	if err != nil {
+		return ch, err
+	}
+	if releaseID.Valid {
+		id := int(releaseID.Int64)
+		ch.ReleaseID, ch.Release, ch.Build = &id, &version.String, &build.String
+	}
+	if rolloutID.Valid {
+		ch.Rollout = &model.ReleaseRollout{ReleaseID: int(rolloutID.Int64), Release: rolloutVersion.String, Percent: rolloutPercent}
+	}
+	if roles.Valid {
+		ch.AllowedRoles = []string{}
+		for _, role := range strings.Split(roles.String, ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				ch.AllowedRoles = append(ch.AllowedRoles, role)
+			}
+		}
+	}
+	return ch, nil
+}
+
+type queryRower interface {
+	QueryRow(string, ...interface{}) *sql.Row
+}
+
+func loadReleaseChannel(q queryRower, name string) (model.ReleaseChannel, error) {
+	return scanReleaseChannel(q.QueryRow("SELECT "+releaseChannelColumns+" WHERE c.name = ?", name))
+}
+
+// lockReleaseChannel loads a channel and locks its row for the rest of the
+// transaction.
+func lockReleaseChannel(tx *sql.Tx, name string) (model.ReleaseChannel, error) {
+	var locked string
+	if err := tx.QueryRow("SELECT name FROM release_channels WHERE name = ? FOR UPDATE", name).Scan(&locked); err != nil {
+		return model.ReleaseChannel{}, err
+	}
+	return loadReleaseChannel(tx, name)
+}
+
+// channelForUser returns the channel if the user may use it: it is open to
+// everyone, the user has one of its roles or is a member, or is an admin.
+func channelForUser(userID, name string) (model.ReleaseChannel, error) {
+	ch, err := loadReleaseChannel(database.DB, name)
+	if err == sql.ErrNoRows {
+		return ch, &keyError{http.StatusNotFound, "Unknown release channel"}
+	}
+	if err != nil {
+		return ch, &keyError{http.StatusInternalServerError, "Failed to look up release channel"}
+	}
+	if ch.AllowedRoles == nil {
+		return ch, nil
+	}
+
+	var role sql.NullString
+	var member bool
+	err = database.DB.QueryRow(`SELECT role, EXISTS(SELECT 1 FROM release_channel_members WHERE channel = ? AND user_id = u.id)
+		FROM users u WHERE id = ?`, name, userID).Scan(&role, &member)
+	if err != nil {
+		return ch, &keyError{http.StatusInternalServerError, "Failed to look up user"}
+	}
+	if member || role.String == "admin" {
+		return ch, nil
+	}
+	for _, allowed := range ch.AllowedRoles {
+		if role.Valid && role.String == allowed {
+			return ch, nil
+		}
+	}
+	return ch, &keyError{http.StatusForbidden, "You do not have access to the " + name + " channel"}
+}
+
+// GetReleaseChannelsHandler lists the channels the user may switch to.
+func GetReleaseChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+
+	rows, err := database.DB.Query("SELECT name FROM release_channels ORDER BY name")
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query release channels"}`, http.StatusInternalServerError)
+		return
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			http.Error(w, `{"error":"Failed to scan release channel row"}`, http.StatusInternalServerError)
+			return
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	type channelInfo struct {
+		Name    string  `json:"name"`
+		Release *string `json:"release"`
+	}
+	channels := []channelInfo{}
+	for _, name := range names {
+		ch, err := channelForUser(claims.Subject, name)
+		if ke, ok := err.(*keyError); ok && ke.Status == http.StatusForbidden {
+			continue
+		}
+		if err != nil {
+			writeKeyError(w, err, "Failed to look up release channel")
+			return
+		}
+		channels = append(channels, channelInfo{ch.Name, ch.Release})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channels)
+}
+
+// AdminGetReleaseChannelsHandler lists every channel with its members.
+func AdminGetReleaseChannelsHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query("SELECT " + releaseChannelColumns + " ORDER BY c.name")
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query release channels"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	channels := []model.ReleaseChannel{}
+	byName := map[string]int{}
+	for rows.Next() {
+		ch, err := scanReleaseChannel(rows)
+		if err != nil {
+			http.Error(w, `{"error":"Failed to scan release channel row"}`, http.StatusInternalServerError)
+			return
+		}
+		byName[ch.Name] = len(channels)
+		channels = append(channels, ch)
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query("SELECT channel, user_id FROM release_channel_members ORDER BY user_id")
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query release channel members"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var channel string
+		var userID int
+		if err := rows.Scan(&channel, &userID); err != nil {
+			http.Error(w, `{"error":"Failed to scan release channel member row"}`, http.StatusInternalServerError)
+			return
+		}
+		if i, ok := byName[channel]; ok {
+			channels[i].Members = append(channels[i].Members, userID)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(channels)
+}
+
+// setChannelRelease makes a release the one a channel serves to everyone,
+// ending any rollout, and records the change in the channel's history.
+func setChannelRelease(tx *sql.Tx, channel string, releaseID int, action string, promotedFrom *string, adminID int) error {
+	_, err := tx.Exec("UPDATE release_channels SET release_id = ?, rollout_release_id = NULL, rollout_percent = 0 WHERE name = ?", releaseID, channel)
+	if err != nil {
+		return err
+	}
+	return recordChannelHistory(tx, channel, releaseID, action, nil, promotedFrom, adminID)
+}
+
+func recordChannelHistory(tx *sql.Tx, channel string, releaseID int, action string, percent *int, promotedFrom *string, adminID int) error {
+	_, err := tx.Exec(`INSERT INTO release_channel_history (channel, release_id, build, action, rollout_percent, promoted_from, admin_id)
+		SELECT ?, id, build, ?, ?, ?, ? FROM releases WHERE id = ?`,
+		channel, action, percent, promotedFrom, adminID, releaseID)
+	return err
+}
+
+// AdminUpdateReleaseChannelHandler creates a channel or changes its release
+// or who may use it. allowed_roles null opens the channel to everyone;
+// leaving it out keeps the current setting.
+func AdminUpdateReleaseChannelHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := middleware.GetClaimsFromContext(r)
+	adminID, _ := strconv.Atoi(claims.Subject)
+	name := mux.Vars(r)["name"]
+	if !releaseChannelPattern.MatchString(name) {
+		http.Error(w, `{"error":"Channel names may only contain lowercase letters, digits and dashes"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Release      *string         `json:"release"`
+		AllowedRoles json.RawMessage `json:"allowed_roles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	// New channels are open to admins and members only until roles are set.
+	if _, err := tx.Exec("INSERT IGNORE INTO release_channels (name, allowed_roles) VALUES (?, '')", name); err != nil {
+		http.Error(w, `{"error":"Failed to create release channel"}`, http.StatusInternalServerError)
+		return
+	}
+	current, err := lockReleaseChannel(tx, name)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up release channel"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if len(req.AllowedRoles) > 0 {
+		var roles []string
+		if err := json.Unmarshal(req.AllowedRoles, &roles); err != nil {
+			http.Error(w, `{"error":"allowed_roles must be a list of roles or null"}`, http.StatusBadRequest)
+			return
+		}
+		var value interface{}
+		if roles != nil {
+			value = strings.Join(roles, ",")
+		}
+		if _, err := tx.Exec("UPDATE release_channels SET allowed_roles = ? WHERE name = ?", value, name); err != nil {
+			http.Error(w, `{"error":"Failed to update release channel"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+	if req.Release != nil && (current.Release == nil || *current.Release != *req.Release) {
+		rel, err := loadReleaseByVersion(tx, *req.Release)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Release not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error":"Failed to look up release"}`, http.StatusInternalServerError)
+			return
+		}
+		if err := setChannelRelease(tx, name, rel.ID, model.ReleaseActionSet, nil, adminID); err != nil {
+			http.Error(w, `{"error":"Failed to update release channel"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ch, err := loadReleaseChannel(tx, name)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up release channel"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ch)
+}
+
+// AdminPromoteReleaseChannelHandler points a channel at the release another
+// channel serves, e.g. beta to stable. A rollout in progress on the source
+// channel is not promoted.
+func AdminPromoteReleaseChannelHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := middleware.GetClaimsFromContext(r)
+	adminID, _ := strconv.Atoi(claims.Subject)
+	name := mux.Vars(r)["name"]
+
+	var req struct {
+		From string `json:"from"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.From == "" {
+		http.Error(w, `{"error":"Send the channel to promote from"}`, http.StatusBadRequest)
+		return
+	}
+	if req.From == name {
+		http.Error(w, `{"error":"A channel cannot be promoted from itself"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	source, err := loadReleaseChannel(tx, req.From)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Unknown release channel to promote from"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up release channel"}`, http.StatusInternalServerError)
+		return
+	}
+	if source.ReleaseID == nil {
+		http.Error(w, `{"error":"That channel has no release to promote"}`, http.StatusConflict)
+		return
+	}
+	_, err = lockReleaseChannel(tx, name)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Unknown release channel"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up release channel"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := setChannelRelease(tx, name, *source.ReleaseID, model.ReleaseActionPromote, &source.Name, adminID); err != nil {
+		http.Error(w, `{"error":"Failed to promote release"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Release " + *source.Release + " promoted to " + name, "release": *source.Release})
+}
+
+// AdminGetReleaseChannelHistoryHandler lists the releases a channel has
+// served and rolled out, newest first.
+func AdminGetReleaseChannelHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query(`SELECT h.id, h.channel, h.action, r.version, h.build, h.rollout_percent, h.promoted_from, h.admin_id, h.created_at
+		FROM release_channel_history h LEFT JOIN releases r ON r.id = h.release_id WHERE h.channel = ? ORDER BY h.id DESC`, mux.Vars(r)["name"])
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query release history"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	history := []model.ReleaseChannelHistory{}
+	for rows.Next() {
+		var h model.ReleaseChannelHistory
+		var version, promotedFrom sql.NullString
+		var percent, adminID sql.NullInt64
+		if err := rows.Scan(&h.ID, &h.Channel, &h.Action, &version, &h.Build, &percent, &promotedFrom, &adminID, &h.CreatedAt); err != nil {
+			http.Error(w, `{"error":"Failed to scan release history row"}`, http.StatusInternalServerError)
+			return
+		}
+		if version.Valid {
+			h.Release = &version.String
+		}
+		if percent.Valid {
+			p := int(percent.Int64)
+			h.RolloutPercent = &p
+		}
+		if promotedFrom.Valid {
+			h.PromotedFrom = &promotedFrom.String
+		}
+		if adminID.Valid {
+			id := int(adminID.Int64)
+			h.AdminID = &id
+		}
+		history = append(history, h)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// AdminAddReleaseChannelMemberHandler lets one user use a restricted channel,
+// such as a tester without the tester role.
+func AdminAddReleaseChannelMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+	if _, err := loadReleaseChannel(database.DB, vars["name"]); err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Unknown release channel"}`, http.StatusNotFound)
+		return
+	}
+
+	_, err = database.DB.Exec("INSERT IGNORE INTO release_channel_members (channel, user_id) VALUES (?, ?)", vars["name"], userID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to add channel member"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User added to channel"})
+}
+
+func AdminRemoveReleaseChannelMemberHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	userID, err := strconv.Atoi(vars["userId"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	_, err = database.DB.Exec("DELETE FROM release_channel_members WHERE channel = ? AND user_id = ?", vars["name"], userID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to remove channel member"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "User removed from channel"})
+}
@@ -0,0 +1,608 @@
+package handler
+
+import (
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	releaseVersionPattern  = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._+-]{0,63}$`)
+	launcherVersionPattern = regexp.MustCompile(`^[0-9]+(\.[0-9]+){0,3}$`)
+)
+
+const releaseColumns = "id, version, build, COALESCE(changelog, ''), min_launcher_version, manifest_hash, created_by, created_at"
+
+func scanRelease(row interface{ Scan(...interface{}) error }) (model.Release, error) {
+	var rel model.Release
+	var minLauncher, manifestHash sql.NullString
+	var createdBy sql.NullInt64
+	err := row.Scan(&rel.ID, &rel.Version, &rel.Build, &rel.Changelog, &minLauncher, &manifestHash, &createdBy, &rel.CreatedAt)
+	if minLauncher.Valid {
+		rel.MinLauncherVersion = &minLauncher.String
+	}
+	if manifestHash.Valid {
+		rel.ManifestHash = &manifestHash.String
+	}
+	if createdBy.Valid {
+		id := int(createdBy.Int64)
+		rel.CreatedBy = &id
+	}
+	return rel, err
+}
+
+func loadRelease(q queryRower, id int) (model.Release, error) {
+	return scanRelease(q.QueryRow("SELECT "+releaseColumns+" FROM releases WHERE id = ?", id))
+}
+
+func loadReleaseByVersion(q queryRower, version string) (model.Release, error) {
+	return scanRelease(q.QueryRow("SELECT "+releaseColumns+" FROM releases WHERE version = ?", version))
+}
+
+// compareVersions compares dotted numeric versions such as 1.4.10, treating
+// missing parts as zero.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// rolloutBucket places a user in one of 100 buckets for a release. The same
+// user always lands in the same bucket, so raising the percentage only adds
+// users; keying on the version spreads different rollouts over different
+// users.
+func rolloutBucket(version, userID string) int {
+	sum := sha256.Sum256([]byte(version + ":" + userID))
+	return int(binary.BigEndian.Uint32(sum[:4]) % 100)
+}
+
+// releaseForUser returns the release of the channel the user gets, taking a
+// staged rollout into account. It returns nil for a channel that still
+// serves the flat game_files directory.
+func releaseForUser(ch model.ReleaseChannel, userID string) (*model.Release, error) {
+	id := ch.ReleaseID
+	if ch.Rollout != nil && rolloutBucket(ch.Rollout.Release, userID) < ch.Rollout.Percent {
+		id = &ch.Rollout.ReleaseID
+	}
+	if id == nil {
+		return nil, nil
+	}
+	rel, err := loadRelease(database.DB, *id)
+	if err != nil {
+		return nil, err
+	}
+	return &rel, nil
+}
+
+// resolveLauncherRelease works out which channel and release a launcher
+// request gets: the channel query parameter, stable by default, and the
+// release of it the user is rolled out to.
+func resolveLauncherRelease(r *http.Request) (model.ReleaseChannel, *model.Release, error) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		return model.ReleaseChannel{}, nil, &keyError{http.StatusInternalServerError, "Could not retrieve user claims"}
+	}
+	name := r.URL.Query().Get("channel")
+	if name == "" {
+		name = model.DefaultReleaseChannel
+	}
+	ch, err := channelForUser(claims.Subject, name)
+	if err != nil {
+		return ch, nil, err
+	}
+	rel, err := releaseForUser(ch, claims.Subject)
+	if err != nil {
+		return ch, nil, &keyError{http.StatusInternalServerError, "Failed to look up release"}
+	}
+	return ch, rel, nil
+}
+
+// checkLauncherVersion rejects launchers older than the release needs. A
+// launcher that does not send X-Launcher-Version is let through.
+func checkLauncherVersion(r *http.Request, rel *model.Release) error {
+	version := r.Header.Get("X-Launcher-Version")
+	if rel == nil || rel.MinLauncherVersion == nil || version == "" {
+		return nil
+	}
+	if compareVersions(version, *rel.MinLauncherVersion) < 0 {
+		return &keyError{http.StatusUpgradeRequired, "Update the launcher to " + *rel.MinLauncherVersion + " or newer"}
+	}
+	return nil
+}
+
+// releaseFilesChanged reports whether a release's files are no longer the
+// ones it was published with. Releases without a recorded hash, published
+// before the hash was kept or under an older hash format, cannot tell; the
+// next publish backfills their hash.
+func releaseFilesChanged(rel *model.Release, m *cachedManifest) bool {
+	return rel.ManifestHash != nil && *rel.ManifestHash != m.FilesHash
+}
+
+// verifyReleaseManifest alerts the admins when the files of a release served
+// to players changed after publishing. Players are still served: the
+// manifest describes the files as they are now, so launchers end up with a
+// consistent install, and a 500 would keep everyone from playing.
+func verifyReleaseManifest(rel *model.Release, m *cachedManifest) {
+	if !releaseFilesChanged(rel, m) {
+		return
+	}
+	alertAdmins("release-files:"+rel.Version+":"+m.FilesHash, "Release "+rel.Version+" files changed",
+		fmt.Sprintf("The files of release %s (build %s) no longer match the ones it was published with (%s, now %s).",
+			rel.Version, rel.Build, *rel.ManifestHash, m.FilesHash))
+}
+
+// backfillReleaseHashes records the files hash of releases that have none.
+func backfillReleaseHashes() error {
+	rows, err := database.DB.Query("SELECT id, version, build FROM releases WHERE manifest_hash IS NULL")
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id             int
+		version, build string
+	}
+	var releases []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.version, &p.build); err != nil {
+			rows.Close()
+			return err
+		}
+		releases = append(releases, p)
+	}
+	rows.Close()
+
+	for _, p := range releases {
+		m, err := manifestFor(p.build).get()
+		if err != nil {
+			return fmt.Errorf("release %s: %w", p.version, err)
+		}
+		if _, err := database.DB.Exec("UPDATE releases SET manifest_hash = ? WHERE id = ? AND manifest_hash IS NULL", m.FilesHash, p.id); err != nil {
+			return err
+		}
+		log.Printf("Recorded the files hash of release %s: %s", p.version, m.FilesHash)
+	}
+	return nil
+}
+
+// GetReleaseHandler describes the release the launcher should be on, for
+// showing the changelog before updating.
+func GetReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	ch, rel, err := resolveLauncherRelease(r)
+	if err != nil {
+		writeKeyError(w, err, "Failed to look up release")
+		return
+	}
+	if rel == nil {
+		http.Error(w, `{"error":"No release has been published on this channel"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"channel":              ch.Name,
+		"version":              rel.Version,
+		"changelog":            rel.Changelog,
+		"min_launcher_version": rel.MinLauncherVersion,
+		"published_at":         rel.CreatedAt,
+	})
+}
+
+// activeReleaseBuilds returns the builds channels currently serve, the flat
+// game_files directory included as "" while the stable channel has no
+// release.
+func activeReleaseBuilds() ([]string, error) {
+	rows, err := database.DB.Query(`SELECT DISTINCT r.build FROM release_channels c
+		JOIN releases r ON r.id = c.release_id OR r.id = c.rollout_release_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var builds []string
+	for rows.Next() {
+		var build string
+		if err := rows.Scan(&build); err != nil {
+			return nil, err
+		}
+		builds = append(builds, build)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ch, err := loadReleaseChannel(database.DB, model.DefaultReleaseChannel)
+	if err == sql.ErrNoRows || (err == nil && ch.ReleaseID == nil) {
+		builds = append(builds, "")
+	} else if err != nil {
+		return nil, err
+	}
+	return builds, nil
+}
+
+// userReleaseBuilds returns the builds the user gets on the channels they
+// may use, "" standing for the flat game_files directory.
+func userReleaseBuilds(userID string) ([]string, error) {
+	rows, err := database.DB.Query("SELECT name FROM release_channels")
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+
+	builds := []string{}
+	seen := map[string]bool{}
+	add := func(build string) {
+		if !seen[build] {
+			seen[build] = true
+			builds = append(builds, build)
+		}
+	}
+	stable := false
+	for _, name := range names {
+		ch, err := channelForUser(userID, name)
+		if ke, ok := err.(*keyError); ok && ke.Status == http.StatusForbidden {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stable = stable || name == model.DefaultReleaseChannel
+		rel, err := releaseForUser(ch, userID)
+		if err != nil {
+			return nil, err
+		}
+		if rel == nil {
+			add("")
+		} else {
+			add(rel.Build)
+		}
+	}
+	if !stable {
+		add("")
+	}
+	return builds, nil
+}
+
+func AdminGetReleasesHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query("SELECT " + releaseColumns + " FROM releases ORDER BY id DESC")
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query releases"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	releases := []model.Release{}
+	for rows.Next() {
+		rel, err := scanRelease(rows)
+		if err != nil {
+			http.Error(w, `{"error":"Failed to scan release row"}`, http.StatusInternalServerError)
+			return
+		}
+		releases = append(releases, rel)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(releases)
+}
+
+// applyRollout rolls a release out to percent of a channel's users. 100
+// makes it the channel's release, 0 cancels the rollout.
+func applyRollout(tx *sql.Tx, ch model.ReleaseChannel, rel model.Release, percent, adminID int) error {
+	switch {
+	case percent < 0 || percent > 100:
+		return &keyError{http.StatusBadRequest, "Rollout percent must be between 0 and 100"}
+	case percent == 100:
+		return setChannelRelease(tx, ch.Name, rel.ID, model.ReleaseActionRollout, nil, adminID)
+	case ch.ReleaseID != nil && *ch.ReleaseID == rel.ID:
+		return &keyError{http.StatusConflict, "This is already the channel's release"}
+	case percent == 0:
+		if ch.Rollout == nil || ch.Rollout.ReleaseID != rel.ID {
+			return &keyError{http.StatusConflict, "This release is not being rolled out on the channel"}
+		}
+	case ch.ReleaseID == nil:
+		return &keyError{http.StatusConflict, "Set a release on the channel before staging a rollout"}
+	}
+
+	var rolloutID interface{}
+	if percent > 0 {
+		rolloutID = rel.ID
+	}
+	_, err := tx.Exec("UPDATE release_channels SET rollout_release_id = ?, rollout_percent = ? WHERE name = ?", rolloutID, percent, ch.Name)
+	if err != nil {
+		return err
+	}
+	return recordChannelHistory(tx, ch.Name, rel.ID, model.ReleaseActionRollout, &percent, nil, adminID)
+}
+
+// AdminPublishReleaseHandler publishes an uploaded build as a new release,
+// and optionally puts it on a channel, fully or to a share of its users.
+func AdminPublishReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := middleware.GetClaimsFromContext(r)
+	adminID, _ := strconv.Atoi(claims.Subject)
+
+	var req struct {
+		Version            string  `json:"version"`
+		Build              string  `json:"build"`
+		Changelog          string  `json:"changelog"`
+		MinLauncherVersion *string `json:"min_launcher_version"`
+		Channel            string  `json:"channel"`
+		RolloutPercent     *int    `json:"rollout_percent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	errs := fieldErrors{}
+	if !releaseVersionPattern.MatchString(req.Version) {
+		errs["version"] = "Version may only contain letters, digits, dots, dashes, pluses and underscores"
+	}
+	if err := validateReleaseBuild(req.Build); err != nil {
+		errs["build"] = err.Error()
+	}
+	if req.MinLauncherVersion != nil && !launcherVersionPattern.MatchString(*req.MinLauncherVersion) {
+		errs["min_launcher_version"] = "Launcher versions look like 1.2.3"
+	}
+	if len(errs) > 0 {
+		writeFieldErrors(w, "Invalid release", errs, http.StatusBadRequest)
+		return
+	}
+
+	var existing string
+	err := database.DB.QueryRow("SELECT version FROM releases WHERE version = ? OR build = ? LIMIT 1", req.Version, req.Build).Scan(&existing)
+	if err == nil {
+		jsonError(w, "Release "+existing+" already uses this version or build; upload changed files as a new build", http.StatusConflict)
+		return
+	}
+	if err != sql.ErrNoRows {
+		http.Error(w, `{"error":"Failed to look up releases"}`, http.StatusInternalServerError)
+		return
+	}
+
+	m, _, err := manifestFor(req.Build).refresh()
+	if err != nil {
+		jsonError(w, "Failed to read build "+req.Build+": "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`INSERT INTO releases (version, build, changelog, min_launcher_version, manifest_hash, created_by)
+		VALUES (?, ?, NULLIF(?, ''), ?, ?, ?)`, req.Version, req.Build, req.Changelog, req.MinLauncherVersion, m.FilesHash, adminID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to create release"}`, http.StatusConflict)
+		return
+	}
+	id, _ := res.LastInsertId()
+	rel, err := loadRelease(tx, int(id))
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up release"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if req.Channel != "" {
+		ch, err := lockReleaseChannel(tx, req.Channel)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Unknown release channel"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error":"Failed to look up release channel"}`, http.StatusInternalServerError)
+			return
+		}
+		percent := 100
+		if req.RolloutPercent != nil {
+			percent = *req.RolloutPercent
+		}
+		if err := applyRollout(tx, ch, rel, percent, adminID); err != nil {
+			writeKeyError(w, err, "Failed to put release on channel")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := backfillReleaseHashes(); err != nil {
+		log.Printf("Failed to record the files hash of older releases: %v", err)
+	}
+	queueReleasePatches()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rel)
+}
+
+// AdminRolloutReleaseHandler changes the share of a channel's users that get
+// a release.
+func AdminRolloutReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := middleware.GetClaimsFromContext(r)
+	adminID, _ := strconv.Atoi(claims.Subject)
+
+	var req struct {
+		Release string `json:"release"`
+		Percent *int   `json:"percent"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Release == "" || req.Percent == nil {
+		http.Error(w, `{"error":"Send the release and the percent of users to roll it out to"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	ch, err := lockReleaseChannel(tx, mux.Vars(r)["name"])
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Unknown release channel"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up release channel"}`, http.StatusInternalServerError)
+		return
+	}
+	rel, err := loadReleaseByVersion(tx, req.Release)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Release not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up release"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := applyRollout(tx, ch, rel, *req.Percent, adminID); err != nil {
+		writeKeyError(w, err, "Failed to update rollout")
+		return
+	}
+	ch, err = loadReleaseChannel(tx, ch.Name)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up release channel"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ch)
+}
+
+// AdminRollbackReleaseChannelHandler puts a channel back on an earlier
+// release: the one named, or else the last one the channel fully served
+// before its current release. Without a named release, a rollout in
+// progress is cancelled first and the current release kept.
+func AdminRollbackReleaseChannelHandler(w http.ResponseWriter, r *http.Request) {
+	claims, _ := middleware.GetClaimsFromContext(r)
+	adminID, _ := strconv.Atoi(claims.Subject)
+
+	var req struct {
+		Release string `json:"release"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	ch, err := lockReleaseChannel(tx, mux.Vars(r)["name"])
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Unknown release channel"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up release channel"}`, http.StatusInternalServerError)
+		return
+	}
+
+	switch {
+	case req.Release == "" && ch.Rollout != nil:
+		rel, err := loadRelease(tx, ch.Rollout.ReleaseID)
+		if err == nil {
+			err = applyRollout(tx, ch, rel, 0, adminID)
+		}
+		if err != nil {
+			writeKeyError(w, err, "Failed to cancel rollout")
+			return
+		}
+	case req.Release != "":
+		rel, err := loadReleaseByVersion(tx, req.Release)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"Release not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error":"Failed to look up release"}`, http.StatusInternalServerError)
+			return
+		}
+		if err := setChannelRelease(tx, ch.Name, rel.ID, model.ReleaseActionRollback, nil, adminID); err != nil {
+			http.Error(w, `{"error":"Failed to roll back"}`, http.StatusInternalServerError)
+			return
+		}
+	default:
+		if ch.ReleaseID == nil {
+			http.Error(w, `{"error":"The channel has no release to roll back"}`, http.StatusConflict)
+			return
+		}
+		var previous int
+		err := tx.QueryRow(`SELECT release_id FROM release_channel_history
+			WHERE channel = ? AND release_id IS NOT NULL AND release_id <> ? AND (action <> ? OR rollout_percent IS NULL)
+			ORDER BY id DESC LIMIT 1`, ch.Name, *ch.ReleaseID, model.ReleaseActionRollout).Scan(&previous)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"error":"The channel has no earlier release"}`, http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"error":"Failed to query release history"}`, http.StatusInternalServerError)
+			return
+		}
+		if err := setChannelRelease(tx, ch.Name, previous, model.ReleaseActionRollback, nil, adminID); err != nil {
+			http.Error(w, `{"error":"Failed to roll back"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ch, err = loadReleaseChannel(tx, ch.Name)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up release channel"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ch)
+}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestRolloutBucket(t *testing.T) {
+	if a, b := rolloutBucket("1.4.0", "42"), rolloutBucket("1.4.0", "42"); a != b {
+		t.Fatalf("same user and version got buckets %d and %d", a, b)
+	}
+
+	counts := make([]int, 100)
+	moved := 0
+	const users = 20000
+	for i := 0; i < users; i++ {
+		userID := strconv.Itoa(i)
+		bucket := rolloutBucket("1.4.0", userID)
+		if bucket < 0 || bucket >= 100 {
+			t.Fatalf("user %s got bucket %d, want 0 to 99", userID, bucket)
+		}
+		counts[bucket]++
+		if rolloutBucket("1.5.0", userID) != bucket {
+			moved++
+		}
+	}
+
+	// With 200 users per bucket expected, a bucket off by half points at a
+	// broken hash rather than chance.
+	for bucket, n := range counts {
+		if n < users/100/2 || n > users/100*3/2 {
+			t.Errorf("bucket %d has %d users, want about %d", bucket, n, users/100)
+		}
+	}
+	// Another version should place users independently, so a user early in
+	// one rollout is not early in every rollout.
+	if moved < users*9/10 {
+		t.Errorf("only %d of %d users changed bucket between versions", moved, users)
+	}
+}
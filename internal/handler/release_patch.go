@@ -0,0 +1,300 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// releasePatchesPath is the directory under game_files that holds the
+// binary deltas between release files.
+const releasePatchesPath = "patches"
+
+func releasePatchesDir() string {
+	return filepath.Join(config.Cfg.GameFilesDir, releasePatchesPath)
+}
+
+func patchFileName(from, to string) string {
+	return from + "-" + to + ".delta"
+}
+
+// loadPatchEdges returns every known patch, by path and then by the hash it
+// leads to.
+func loadPatchEdges() (map[string]map[string][]FilePatch, error) {
+	rows, err := database.DB.Query("SELECT path, from_hash, to_hash, size, sha256 FROM release_patches")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	edges := map[string]map[string][]FilePatch{}
+	for rows.Next() {
+		var path string
+		var p FilePatch
+		if err := rows.Scan(&path, &p.From, &p.To, &p.Size, &p.Hash); err != nil {
+			return nil, err
+		}
+		p.URL = downloadURL("/api/launcher/download/"+releasePatchesPath+"/", patchFileName(p.From, p.To))
+		if edges[path] == nil {
+			edges[path] = map[string][]FilePatch{}
+		}
+		edges[path][p.To] = append(edges[path][p.To], p)
+	}
+	return edges, rows.Err()
+}
+
+// patchChains returns the patches that lead, directly or through other
+// patches, to the given hash of a file. A launcher follows them from the
+// hash it has installed. Chains are at most PatchChainLength patches long
+// and are dropped once they would cost as much as the full file, in which
+// case the launcher falls back to downloading it.
+func patchChains(edges map[string][]FilePatch, hash string, size int64) []FilePatch {
+	if len(edges) == 0 {
+		return nil
+	}
+	cost := map[string]int64{hash: 0}
+	frontier := []string{hash}
+	var chains []FilePatch
+	for depth := 0; depth < config.Cfg.PatchChainLength && len(frontier) > 0; depth++ {
+		var next []string
+		for _, to := range frontier {
+			for _, p := range edges[to] {
+				total := cost[to] + p.Size
+				if total >= size {
+					continue
+				}
+				if known, ok := cost[p.From]; ok && known <= total {
+					continue
+				}
+				cost[p.From] = total
+				chains = append(chains, p)
+				next = append(next, p.From)
+			}
+		}
+		frontier = next
+	}
+	sort.Slice(chains, func(i, j int) bool {
+		if chains[i].From != chains[j].From {
+			return chains[i].From < chains[j].From
+		}
+		return chains[i].To < chains[j].To
+	})
+	return chains
+}
+
+// releasePatchesWake starts a patch run right away rather than at the next
+// tick; see queueReleasePatches.
+var releasePatchesWake = make(chan struct{}, 1)
+
+// queueReleasePatches asks the patch job to look for new releases now.
+func queueReleasePatches() {
+	select {
+	case releasePatchesWake <- struct{}{}:
+	default:
+	}
+}
+
+// StartReleasePatcher makes the patches to newly published releases in the
+// background, when woken by a publish and every few minutes until ctx is
+// cancelled. Releases are served without patches until theirs are ready.
+func StartReleasePatcher(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for {
+			patchPendingReleases(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			case <-releasePatchesWake:
+			}
+		}
+	}()
+}
+
+// patchPendingReleases makes the patches from each release without them to
+// the next, oldest first. A release that fails is tried again next time.
+func patchPendingReleases(ctx context.Context) {
+	rows, err := database.DB.Query("SELECT id, build FROM releases WHERE patches_done_at IS NULL ORDER BY id")
+	if err != nil {
+		log.Printf("Could not look up releases to patch: %v", err)
+		return
+	}
+	type pending struct {
+		id    int
+		build string
+	}
+	var releases []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.build); err == nil {
+			releases = append(releases, p)
+		}
+	}
+	rows.Close()
+
+	for _, rel := range releases {
+		var previous string
+		err := database.DB.QueryRow("SELECT build FROM releases WHERE id < ? ORDER BY id DESC LIMIT 1", rel.id).Scan(&previous)
+		if err == nil && previous != rel.build {
+			err = generateReleasePatches(ctx, previous, rel.build)
+		} else if err == sql.ErrNoRows {
+			err = nil
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to generate patches for build %s: %v", rel.build, err)
+			alertAdmins("patches:"+rel.build, "Release patches failed",
+				fmt.Sprintf("Patches to build %s could not be made and will be retried: %v", rel.build, err))
+			continue
+		}
+		if _, err := database.DB.Exec("UPDATE releases SET patches_done_at = NOW() WHERE id = ?", rel.id); err != nil {
+			log.Printf("Failed to mark the patches of build %s done: %v", rel.build, err)
+			continue
+		}
+		if _, changed, err := manifestFor(rel.build).refresh(); err != nil {
+			log.Printf("Failed to rebuild the manifest of build %s: %v", rel.build, err)
+		} else if changed {
+			log.Printf("Patches to build %s are ready", rel.build)
+		}
+	}
+}
+
+// generateReleasePatches makes deltas from the files of one build to the
+// changed files of the next.
+func generateReleasePatches(ctx context.Context, previous, build string) error {
+	oldCache, newCache := manifestFor(previous), manifestFor(build)
+	oldManifest, err := oldCache.get()
+	if err != nil {
+		return err
+	}
+	newManifest, err := newCache.get()
+	if err != nil {
+		return err
+	}
+	oldFiles := map[string]GameFile{}
+	for _, f := range oldManifest.Files {
+		oldFiles[f.Path] = f
+	}
+	if err := os.MkdirAll(releasePatchesDir(), 0755); err != nil {
+		return err
+	}
+
+	maxSize := int64(config.Cfg.PatchMaxFileMB) << 20
+	for _, f := range newManifest.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		o, ok := oldFiles[f.Path]
+		if !ok || o.Hash == f.Hash || o.Size > maxSize || f.Size > maxSize {
+			continue
+		}
+		var exists bool
+		err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM release_patches WHERE path = ? AND from_hash = ? AND to_hash = ?)",
+			f.Path, o.Hash, f.Hash).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+
+		size, sum, err := makeFilePatch(filepath.Join(releasePatchesDir(), patchFileName(o.Hash, f.Hash)),
+			filepath.Join(oldCache.dir, filepath.FromSlash(o.Path)), o.Hash,
+			filepath.Join(newCache.dir, filepath.FromSlash(f.Path)), f.Hash, f.Size)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.Path, err)
+		}
+		if size == 0 {
+			continue
+		}
+		_, err = database.DB.Exec("INSERT IGNORE INTO release_patches (path, from_hash, to_hash, size, sha256) VALUES (?, ?, ?, ?, ?)",
+			f.Path, o.Hash, f.Hash, size, sum)
+		if err != nil {
+			return err
+		}
+		log.Printf("Patch for %s: %d bytes instead of %d", f.Path, size, f.Size)
+	}
+	return nil
+}
+
+// makeFilePatch diffs two files whose hashes are known into dest, streaming
+// both, and checks that the delta rebuilds the new file. It returns the size
+// and SHA-256 of the delta, or a size of 0 when the delta is nearly as big as
+// the file, saves nothing over downloading it and is not kept.
+func makeFilePatch(dest, oldName, oldHash, newName, newHash string, newSize int64) (int64, string, error) {
+	var h deltaHeader
+	h.Size = newSize
+	if n, err := hex.Decode(h.OldSum[:], []byte(oldHash)); err != nil || n != len(h.OldSum) {
+		return 0, "", fmt.Errorf("bad hash %q", oldHash)
+	}
+	if n, err := hex.Decode(h.NewSum[:], []byte(newHash)); err != nil || n != len(h.NewSum) {
+		return 0, "", fmt.Errorf("bad hash %q", newHash)
+	}
+
+	old, err := os.Open(oldName)
+	if err != nil {
+		return 0, "", err
+	}
+	defer old.Close()
+	oldInfo, err := old.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+	new, err := os.Open(newName)
+	if err != nil {
+		return 0, "", err
+	}
+	defer new.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dest), ".delta-*")
+	if err != nil {
+		return 0, "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	sum := sha256.New()
+	out := bufio.NewWriter(io.MultiWriter(tmp, sum))
+	if err := makeDelta(out, h, old, oldInfo.Size(), new); err != nil {
+		return 0, "", err
+	}
+	if err := out.Flush(); err != nil {
+		return 0, "", err
+	}
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, "", err
+	}
+	if size >= newSize*9/10 {
+		return 0, "", nil
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, "", err
+	}
+	if err := applyDelta(io.Discard, old, oldInfo.Size(), tmp); err != nil {
+		return 0, "", fmt.Errorf("patch does not rebuild the file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, "", err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(sum.Sum(nil)), nil
+}
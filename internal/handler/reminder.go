@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// expiringSubscription is one subscription that a reminder may be sent for.
+// ProductID is 0 for the global subscription.
+type expiringSubscription struct {
+	UserID      int
+	Username    string
+	Email       string
+	ProductID   int
+	ProductName string
+	ExpiresAt   time.Time
+}
+
+// StartExpiryReminders scans for expiring subscriptions every configured
+// interval until ctx is cancelled.
+func StartExpiryReminders(ctx context.Context) {
+	interval := time.Duration(config.Cfg.ReminderIntervalMinutes) * time.Minute
+	if interval <= 0 {
+		log.Println("Expiry reminders are disabled")
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			sendExpiryReminders()
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func sendExpiryReminders() {
+	offsets := append([]int(nil), config.Cfg.ReminderOffsetsDays...)
+	sort.Ints(offsets)
+	if len(offsets) == 0 {
+		return
+	}
+
+	subs, err := findExpiringSubscriptions(time.Duration(offsets[len(offsets)-1]) * 24 * time.Hour)
+	if err != nil {
+		log.Printf("Could not look up expiring subscriptions: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, sub := range subs {
+		// Use the tightest window the subscription is in; a reminder for a
+		// wider window that was missed is not worth sending any more.
+		offset := -1
+		for _, d := range offsets {
+			if sub.ExpiresAt.Sub(now) <= time.Duration(d)*24*time.Hour {
+				offset = d
+				break
+			}
+		}
+		if offset < 0 {
+			continue
+		}
+
+		// Reserve the window before sending, so a reminder goes out at most
+		// once even if several instances run the job.
+		res, err := database.DB.Exec("INSERT IGNORE INTO subscription_reminders (user_id, product_id, expires_at, offset_days) VALUES (?, ?, ?, ?)",
+			sub.UserID, sub.ProductID, sub.ExpiresAt, offset)
+		if err != nil {
+			log.Printf("Could not reserve reminder for user %d: %v", sub.UserID, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		if err := sendEmail(sub.Email, "Ваша подписка Astralis скоро закончится", expiryReminderHTML(sub)); err != nil {
+			log.Printf("Could not send expiry reminder to user %d: %v", sub.UserID, err)
+			// Free the window so the next run retries.
+			database.DB.Exec("DELETE FROM subscription_reminders WHERE user_id = ? AND product_id = ? AND expires_at = ? AND offset_days = ?",
+				sub.UserID, sub.ProductID, sub.ExpiresAt, offset)
+		}
+	}
+}
+
+// findExpiringSubscriptions returns global and product subscriptions of users
+// who have not opted out and that end within the given time.
+func findExpiringSubscriptions(within time.Duration) ([]expiringSubscription, error) {
+	now := time.Now()
+	until := now.Add(within)
+	subs := []expiringSubscription{}
+
+	rows, err := database.DB.Query(`SELECT id, username, email, subscription_expires_at FROM users
+		WHERE subscription_expires_at > ? AND subscription_expires_at <= ?
+		AND is_banned = FALSE AND expiry_reminders_opt_out = FALSE`, now, until)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var s expiringSubscription
+		if err := rows.Scan(&s.UserID, &s.Username, &s.Email, &s.ExpiresAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query(`SELECT u.id, u.username, u.email, p.id, p.name, MAX(s.expires_at) AS ends
+		FROM subscriptions s
+		JOIN users u ON u.id = s.user_id
+		JOIN products p ON p.id = s.product_id
+		WHERE u.is_banned = FALSE AND u.expiry_reminders_opt_out = FALSE
+		GROUP BY u.id, u.username, u.email, p.id, p.name
+		HAVING ends > ? AND ends <= ?`, now, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s expiringSubscription
+		if err := rows.Scan(&s.UserID, &s.Username, &s.Email, &s.ProductID, &s.ProductName, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	return subs, rows.Err()
+}
+
+func expiryReminderHTML(sub expiringSubscription) string {
+	what := "Ваша подписка Astralis"
+	if sub.ProductID != 0 {
+		what = fmt.Sprintf("Ваша подписка на %s", html.EscapeString(sub.ProductName))
+	}
+	return fmt.Sprintf(`
+		<!DOCTYPE html>
+		<html lang="ru">
+		<head><meta charset="UTF-8"><title>Подписка скоро закончится</title></head>
+		<body style="font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Helvetica, Arial, sans-serif; background-color: #06080f; color: #e0e0e0; padding: 20px;">
+			<div style="max-width: 600px; margin: 0 auto; background-color: #101422; border: 1px solid #366a98; border-radius: 12px; padding: 40px; text-align: center;">
+				<h1 style="color: #ffffff;">Подписка скоро закончится</h1>
+				<p style="color: #a0a0a0;">%s, %s закончится %s (UTC).</p>
+				<a href="%s/profile" style="display: inline-block; background-color: #59a6e4; color: #ffffff; padding: 15px 30px; border-radius: 8px; text-decoration: none; font-weight: bold;">Продлить подписку</a>
+				<p style="font-size: 12px; color: #606060; margin-top: 30px;">Напоминания можно отключить в настройках профиля.</p>
+			</div>
+		</body>
+		</html>
+	`, html.EscapeString(sub.Username), what, sub.ExpiresAt.UTC().Format("02.01.2006 15:04"), config.Cfg.SiteURL)
+}
+
+// UpdateNotificationSettingsHandler lets a user opt out of expiry reminders.
+func UpdateNotificationSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var req struct {
+		ExpiryReminders *bool `json:"expiry_reminders"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ExpiryReminders == nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	_, err := database.DB.Exec("UPDATE users SET expiry_reminders_opt_out = ? WHERE id = ?", !*req.ExpiryReminders, claims.Subject)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to update settings"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"message": "Notification settings updated"})
+}
@@ -0,0 +1,549 @@
+package handler
+
+import (
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+const maxResellerKeysPerRequest = 100
+
+// resellerKeyTypes are the key types a reseller may be allowed to allocate.
+// Role grants and HWID resets stay admin-only.
+var resellerKeyTypes = map[string]bool{
+	model.KeyTypeSubscription:  true,
+	model.KeyTypeLifetime:      true,
+	model.KeyTypeProductUnlock: true,
+}
+
+// Resellers that are not given limits sell global subscription keys of up
+// to a year.
+const defaultResellerMaxDurationDays = 365
+
+var defaultResellerKeyTypes = []string{model.KeyTypeSubscription}
+
+// resellerLimits is what a reseller may sell: the key types, the products
+// keys may be bound to, and the longest subscription key.
+type resellerLimits struct {
+	KeyTypes        []string
+	ProductIDs      []int
+	MaxDurationDays int
+}
+
+// check reports whether the reseller may allocate a key. Keys bound to a
+// product need the product to be allowed; unbound keys only the key type.
+func (l resellerLimits) check(keyType string, productID *int, durationDays int) error {
+	allowedType := false
+	for _, t := range l.KeyTypes {
+		allowedType = allowedType || t == keyType
+	}
+	if !allowedType {
+		return &keyError{http.StatusForbidden, "Key type is not available to this reseller"}
+	}
+	if productID != nil {
+		allowedProduct := false
+		for _, id := range l.ProductIDs {
+			allowedProduct = allowedProduct || id == *productID
+		}
+		if !allowedProduct {
+			return &keyError{http.StatusForbidden, "Product is not available to this reseller"}
+		}
+	}
+	if keyType == model.KeyTypeSubscription && durationDays > l.MaxDurationDays {
+		return &keyError{http.StatusForbidden, fmt.Sprintf("Keys from this reseller can last at most %d days", l.MaxDurationDays)}
+	}
+	return nil
+}
+
+// parseResellerLimits reads the comma-separated lists of the resellers table.
+func parseResellerLimits(keyTypes, productIDs string, maxDurationDays int) resellerLimits {
+	l := resellerLimits{KeyTypes: []string{}, ProductIDs: []int{}, MaxDurationDays: maxDurationDays}
+	for _, t := range strings.Split(keyTypes, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			l.KeyTypes = append(l.KeyTypes, t)
+		}
+	}
+	for _, id := range strings.Split(productIDs, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(id)); err == nil {
+			l.ProductIDs = append(l.ProductIDs, n)
+		}
+	}
+	return l
+}
+
+// validateResellerLimits checks limits set by an admin.
+func validateResellerLimits(keyTypes []string, productIDs []int, maxDurationDays int) error {
+	for _, t := range keyTypes {
+		if !resellerKeyTypes[t] {
+			return &keyError{http.StatusBadRequest, "Key type " + t + " cannot be sold by resellers"}
+		}
+	}
+	for _, id := range productIDs {
+		if err := validateProductExists(id); err != nil {
+			return err
+		}
+	}
+	if maxDurationDays < 1 || maxDurationDays > maxKeyDurationDays {
+		return &keyError{http.StatusBadRequest, fmt.Sprintf("max_duration_days must be between 1 and %d", maxKeyDurationDays)}
+	}
+	return nil
+}
+
+func joinProductIDs(ids []int) string {
+	parts := make([]string, len(ids))
+	for i, id := range ids {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+func AdminCreateResellerHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name              string   `json:"name"`
+		KeyQuota          int      `json:"key_quota"`
+		AllowedKeyTypes   []string `json:"allowed_key_types"`
+		AllowedProductIDs []int    `json:"allowed_product_ids"`
+		MaxDurationDays   int      `json:"max_duration_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" {
+		http.Error(w, `{"error":"Name is required"}`, http.StatusBadRequest)
+		return
+	}
+	if req.KeyQuota < 0 {
+		http.Error(w, `{"error":"Quota cannot be negative"}`, http.StatusBadRequest)
+		return
+	}
+	if req.AllowedKeyTypes == nil {
+		req.AllowedKeyTypes = defaultResellerKeyTypes
+	}
+	if req.MaxDurationDays == 0 {
+		req.MaxDurationDays = defaultResellerMaxDurationDays
+	}
+	if err := validateResellerLimits(req.AllowedKeyTypes, req.AllowedProductIDs, req.MaxDurationDays); err != nil {
+		writeKeyError(w, err, "Failed to validate reseller limits")
+		return
+	}
+
+	res, err := database.DB.Exec("INSERT INTO resellers (name, key_quota, allowed_key_types, allowed_product_ids, max_duration_days) VALUES (?, ?, ?, ?, ?)",
+		req.Name, req.KeyQuota, strings.Join(req.AllowedKeyTypes, ","), joinProductIDs(req.AllowedProductIDs), req.MaxDurationDays)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to create reseller"}`, http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"id": id, "message": "Reseller created successfully"})
+}
+
+func AdminGetResellersHandler(w http.ResponseWriter, r *http.Request) {
+	rows, err := database.DB.Query("SELECT id, name, key_quota, keys_issued, allowed_key_types, allowed_product_ids, max_duration_days, is_active, created_at FROM resellers ORDER BY id DESC")
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query resellers"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	resellers := make([]model.Reseller, 0)
+	for rows.Next() {
+		var rs model.Reseller
+		var keyTypes, productIDs string
+		if err := rows.Scan(&rs.ID, &rs.Name, &rs.KeyQuota, &rs.KeysIssued, &keyTypes, &productIDs, &rs.MaxDurationDays, &rs.IsActive, &rs.CreatedAt); err != nil {
+			http.Error(w, `{"error":"Failed to scan reseller row"}`, http.StatusInternalServerError)
+			return
+		}
+		limits := parseResellerLimits(keyTypes, productIDs, rs.MaxDurationDays)
+		rs.AllowedKeyTypes, rs.AllowedProductIDs = limits.KeyTypes, limits.ProductIDs
+		resellers = append(resellers, rs)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resellers)
+}
+
+func AdminUpdateResellerHandler(w http.ResponseWriter, r *http.Request) {
+	resellerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid reseller ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		KeyQuota          *int      `json:"key_quota"`
+		IsActive          *bool     `json:"is_active"`
+		AllowedKeyTypes   *[]string `json:"allowed_key_types"`
+		AllowedProductIDs *[]int    `json:"allowed_product_ids"`
+		MaxDurationDays   *int      `json:"max_duration_days"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	limits, err := loadResellerLimits(resellerID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"error":"Reseller not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to look up reseller"}`, http.StatusInternalServerError)
+		return
+	}
+	if req.AllowedKeyTypes != nil {
+		limits.KeyTypes = *req.AllowedKeyTypes
+	}
+	if req.AllowedProductIDs != nil {
+		limits.ProductIDs = *req.AllowedProductIDs
+	}
+	if req.MaxDurationDays != nil {
+		limits.MaxDurationDays = *req.MaxDurationDays
+	}
+	if err := validateResellerLimits(limits.KeyTypes, limits.ProductIDs, limits.MaxDurationDays); err != nil {
+		writeKeyError(w, err, "Failed to validate reseller limits")
+		return
+	}
+
+	if req.KeyQuota != nil {
+		if *req.KeyQuota < 0 {
+			http.Error(w, `{"error":"Quota cannot be negative"}`, http.StatusBadRequest)
+			return
+		}
+		_, err = database.DB.Exec("UPDATE resellers SET key_quota = ? WHERE id = ?", *req.KeyQuota, resellerID)
+	}
+	if err == nil && req.IsActive != nil {
+		_, err = database.DB.Exec("UPDATE resellers SET is_active = ? WHERE id = ?", *req.IsActive, resellerID)
+	}
+	if err == nil && (req.AllowedKeyTypes != nil || req.AllowedProductIDs != nil || req.MaxDurationDays != nil) {
+		_, err = database.DB.Exec("UPDATE resellers SET allowed_key_types = ?, allowed_product_ids = ?, max_duration_days = ? WHERE id = ?",
+			strings.Join(limits.KeyTypes, ","), joinProductIDs(limits.ProductIDs), limits.MaxDurationDays, resellerID)
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to update reseller"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Reseller updated successfully"})
+}
+
+// AdminCreateResellerAPIKeyHandler issues a new access key and secret. The
+// secret is only returned here.
+func AdminCreateResellerAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	resellerID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid reseller ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Scopes []string `json:"scopes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{middleware.ResellerScopeAllocateKeys, middleware.ResellerScopeReadKeys}
+	}
+	for _, s := range req.Scopes {
+		if s != middleware.ResellerScopeAllocateKeys && s != middleware.ResellerScopeReadKeys {
+			jsonError(w, "Unknown scope: "+s, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var exists bool
+	if err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM resellers WHERE id = ?)", resellerID).Scan(&exists); err != nil || !exists {
+		http.Error(w, `{"error":"Reseller not found"}`, http.StatusNotFound)
+		return
+	}
+
+	accessKey, err := generateOneTimeToken()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to generate API key"}`, http.StatusInternalServerError)
+		return
+	}
+	accessKey = "rk_" + accessKey[:32]
+	secret, err := generateOneTimeToken()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to generate API key"}`, http.StatusInternalServerError)
+		return
+	}
+
+	res, err := database.DB.Exec("INSERT INTO reseller_api_keys (reseller_id, access_key, secret, scopes) VALUES (?, ?, ?, ?)",
+		resellerID, accessKey, secret, strings.Join(req.Scopes, ","))
+	if err != nil {
+		http.Error(w, `{"error":"Failed to save API key"}`, http.StatusInternalServerError)
+		return
+	}
+	id, _ := res.LastInsertId()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":         id,
+		"access_key": accessKey,
+		"secret":     secret,
+		"scopes":     req.Scopes,
+	})
+}
+
+func AdminRevokeResellerAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	resellerID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid reseller ID"}`, http.StatusBadRequest)
+		return
+	}
+	keyID, err := strconv.Atoi(vars["keyId"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid API key ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	res, err := database.DB.Exec("UPDATE reseller_api_keys SET is_revoked = TRUE WHERE id = ? AND reseller_id = ?", keyID, resellerID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to revoke API key"}`, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"error":"API key not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "API key revoked successfully"})
+}
+
+// loadResellerLimits returns what a reseller may sell.
+func loadResellerLimits(resellerID int) (resellerLimits, error) {
+	var keyTypes, productIDs string
+	var maxDurationDays int
+	err := database.DB.QueryRow("SELECT allowed_key_types, allowed_product_ids, max_duration_days FROM resellers WHERE id = ?", resellerID).
+		Scan(&keyTypes, &productIDs, &maxDurationDays)
+	if err != nil {
+		return resellerLimits{}, err
+	}
+	return parseResellerLimits(keyTypes, productIDs, maxDurationDays), nil
+}
+
+func ResellerQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	reseller, ok := middleware.GetResellerFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve reseller"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var quota, issued int
+	err := database.DB.QueryRow("SELECT key_quota, keys_issued FROM resellers WHERE id = ?", reseller.ResellerID).Scan(&quota, &issued)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to load quota"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{
+		"key_quota":   quota,
+		"keys_issued": issued,
+		"remaining":   quota - issued,
+	})
+}
+
+// ResellerAllocateKeysHandler issues keys against the reseller's quota. The
+// quota is reserved with a conditional UPDATE, so concurrent requests cannot
+// overdraw it.
+func ResellerAllocateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	reseller, ok := middleware.GetResellerFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve reseller"}`, http.StatusInternalServerError)
+		return
+	}
+	if !reseller.HasScope(middleware.ResellerScopeAllocateKeys) {
+		http.Error(w, `{"error":"API key lacks the keys:allocate scope"}`, http.StatusForbidden)
+		return
+	}
+
+	var req struct {
+		KeyType      string `json:"key_type"`
+		DurationDays int    `json:"duration_days"`
+		ProductID    *int   `json:"product_id"`
+		Quantity     int    `json:"quantity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.KeyType == "" {
+		req.KeyType = model.KeyTypeSubscription
+	}
+	if !resellerKeyTypes[req.KeyType] {
+		http.Error(w, `{"error":"Key type is not available to resellers"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Quantity <= 0 || req.Quantity > maxResellerKeysPerRequest {
+		http.Error(w, `{"error":"Quantity must be between 1 and 100"}`, http.StatusBadRequest)
+		return
+	}
+	limits, err := loadResellerLimits(reseller.ResellerID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to load reseller limits"}`, http.StatusInternalServerError)
+		return
+	}
+	if err := limits.check(req.KeyType, req.ProductID, req.DurationDays); err != nil {
+		writeKeyError(w, err, "Failed to check reseller limits")
+		return
+	}
+	params := keyParams{DurationDays: req.DurationDays, ProductID: req.ProductID}
+	if err := keyTypes[req.KeyType].validate(params); err != nil {
+		writeKeyError(w, err, "Failed to validate key parameters")
+		return
+	}
+	format, err := resolveKeyFormat("", 0, 0, req.ProductID)
+	if err != nil {
+		writeKeyError(w, err, "Failed to resolve key format")
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE resellers SET keys_issued = keys_issued + ? WHERE id = ? AND keys_issued + ? <= key_quota",
+		req.Quantity, reseller.ResellerID, req.Quantity)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to reserve quota"}`, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"error":"Not enough quota left","code":"quota_exceeded"}`, http.StatusPaymentRequired)
+		return
+	}
+
+	stmt, err := tx.Prepare("INSERT IGNORE INTO activation_keys (key_string, key_type, duration_days, product_id, reseller_id) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		http.Error(w, `{"error":"Failed to prepare statement"}`, http.StatusInternalServerError)
+		return
+	}
+	defer stmt.Close()
+
+	keys := make([]string, 0, req.Quantity)
+	for len(keys) < req.Quantity {
+		newKey, err := generateActivationKey(format)
+		if err != nil {
+			http.Error(w, `{"error":"Failed to generate key"}`, http.StatusInternalServerError)
+			return
+		}
+		res, err := stmt.Exec(newKey, req.KeyType, req.DurationDays, req.ProductID, reseller.ResellerID)
+		if err != nil {
+			http.Error(w, `{"error":"Failed to save key to database"}`, http.StatusInternalServerError)
+			return
+		}
+		// A collision with an existing key inserts nothing; just try again.
+		if n, _ := res.RowsAffected(); n == 1 {
+			keys = append(keys, newKey)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+}
+
+func ResellerGetKeysHandler(w http.ResponseWriter, r *http.Request) {
+	reseller, ok := middleware.GetResellerFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve reseller"}`, http.StatusInternalServerError)
+		return
+	}
+	if !reseller.HasScope(middleware.ResellerScopeReadKeys) {
+		http.Error(w, `{"error":"API key lacks the keys:read scope"}`, http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 100
+	}
+	offset := (page - 1) * limit
+
+	where := "WHERE reseller_id = ?"
+	args := []interface{}{reseller.ResellerID}
+	switch query.Get("status") {
+	case "used":
+		where += " AND is_used = TRUE"
+	case "unused":
+		where += " AND is_used = FALSE"
+	}
+	if key := query.Get("key"); key != "" {
+		where += " AND key_string = ?"
+		args = append(args, normalizeActivationKey(key))
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM activation_keys "+where, args...).Scan(&total); err != nil {
+		http.Error(w, `{"error":"Failed to count keys"}`, http.StatusInternalServerError)
+		return
+	}
+	totalPages := int(math.Ceil(float64(total) / float64(limit)))
+
+	rows, err := database.DB.Query("SELECT key_string, key_type, duration_days, product_id, is_used, used_at FROM activation_keys "+where+" ORDER BY id DESC LIMIT ? OFFSET ?",
+		append(args, limit, offset)...)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query keys"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	keys := make([]model.KeyForReseller, 0)
+	for rows.Next() {
+		var key model.KeyForReseller
+		var productID sql.NullInt64
+		var usedAt sql.NullTime
+		if err := rows.Scan(&key.KeyString, &key.KeyType, &key.DurationDays, &productID, &key.IsUsed, &usedAt); err != nil {
+			http.Error(w, `{"error":"Failed to scan key row"}`, http.StatusInternalServerError)
+			return
+		}
+		if productID.Valid {
+			id := int(productID.Int64)
+			key.ProductID = &id
+		}
+		if usedAt.Valid {
+			key.UsedAt = &usedAt.Time
+		}
+		keys = append(keys, key)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(model.PaginatedResellerKeysResponse{
+		Keys:        keys,
+		TotalPages:  totalPages,
+		CurrentPage: page,
+	})
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"astralis.backend/internal/model"
+	"testing"
+	"time"
+)
+
+func TestResellerLimitsCheck(t *testing.T) {
+	limits := parseResellerLimits("subscription, product_unlock", "3,7", 30)
+	product := func(id int) *int { return &id }
+
+	tests := []struct {
+		name      string
+		keyType   string
+		productID *int
+		days      int
+		ok        bool
+	}{
+		{"subscription", model.KeyTypeSubscription, nil, 30, true},
+		{"subscription for an allowed product", model.KeyTypeSubscription, product(7), 1, true},
+		{"too long", model.KeyTypeSubscription, nil, 31, false},
+		{"overflowing duration", model.KeyTypeSubscription, nil, 1 << 40, false},
+		{"other product", model.KeyTypeSubscription, product(4), 1, false},
+		{"product unlock", model.KeyTypeProductUnlock, product(3), 0, true},
+		{"product unlock for another product", model.KeyTypeProductUnlock, product(5), 0, false},
+		{"lifetime not allowed", model.KeyTypeLifetime, nil, 0, false},
+		{"admin-only type", model.KeyTypeRoleGrant, nil, 0, false},
+	}
+	for _, tt := range tests {
+		err := limits.check(tt.keyType, tt.productID, tt.days)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v, want ok = %v", tt.name, err, tt.ok)
+		}
+	}
+
+	empty := parseResellerLimits("", "", 365)
+	if len(empty.KeyTypes) != 0 || len(empty.ProductIDs) != 0 {
+		t.Errorf("empty lists parsed as %v and %v", empty.KeyTypes, empty.ProductIDs)
+	}
+}
+
+func TestAddDays(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		days int
+		want time.Time
+	}{
+		{0, start},
+		{30, time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)},
+		{-1, time.Date(2026, 2, 28, 12, 0, 0, 0, time.UTC)},
+		{maxKeyDurationDays, start.AddDate(0, 0, maxKeyDurationDays)},
+		// Far beyond what time.Duration can hold; stops at lifetime access.
+		{3000000, lifetimeExpiry},
+		{1 << 40, lifetimeExpiry},
+	}
+	for _, tt := range tests {
+		if got := addDays(start, tt.days); !got.Equal(tt.want) {
+			t.Errorf("addDays(%d) = %v, want %v", tt.days, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// jsonError works like http.Error but escapes message into the usual
+// {"error": "..."} body, for messages that are not compile-time constants.
+func jsonError(w http.ResponseWriter, message string, code int) {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	http.Error(w, string(body), code)
+}
+
+// fieldErrors maps request fields to what is wrong with them.
+type fieldErrors map[string]string
+
+// writeFieldErrors reports a request that failed validation, naming each
+// offending field: {"error": "...", "fields": {"name": "..."}}.
+func writeFieldErrors(w http.ResponseWriter, message string, fields fieldErrors, code int) {
+	body, _ := json.Marshal(map[string]interface{}{"error": message, "fields": fields})
+	http.Error(w, string(body), code)
+}
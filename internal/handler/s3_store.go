@@ -0,0 +1,228 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// s3Store keeps release files in an S3-compatible bucket, such as MinIO
+// locally. Requests are authenticated with presigned URLs (AWS Signature
+// Version 4 in the query string), the same kind launchers are given.
+type s3Store struct {
+	scheme    string
+	host      string
+	pathStyle bool
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	prefix    string
+	client    *http.Client
+
+	// uploaded remembers the SHA-256 of the content known to be in the
+	// bucket by key, so each version is checked at most once per process.
+	uploaded sync.Map
+}
+
+func newS3Store() (*s3Store, error) {
+	cfg := config.Cfg
+	endpoint, err := url.Parse(cfg.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("%q is not an http(s) URL", cfg.S3Endpoint)
+	}
+	prefix := strings.Trim(cfg.S3Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Store{
+		scheme:    endpoint.Scheme,
+		host:      endpoint.Host,
+		pathStyle: cfg.S3PathStyle,
+		region:    cfg.S3Region,
+		bucket:    cfg.S3Bucket,
+		accessKey: cfg.S3AccessKey,
+		secretKey: cfg.S3SecretKey,
+		prefix:    prefix,
+		client:    &http.Client{Timeout: 30 * time.Minute},
+	}, nil
+}
+
+// s3Escape encodes a string the way Signature Version 4 expects: every byte
+// but the unreserved characters, and the slash when escapeSlash is false.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3HashHeader carries the SHA-256 of an object, set on upload and compared
+// before the next one.
+const s3HashHeader = "x-amz-meta-sha256"
+
+// presign returns a URL for method on key, valid for the given time from
+// now. The payload is left unsigned, so uploads can be streamed; headers,
+// by lower-case name, are signed and must be sent with the request.
+func (s *s3Store) presign(method, key string, validFor time.Duration, headers map[string]string) string {
+	host := s.host
+	path := "/" + s3Escape(s.prefix+key, false)
+	if s.pathStyle {
+		path = "/" + s3Escape(s.bucket, true) + path
+	} else {
+		host = s.bucket + "." + host
+	}
+
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + s.region + "/s3/aws4_request"
+	seconds := int64((validFor + time.Second - 1) / time.Second)
+	if seconds > 7*24*3600 {
+		seconds = 7 * 24 * 3600
+	}
+	headerNames := []string{"host"}
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		value := host
+		if name != "host" {
+			value = strings.TrimSpace(headers[name])
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+	params := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    s.accessKey + "/" + scope,
+		"X-Amz-Date":          amzDate,
+		"X-Amz-Expires":       strconv.FormatInt(seconds, 10),
+		"X-Amz-SignedHeaders": signedHeaders,
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	query := make([]string, len(names))
+	for i, name := range names {
+		query[i] = s3Escape(name, true) + "=" + s3Escape(params[name], true)
+	}
+	canonicalQuery := strings.Join(query, "&")
+
+	canonicalRequest := strings.Join([]string{
+		method, path, canonicalQuery, canonicalHeaders.String(), signedHeaders, "UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.secretKey), amzDate[:8])
+	signingKey = hmacSHA256(signingKey, s.region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	return s.scheme + "://" + host + path + "?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+func (s *s3Store) signedURL(key string, expires time.Time) string {
+	return s.presign(http.MethodGet, key, time.Until(expires), nil)
+}
+
+func (s *s3Store) has(key, hash string) bool {
+	stored, ok := s.uploaded.Load(key)
+	return ok && stored == hash
+}
+
+// upload checks the hash the object was uploaded with, so a file edited in
+// place under the same key is uploaded again. Objects without the hash, from
+// before it was recorded, are replaced too.
+func (s *s3Store) upload(key, hash string) error {
+	if s.has(key, hash) {
+		return nil
+	}
+
+	resp, err := s.client.Head(s.presign(http.MethodHead, key, 5*time.Minute, nil))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if resp.Header.Get(s3HashHeader) == hash {
+			s.uploaded.Store(key, hash)
+			return nil
+		}
+	case http.StatusNotFound:
+	default:
+		return fmt.Errorf("checking %s in the bucket: %s", key, resp.Status)
+	}
+
+	file, err := os.Open(filepath.Join(config.Cfg.GameFilesDir, filepath.FromSlash(key)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// The file may have changed again since the manifest was built; upload
+	// it with the next manifest rather than under a hash it does not have.
+	sum := sha256.New()
+	size, err := io.Copy(sum, file)
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(sum.Sum(nil)) != hash {
+		return fmt.Errorf("%s has changed since the manifest was built", key)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	headers := map[string]string{s3HashHeader: hash}
+	req, err := http.NewRequest(http.MethodPut, s.presign(http.MethodPut, key, time.Hour, headers), file)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set(s3HashHeader, hash)
+	resp, err = s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("uploading %s to the bucket: %s", key, resp.Status)
+	}
+	s.uploaded.Store(key, hash)
+	return nil
+}
@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/model"
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+func validateProductExists(productID int) error {
+	var exists bool
+	err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM products WHERE id = ?)", productID).Scan(&exists)
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to look up product"}
+	}
+	if !exists {
+		return &keyError{http.StatusBadRequest, "Product not found"}
+	}
+	return nil
+}
+
+// grantProductSubscription appends days to the user's subscription for a
+// product, starting where the current one ends if it is still active.
+func grantProductSubscription(tx *sql.Tx, userID string, productID, days int, source string, sourceRef *int) error {
+	if frozen, err := addFrozenTime(tx, userID, &productID, days); err != nil || frozen {
+		if err != nil {
+			return &keyError{http.StatusInternalServerError, "Failed to get current subscription"}
+		}
+		return nil
+	}
+	startsAt, err := productSubscriptionEnd(tx, userID, productID)
+	if err != nil {
+		return err
+	}
+	if !startsAt.Before(lifetimeExpiry) {
+		return nil
+	}
+	return insertSubscription(tx, userID, productID, startsAt, addDays(startsAt, days), source, sourceRef)
+}
+
+func grantProductLifetime(tx *sql.Tx, userID string, productID int, source string, sourceRef *int) error {
+	startsAt, err := productSubscriptionEnd(tx, userID, productID)
+	if err != nil {
+		return err
+	}
+	if err := endFreeze(tx, userID, &productID); err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to update product subscription"}
+	}
+	return insertSubscription(tx, userID, productID, startsAt, lifetimeExpiry, source, sourceRef)
+}
+
+// productSubscriptionEnd returns when the user's subscription to a product
+// runs out, or now if it already has. The user row is locked so concurrent
+// grants are serialized.
+func productSubscriptionEnd(tx *sql.Tx, userID string, productID int) (time.Time, error) {
+	if _, err := tx.Exec("SELECT id FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		return time.Time{}, &keyError{http.StatusInternalServerError, "Failed to get current subscription"}
+	}
+	var end sql.NullTime
+	err := tx.QueryRow("SELECT MAX(expires_at) FROM subscriptions WHERE user_id = ? AND product_id = ?", userID, productID).Scan(&end)
+	if err != nil {
+		return time.Time{}, &keyError{http.StatusInternalServerError, "Failed to get current subscription"}
+	}
+	now := time.Now()
+	if end.Valid && end.Time.After(now) {
+		return end.Time, nil
+	}
+	return now, nil
+}
+
+func insertSubscription(tx *sql.Tx, userID string, productID int, startsAt, expiresAt time.Time, source string, sourceRef *int) error {
+	_, err := tx.Exec("INSERT INTO subscriptions (user_id, product_id, starts_at, expires_at, source, source_ref) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, productID, startsAt, expiresAt, source, sourceRef)
+	if err != nil {
+		return &keyError{http.StatusInternalServerError, "Failed to update product subscription"}
+	}
+	return nil
+}
+
+// loadEntitlements lists every product the user may currently launch. An
+// active global subscription entitles the user to all products; a product
+// subscription that runs longer takes precedence for that product.
+func loadEntitlements(userID string) ([]model.Entitlement, error) {
+	now := time.Now()
+
+	var globalExpiry sql.NullTime
+	if err := database.DB.QueryRow("SELECT subscription_expires_at FROM users WHERE id = ?", userID).Scan(&globalExpiry); err != nil {
+		return nil, err
+	}
+
+	// Subscription rows are chained, so the product's entitlement lasts until
+	// the latest expiry and its source is the row active right now.
+	type productSub struct {
+		expiresAt time.Time
+		source    string
+	}
+	subs := map[int]*productSub{}
+	rows, err := database.DB.Query("SELECT product_id, starts_at, expires_at, source FROM subscriptions WHERE user_id = ? AND expires_at > ?", userID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var productID int
+		var startsAt, expiresAt time.Time
+		var source string
+		if err := rows.Scan(&productID, &startsAt, &expiresAt, &source); err != nil {
+			return nil, err
+		}
+		ps, ok := subs[productID]
+		if !ok {
+			ps = &productSub{}
+			subs[productID] = ps
+		}
+		if expiresAt.After(ps.expiresAt) {
+			ps.expiresAt = expiresAt
+		}
+		if !startsAt.After(now) {
+			ps.source = source
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	products, err := database.DB.Query("SELECT id, name FROM products ORDER BY sort_index ASC")
+	if err != nil {
+		return nil, err
+	}
+	defer products.Close()
+
+	entitlements := make([]model.Entitlement, 0)
+	for products.Next() {
+		var e model.Entitlement
+		if err := products.Scan(&e.ProductID, &e.ProductName); err != nil {
+			return nil, err
+		}
+		if globalExpiry.Valid && globalExpiry.Time.After(now) {
+			e.ExpiresAt = globalExpiry.Time
+			e.Source = model.SubscriptionSourceGlobal
+		}
+		if ps, ok := subs[e.ProductID]; ok && ps.source != "" && ps.expiresAt.After(e.ExpiresAt) {
+			e.ExpiresAt = ps.expiresAt
+			e.Source = ps.source
+		}
+		if e.Source == "" {
+			continue
+		}
+		e.Lifetime = !e.ExpiresAt.Before(lifetimeExpiry)
+		entitlements = append(entitlements, e)
+	}
+	return entitlements, products.Err()
+}
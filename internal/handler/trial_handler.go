@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// trialIneligibility explains why a user cannot start a trial.
+type trialIneligibility struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// normalizeTrialEmail folds the address variants that reach the same mailbox,
+// so "Name+trial2@example.com" counts as "name@example.com".
+func normalizeTrialEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	local, domain := email[:at], email[at:]
+	if plus := strings.Index(local, "+"); plus >= 0 {
+		local = local[:plus]
+	}
+	return local + domain
+}
+
+// checkTrialEligibility runs the trial rules against the user and returns the
+// reason the user is not eligible, or nil together with the HWID and email to
+// record. StartTrialHandler locks the user row first, so the same account
+// cannot start two trials at once; accounts sharing a HWID or email are kept
+// apart by reserveTrialIdentities.
+func checkTrialEligibility(q interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, userID string) (*trialIneligibility, string, string, error) {
+	var email string
+	var hwid, override sql.NullString
+	var isBanned bool
+	err := q.QueryRow("SELECT email, hwid, trial_override, is_banned FROM users WHERE id = ?", userID).Scan(&email, &hwid, &override, &isBanned)
+	if err != nil {
+		return nil, "", "", err
+	}
+	email = normalizeTrialEmail(email)
+
+	if isBanned {
+		return &trialIneligibility{http.StatusForbidden, "banned", "This account is banned"}, "", "", nil
+	}
+	if override.String == model.TrialOverrideDeny {
+		return &trialIneligibility{http.StatusForbidden, "trial_denied", "Trials are not available for this account"}, "", "", nil
+	}
+	if !hwid.Valid || hwid.String == "" {
+		return &trialIneligibility{http.StatusConflict, "hwid_required", "Log in from the launcher to start a trial"}, "", "", nil
+	}
+	if override.String == model.TrialOverrideGrant {
+		return nil, hwid.String, email, nil
+	}
+
+	var used int
+	err = q.QueryRow("SELECT COUNT(*) FROM trial_claims WHERE user_id = ? OR hwid = ? OR email = ?",
+		userID, hwid.String, email).Scan(&used)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if used > 0 {
+		return &trialIneligibility{http.StatusConflict, "trial_already_used", "A trial has already been used on this account, device or email"}, "", "", nil
+	}
+	return nil, hwid.String, email, nil
+}
+
+// reserveTrialIdentities marks the HWID and email of a trial as used. Their
+// unique key makes a second account with the same HWID or email fail with a
+// duplicate key error, even while the first claim is not yet committed. A
+// trial allowed by an admin override does not fail, and only marks what is
+// not marked yet.
+func reserveTrialIdentities(tx *sql.Tx, claimID int, hwid, email string, override bool) error {
+	insert := "INSERT INTO trial_identities (kind, value, claim_id) VALUES (?, ?, ?), (?, ?, ?)"
+	if override {
+		insert = "INSERT IGNORE INTO trial_identities (kind, value, claim_id) VALUES (?, ?, ?), (?, ?, ?)"
+	}
+	_, err := tx.Exec(insert, "hwid", hwid, claimID, "email", email, claimID)
+	return err
+}
+
+func GetTrialStatusHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+
+	reason, _, _, err := checkTrialEligibility(database.DB, claims.Subject)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to check trial eligibility"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]interface{}{
+		"eligible":    reason == nil,
+		"days":        config.Cfg.TrialDays,
+		"product_ids": config.Cfg.TrialProductIDs,
+	}
+	if reason != nil {
+		response["code"] = reason.Code
+		response["message"] = reason.Message
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// StartTrialHandler starts the one-time trial. Without configured trial
+// products it extends the global subscription.
+func StartTrialHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	userID := claims.Subject
+
+	if config.Cfg.TrialDays <= 0 {
+		http.Error(w, `{"error":"Trials are currently disabled","code":"trials_disabled"}`, http.StatusForbidden)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT id FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+		return
+	}
+	reason, hwid, email, err := checkTrialEligibility(tx, userID)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to check trial eligibility"}`, http.StatusInternalServerError)
+		return
+	}
+	if reason != nil {
+		body, _ := json.Marshal(map[string]string{"error": reason.Message, "code": reason.Code})
+		http.Error(w, string(body), reason.Status)
+		return
+	}
+
+	res, err := tx.Exec("INSERT INTO trial_claims (user_id, hwid, email, days) VALUES (?, ?, ?, ?)", userID, hwid, email, config.Cfg.TrialDays)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start trial"}`, http.StatusInternalServerError)
+		return
+	}
+	claimID64, _ := res.LastInsertId()
+	claimID := int(claimID64)
+
+	// A granted override is good for one trial only.
+	res, err = tx.Exec("UPDATE users SET trial_override = NULL WHERE id = ? AND trial_override = ?", userID, model.TrialOverrideGrant)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start trial"}`, http.StatusInternalServerError)
+		return
+	}
+	granted, _ := res.RowsAffected()
+	if err := reserveTrialIdentities(tx, claimID, hwid, email, granted > 0); err != nil {
+		if isDuplicateKey(err) {
+			http.Error(w, `{"error":"A trial has already been used on this account, device or email","code":"trial_already_used"}`, http.StatusConflict)
+			return
+		}
+		http.Error(w, `{"error":"Failed to start trial"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if len(config.Cfg.TrialProductIDs) == 0 {
+		err = extendSubscription(tx, userID, config.Cfg.TrialDays)
+	}
+	for _, productID := range config.Cfg.TrialProductIDs {
+		if err = grantProductSubscription(tx, userID, productID, config.Cfg.TrialDays, model.SubscriptionSourceTrial, &claimID); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		writeKeyError(w, err, "Failed to start trial")
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"message": fmt.Sprintf("Your %d-day trial has started", config.Cfg.TrialDays)})
+}
@@ -0,0 +1,310 @@
+package handler
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"astralis.backend/internal/middleware"
+	"astralis.backend/internal/model"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ledgerEntry moves amount into (positive) or out of (negative) an account.
+type ledgerEntry struct {
+	AccountID int64
+	Amount    int64
+}
+
+// userWalletAccount returns the ledger account of a user's wallet, opening it
+// on first use.
+func userWalletAccount(tx *sql.Tx, userID string) (int64, error) {
+	if _, err := tx.Exec("INSERT IGNORE INTO wallet_accounts (user_id) VALUES (?)", userID); err != nil {
+		return 0, &keyError{http.StatusInternalServerError, "Failed to open wallet"}
+	}
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM wallet_accounts WHERE user_id = ?", userID).Scan(&id); err != nil {
+		return 0, &keyError{http.StatusInternalServerError, "Failed to open wallet"}
+	}
+	return id, nil
+}
+
+func systemWalletAccount(tx *sql.Tx, code string) (int64, error) {
+	var id int64
+	if err := tx.QueryRow("SELECT id FROM wallet_accounts WHERE code = ?", code).Scan(&id); err != nil {
+		return 0, &keyError{http.StatusInternalServerError, "Failed to find system account " + code}
+	}
+	return id, nil
+}
+
+// postLedgerTransaction records a balanced set of entries under an
+// idempotency key. It reports false without changing anything when the key
+// was already used, so retried requests are applied once. Accounts are locked
+// in ID order, and a user account that would go below zero fails the whole
+// transaction.
+func postLedgerTransaction(tx *sql.Tx, idempotencyKey, kind, reference string, createdBy *int, entries ...ledgerEntry) (bool, error) {
+	var sum int64
+	for _, e := range entries {
+		sum += e.Amount
+	}
+	if sum != 0 || len(entries) < 2 {
+		return false, &keyError{http.StatusInternalServerError, "Unbalanced ledger transaction"}
+	}
+
+	res, err := tx.Exec("INSERT IGNORE INTO ledger_transactions (idempotency_key, kind, reference, created_by) VALUES (?, ?, NULLIF(?, ''), ?)",
+		idempotencyKey, kind, reference, createdBy)
+	if err != nil {
+		return false, &keyError{http.StatusInternalServerError, "Failed to record transaction"}
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	transactionID, _ := res.LastInsertId()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].AccountID < entries[j].AccountID })
+	for _, e := range entries {
+		var balance int64
+		var userID sql.NullInt64
+		if err := tx.QueryRow("SELECT balance, user_id FROM wallet_accounts WHERE id = ? FOR UPDATE", e.AccountID).Scan(&balance, &userID); err != nil {
+			return false, &keyError{http.StatusInternalServerError, "Failed to lock account"}
+		}
+		balance += e.Amount
+		if userID.Valid && balance < 0 {
+			return false, &keyError{http.StatusPaymentRequired, "Insufficient balance"}
+		}
+		if _, err := tx.Exec("UPDATE wallet_accounts SET balance = ? WHERE id = ?", balance, e.AccountID); err != nil {
+			return false, &keyError{http.StatusInternalServerError, "Failed to update balance"}
+		}
+		if _, err := tx.Exec("INSERT INTO ledger_entries (transaction_id, account_id, amount, balance_after) VALUES (?, ?, ?, ?)",
+			transactionID, e.AccountID, e.Amount, balance); err != nil {
+			return false, &keyError{http.StatusInternalServerError, "Failed to record transaction"}
+		}
+	}
+	return true, nil
+}
+
+// transferWallet posts a two-entry transaction moving amount from a system
+// account to a user's wallet; a negative amount moves it back.
+func transferWallet(tx *sql.Tx, userID, systemAccount, idempotencyKey, kind, reference string, createdBy *int, amount int64) (bool, error) {
+	userAccount, err := userWalletAccount(tx, userID)
+	if err != nil {
+		return false, err
+	}
+	system, err := systemWalletAccount(tx, systemAccount)
+	if err != nil {
+		return false, err
+	}
+	return postLedgerTransaction(tx, idempotencyKey, kind, reference, createdBy,
+		ledgerEntry{system, -amount}, ledgerEntry{userAccount, amount})
+}
+
+// requestIdempotencyKey scopes the client's Idempotency-Key header to the
+// caller, or makes up a unique key when the client sent none.
+func requestIdempotencyKey(r *http.Request, scope string) string {
+	if key := strings.TrimSpace(r.Header.Get("Idempotency-Key")); key != "" && len(key) <= 128 {
+		return scope + ":" + key
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	return scope + ":" + hex.EncodeToString(b)
+}
+
+// maxWalletPageSize caps the limit parameter of wallet history requests.
+const maxWalletPageSize = 100
+
+func loadWallet(w http.ResponseWriter, r *http.Request, userID string) {
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	if limit > maxWalletPageSize {
+		limit = maxWalletPageSize
+	}
+	offset := (page - 1) * limit
+
+	wallet := model.Wallet{Currency: config.Cfg.PaymentCurrency, Transactions: []model.WalletTransaction{}, CurrentPage: page}
+	var accountID int64
+	err = database.DB.QueryRow("SELECT id, balance FROM wallet_accounts WHERE user_id = ?", userID).Scan(&accountID, &wallet.Balance)
+	if err == sql.ErrNoRows {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wallet)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"error":"Failed to get wallet"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var total int
+	if err := database.DB.QueryRow("SELECT COUNT(*) FROM ledger_entries WHERE account_id = ?", accountID).Scan(&total); err != nil {
+		http.Error(w, `{"error":"Failed to count transactions"}`, http.StatusInternalServerError)
+		return
+	}
+	wallet.TotalPages = int(math.Ceil(float64(total) / float64(limit)))
+
+	rows, err := database.DB.Query(`SELECT t.id, t.kind, e.amount, e.balance_after, t.reference, t.created_at
+		FROM ledger_entries e JOIN ledger_transactions t ON t.id = e.transaction_id
+		WHERE e.account_id = ? ORDER BY e.id DESC LIMIT ? OFFSET ?`, accountID, limit, offset)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to query transactions"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t model.WalletTransaction
+		var reference sql.NullString
+		if err := rows.Scan(&t.ID, &t.Kind, &t.Amount, &t.BalanceAfter, &reference, &t.CreatedAt); err != nil {
+			http.Error(w, `{"error":"Failed to scan transaction row"}`, http.StatusInternalServerError)
+			return
+		}
+		if reference.Valid {
+			t.Reference = &reference.String
+		}
+		wallet.Transactions = append(wallet.Transactions, t)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(wallet)
+}
+
+func GetWalletHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	loadWallet(w, r, claims.Subject)
+}
+
+func AdminGetUserWalletHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+	loadWallet(w, r, strconv.Itoa(userID))
+}
+
+// AdminCreditWalletHandler adds to or, with a negative amount, takes from a
+// user's balance. Send an Idempotency-Key header to make retries safe.
+func AdminCreditWalletHandler(w http.ResponseWriter, r *http.Request) {
+	claims, ok := middleware.GetClaimsFromContext(r)
+	if !ok {
+		http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+		return
+	}
+	adminID, _ := strconv.Atoi(claims.Subject)
+
+	userID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, `{"error":"Invalid user ID"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Amount int64  `json:"amount"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	if req.Amount == 0 {
+		http.Error(w, `{"error":"Amount cannot be zero"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Reason == "" {
+		http.Error(w, `{"error":"A reason is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	tx, err := database.DB.Begin()
+	if err != nil {
+		http.Error(w, `{"error":"Failed to start transaction"}`, http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id = ?)", userID).Scan(&exists); err != nil || !exists {
+		http.Error(w, `{"error":"User not found"}`, http.StatusNotFound)
+		return
+	}
+
+	key := requestIdempotencyKey(r, fmt.Sprintf("admin:%d:user:%d", adminID, userID))
+	applied, err := transferWallet(tx, strconv.Itoa(userID), model.WalletAccountAdmin, key, model.LedgerKindAdminCredit, req.Reason, &adminID, req.Amount)
+	if err != nil {
+		writeKeyError(w, err, "Failed to update balance")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, `{"error":"Failed to commit transaction"}`, http.StatusInternalServerError)
+		return
+	}
+
+	message := "Balance updated successfully"
+	if !applied {
+		message = "This request was already processed"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"message": message, "applied": applied})
+}
+
+// AdminAuditWalletHandler checks the ledger: every transaction must balance
+// and every stored balance must equal the sum of its account's entries.
+func AdminAuditWalletHandler(w http.ResponseWriter, r *http.Request) {
+	issues := make([]model.WalletAuditIssue, 0)
+
+	rows, err := database.DB.Query(`SELECT a.id, a.balance, COALESCE(SUM(e.amount), 0) AS total
+		FROM wallet_accounts a LEFT JOIN ledger_entries e ON e.account_id = a.id
+		GROUP BY a.id, a.balance HAVING total <> a.balance`)
+	if err != nil {
+		http.Error(w, `{"error":"Failed to audit balances"}`, http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var id int
+		var balance, total int64
+		if err := rows.Scan(&id, &balance, &total); err != nil {
+			rows.Close()
+			http.Error(w, `{"error":"Failed to scan audit row"}`, http.StatusInternalServerError)
+			return
+		}
+		issues = append(issues, model.WalletAuditIssue{AccountID: &id, Expected: total, Actual: balance, Problem: "balance_mismatch"})
+	}
+	rows.Close()
+
+	rows, err = database.DB.Query("SELECT transaction_id, SUM(amount) AS total FROM ledger_entries GROUP BY transaction_id HAVING total <> 0")
+	if err != nil {
+		http.Error(w, `{"error":"Failed to audit transactions"}`, http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var total int64
+		if err := rows.Scan(&id, &total); err != nil {
+			http.Error(w, `{"error":"Failed to scan audit row"}`, http.StatusInternalServerError)
+			return
+		}
+		issues = append(issues, model.WalletAuditIssue{TransactionID: &id, Expected: 0, Actual: total, Problem: "unbalanced_transaction"})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": len(issues) == 0, "issues": issues})
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"astralis.backend/internal/config"
+	"astralis.backend/internal/database"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// launcherAccessTTL is how long a granted launcher check is reused for the
+// same user and device, so the chunk requests of one update do not each go
+// to the database. Denials are not cached, so a user who just subscribed is
+// let in right away.
+const launcherAccessTTL = 30 * time.Second
+
+// launcherDenial explains why a user may not download the client. Code is
+// stable, so the launcher can pick a screen from it: "buy" for
+// subscription_required, "renew" for subscription_expired.
+type launcherDenial struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// launcherAccessCache remembers until when users were let in per device.
+type launcherAccessCache struct {
+	mu      sync.Mutex
+	granted map[string]time.Time
+	swept   time.Time
+}
+
+var launcherAccess launcherAccessCache
+
+func launcherAccessKey(userID, hwid string) string {
+	return userID + "\x00" + hwid
+}
+
+// allowed reports whether the user was let in from the device recently.
+func (c *launcherAccessCache) allowed(key string, now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return now.Before(c.granted[key])
+}
+
+// grant remembers that the user was let in from the device, and drops the
+// entries that have run out.
+func (c *launcherAccessCache) grant(key string, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.granted == nil {
+		c.granted = map[string]time.Time{}
+	}
+	if now.Sub(c.swept) > launcherAccessTTL {
+		for k, until := range c.granted {
+			if !now.Before(until) {
+				delete(c.granted, k)
+			}
+		}
+		c.swept = now
+	}
+	c.granted[key] = now.Add(launcherAccessTTL)
+}
+
+// checkLauncherAccess decides whether the user may fetch the manifest and
+// client files from the device with the given HWID. Admins, by their role in
+// the database rather than in the token, skip the subscription and device
+// checks so they can test releases from any machine.
+func checkLauncherAccess(userID, hwid string) (*launcherDenial, error) {
+	var isBanned bool
+	var role, storedHwid sql.NullString
+	var subscribedUntil sql.NullTime
+	err := database.DB.QueryRow("SELECT is_banned, role, hwid, subscription_expires_at FROM users WHERE id = ?", userID).
+		Scan(&isBanned, &role, &storedHwid, &subscribedUntil)
+	if err != nil {
+		return nil, err
+	}
+	if isBanned {
+		return &launcherDenial{http.StatusForbidden, "banned", "This account is banned"}, nil
+	}
+	if role.String == "admin" {
+		return nil, nil
+	}
+
+	now := time.Now()
+	if !subscribedUntil.Valid || !subscribedUntil.Time.After(now) {
+		active, had, err := launcherSubscriptions(userID, now)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			if had || subscribedUntil.Valid {
+				return &launcherDenial{http.StatusPaymentRequired, "subscription_expired", "Your subscription has expired"}, nil
+			}
+			return &launcherDenial{http.StatusPaymentRequired, "subscription_required", "A subscription is required to download the client"}, nil
+		}
+	}
+
+	if !storedHwid.Valid || storedHwid.String == "" || hwid == "" {
+		return &launcherDenial{http.StatusForbidden, "hwid_required", "Log in from the launcher to bind this device"}, nil
+	}
+	if hwid != storedHwid.String {
+		var known bool
+		err := database.DB.QueryRow("SELECT EXISTS(SELECT 1 FROM user_devices WHERE user_id = ? AND hwid = ?)", userID, hwid).Scan(&known)
+		if err != nil {
+			return nil, err
+		}
+		if !known {
+			return &launcherDenial{http.StatusForbidden, "hwid_mismatch", "This device is not bound to the account"}, nil
+		}
+	}
+	return nil, nil
+}
+
+// launcherSubscriptions reports whether the user has an active subscription
+// to one of the launcher products, or to any product when none are set, and
+// whether they ever had one, to tell a lapsed customer from a new one.
+func launcherSubscriptions(userID string, now time.Time) (active, had bool, err error) {
+	query := "SELECT COALESCE(MAX(starts_at <= ? AND expires_at > ?), FALSE), COUNT(*) > 0 FROM subscriptions WHERE user_id = ?"
+	args := []interface{}{now, now, userID}
+	if ids := config.Cfg.LauncherProductIDs; len(ids) > 0 {
+		query += " AND product_id IN (?" + strings.Repeat(", ?", len(ids)-1) + ")"
+		for _, id := range ids {
+			args = append(args, id)
+		}
+	}
+	err = database.DB.QueryRow(query, args...).Scan(&active, &had)
+	return active, had, err
+}
+
+// LauncherAccessMiddleware guards the routes that hand out the paid client.
+// The launcher sends the machine's HWID in the X-HWID header. Denials are
+// {"error": "...", "code": "..."} with 402 for subscription problems and
+// 403 otherwise.
+func LauncherAccessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := GetClaimsFromContext(r)
+		if !ok {
+			http.Error(w, `{"error":"Could not retrieve user claims"}`, http.StatusInternalServerError)
+			return
+		}
+
+		hwid := r.Header.Get("X-HWID")
+		key := launcherAccessKey(claims.Subject, hwid)
+		if launcherAccess.allowed(key, time.Now()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		denial, err := checkLauncherAccess(claims.Subject, hwid)
+		if err != nil {
+			log.Printf("Failed to check launcher access of user %s: %v", claims.Subject, err)
+			http.Error(w, `{"error":"Failed to check access"}`, http.StatusInternalServerError)
+			return
+		}
+		if denial != nil {
+			body, _ := json.Marshal(map[string]string{"error": denial.Message, "code": denial.Code})
+			http.Error(w, string(body), denial.Status)
+			return
+		}
+		launcherAccess.grant(key, time.Now())
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,42 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLauncherAccessCache(t *testing.T) {
+	var c launcherAccessCache
+	now := time.Unix(1700000000, 0)
+	alice := launcherAccessKey("1", "hwid-a")
+
+	if c.allowed(alice, now) {
+		t.Fatal("empty cache let a user in")
+	}
+	c.grant(alice, now)
+
+	tests := []struct {
+		name string
+		key  string
+		at   time.Time
+		want bool
+	}{
+		{"same user and device", alice, now.Add(launcherAccessTTL - time.Second), true},
+		{"expired", alice, now.Add(launcherAccessTTL), false},
+		{"other device", launcherAccessKey("1", "hwid-b"), now, false},
+		{"other user", launcherAccessKey("2", "hwid-a"), now, false},
+		{"no device", launcherAccessKey("1", ""), now, false},
+		{"ambiguous split", launcherAccessKey("1\x00hwid", "-a"), now, false},
+	}
+	for _, tt := range tests {
+		if got := c.allowed(tt.key, tt.at); got != tt.want {
+			t.Errorf("%s: allowed = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	later := now.Add(2 * launcherAccessTTL)
+	c.grant(launcherAccessKey("2", "hwid-c"), later)
+	if _, ok := c.granted[alice]; ok {
+		t.Errorf("expired entry was not swept")
+	}
+}
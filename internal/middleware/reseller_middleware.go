@@ -0,0 +1,162 @@
+package middleware
+
+import (
+	"astralis.backend/internal/database"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const resellerContextKey = contextKey("reseller")
+
+// Signed requests older or newer than this are rejected. Within the window
+// each nonce is accepted once per API key, so a captured request cannot be
+// replayed.
+const resellerSignatureMaxSkew = 5 * time.Minute
+
+// Reseller request bodies are small JSON documents.
+const resellerMaxBodyBytes = 1 << 20
+
+var resellerNoncePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,64}$`)
+
+const (
+	ResellerScopeAllocateKeys = "keys:allocate"
+	ResellerScopeReadKeys     = "keys:read"
+)
+
+type ResellerClaims struct {
+	ResellerID int
+	APIKeyID   int
+	Scopes     []string
+}
+
+func (c *ResellerClaims) HasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// resellerSignature computes the signature of a reseller request.
+func resellerSignature(secret, method, requestURI, timestamp, nonce string, body []byte) []byte {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + requestURI + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyHash[:])))
+	return mac.Sum(nil)
+}
+
+// validResellerSignature reports whether the hex signature given by a
+// client matches the request.
+func validResellerSignature(given, secret, method, requestURI, timestamp, nonce string, body []byte) bool {
+	decoded, err := hex.DecodeString(given)
+	return err == nil && hmac.Equal(decoded, resellerSignature(secret, method, requestURI, timestamp, nonce, body))
+}
+
+// ResellerHMACMiddleware authenticates reseller API calls. A request carries
+// X-Reseller-Key, X-Reseller-Timestamp (unix seconds), X-Nonce (16 to 64
+// random characters from [A-Za-z0-9_-], never reused with the same key) and
+// X-Reseller-Signature, the hex HMAC-SHA256 with the key's secret over
+//
+//	METHOD + "\n" + request URI + "\n" + timestamp + "\n" + nonce + "\n" + hex(SHA-256(body))
+func ResellerHMACMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accessKey := r.Header.Get("X-Reseller-Key")
+		timestamp := r.Header.Get("X-Reseller-Timestamp")
+		nonce := r.Header.Get("X-Nonce")
+		signature := r.Header.Get("X-Reseller-Signature")
+		if accessKey == "" || timestamp == "" || nonce == "" || signature == "" {
+			http.Error(w, `{"error":"Missing reseller authentication headers"}`, http.StatusUnauthorized)
+			return
+		}
+		if !resellerNoncePattern.MatchString(nonce) {
+			http.Error(w, `{"error":"Invalid nonce"}`, http.StatusUnauthorized)
+			return
+		}
+
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			http.Error(w, `{"error":"Invalid timestamp"}`, http.StatusUnauthorized)
+			return
+		}
+		skew := time.Since(time.Unix(ts, 0))
+		if skew > resellerSignatureMaxSkew || skew < -resellerSignatureMaxSkew {
+			http.Error(w, `{"error":"Request timestamp is too far from server time"}`, http.StatusUnauthorized)
+			return
+		}
+
+		var claims ResellerClaims
+		var secret, scopes string
+		var resellerActive bool
+		query := `SELECT k.id, k.reseller_id, k.secret, k.scopes, r.is_active
+			FROM reseller_api_keys k JOIN resellers r ON r.id = k.reseller_id
+			WHERE k.access_key = ? AND k.is_revoked = FALSE`
+		err = database.DB.QueryRow(query, accessKey).Scan(&claims.APIKeyID, &claims.ResellerID, &secret, &scopes, &resellerActive)
+		if err != nil {
+			http.Error(w, `{"error":"Invalid API key"}`, http.StatusUnauthorized)
+			return
+		}
+		if !resellerActive {
+			http.Error(w, `{"error":"Reseller account is disabled"}`, http.StatusForbidden)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, resellerMaxBodyBytes))
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, `{"error":"Request body is too large"}`, http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, `{"error":"Could not read request body"}`, http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		if !validResellerSignature(signature, secret, r.Method, r.URL.RequestURI(), timestamp, nonce, body) {
+			http.Error(w, `{"error":"Invalid signature"}`, http.StatusUnauthorized)
+			return
+		}
+
+		// Nonces only need to be kept as long as their timestamp is accepted.
+		database.DB.Exec("DELETE FROM reseller_nonces WHERE api_key_id = ? AND created_at < ?",
+			claims.APIKeyID, time.Now().Add(-2*resellerSignatureMaxSkew))
+		_, err = database.DB.Exec("INSERT INTO reseller_nonces (api_key_id, nonce, created_at) VALUES (?, ?, ?)", claims.APIKeyID, nonce, time.Now())
+		if err != nil {
+			var mysqlErr *mysql.MySQLError
+			if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+				http.Error(w, `{"error":"Nonce has already been used"}`, http.StatusUnauthorized)
+				return
+			}
+			http.Error(w, `{"error":"Server error"}`, http.StatusInternalServerError)
+			return
+		}
+
+		database.DB.Exec("UPDATE reseller_api_keys SET last_used_at = ? WHERE id = ?", time.Now(), claims.APIKeyID)
+
+		for _, s := range strings.Split(scopes, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				claims.Scopes = append(claims.Scopes, s)
+			}
+		}
+		ctx := context.WithValue(r.Context(), resellerContextKey, &claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func GetResellerFromContext(r *http.Request) (*ResellerClaims, bool) {
+	claims, ok := r.Context().Value(resellerContextKey).(*ResellerClaims)
+	return claims, ok
+}
@@ -0,0 +1,60 @@
+package middleware
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestValidResellerSignature(t *testing.T) {
+	const (
+		secret    = "s3cret"
+		method    = "POST"
+		uri       = "/api/reseller/keys?dry_run=1"
+		timestamp = "1700000000"
+		nonce     = "0123456789abcdef"
+	)
+	body := []byte(`{"quantity":5}`)
+	signature := hex.EncodeToString(resellerSignature(secret, method, uri, timestamp, nonce, body))
+
+	if !validResellerSignature(signature, secret, method, uri, timestamp, nonce, body) {
+		t.Fatal("signature of the request itself was rejected")
+	}
+
+	tests := []struct {
+		name                                      string
+		signature, secret, method, uri, ts, nonce string
+		body                                      string
+	}{
+		{"other secret", signature, "other", method, uri, timestamp, nonce, string(body)},
+		{"other method", signature, secret, "GET", uri, timestamp, nonce, string(body)},
+		{"other uri", signature, secret, method, "/api/reseller/keys", timestamp, nonce, string(body)},
+		{"other timestamp", signature, secret, method, uri, "1700000001", nonce, string(body)},
+		{"other nonce", signature, secret, method, uri, timestamp, "fedcba9876543210", string(body)},
+		{"other body", signature, secret, method, uri, timestamp, nonce, `{"quantity":500}`},
+		{"not hex", "zz" + signature[2:], secret, method, uri, timestamp, nonce, string(body)},
+		{"truncated", signature[:len(signature)-2], secret, method, uri, timestamp, nonce, string(body)},
+		{"empty", "", secret, method, uri, timestamp, nonce, string(body)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if validResellerSignature(tt.signature, tt.secret, tt.method, tt.uri, tt.ts, tt.nonce, []byte(tt.body)) {
+				t.Error("tampered request was accepted")
+			}
+		})
+	}
+}
+
+func TestResellerNoncePattern(t *testing.T) {
+	for nonce, want := range map[string]bool{
+		"0123456789abcdef":       true,
+		"AZaz09_-AZaz09_-":       true,
+		"short":                  false,
+		"0123456789abcde!":       false,
+		"0123456789abcdef ":      false,
+		string(make([]byte, 65)): false,
+	} {
+		if got := resellerNoncePattern.MatchString(nonce); got != want {
+			t.Errorf("nonce %q: got %v, want %v", nonce, got, want)
+		}
+	}
+}
@@ -10,24 +10,76 @@ type UserForAdmin struct {
 	SubscriptionExpiresAt *time.Time `json:"subscription_expires_at"`
 	IsBanned              bool       `json:"is_banned"`
 	Hwid                  *string    `json:"hwid"`
+	TrialOverride         *string    `json:"trial_override"`
 }
 
+const (
+	KeyTypeSubscription    = "subscription"
+	KeyTypeHwidReset       = "hwid_reset"
+	KeyTypeLifetime        = "lifetime"
+	KeyTypeProductUnlock   = "product_unlock"
+	KeyTypeRoleGrant       = "role_grant"
+	KeyTypeExtraDeviceSlot = "extra_device_slot"
+)
+
+// Roles a user can have. Role grant keys may hand out any of them but admin.
+const (
+	RoleUser   = "user"
+	RoleTester = "tester"
+	RoleAdmin  = "admin"
+)
+
+const (
+	TrialOverrideGrant = "grant"
+	TrialOverrideDeny  = "deny"
+)
+
 type KeyForAdmin struct {
 	ID           int        `json:"id"`
 	KeyString    string     `json:"key_string"`
+	KeyType      string     `json:"key_type"`
 	DurationDays int        `json:"duration_days"`
+	ProductID    *int       `json:"product_id"`
+	GrantRole    *string    `json:"grant_role"`
 	IsUsed       bool       `json:"is_used"`
 	UsedByUserID *int       `json:"used_by_user_id"`
 	UsedAt       *time.Time `json:"used_at"`
 }
 
+// Product is a store item. DurationDays is how long a purchase lasts, 0
+// meaning lifetime; Translations is only filled in for admins.
 type Product struct {
-	ID          int    `json:"id"`
+	ID              int                           `json:"id"`
+	Name            string                        `json:"name"`
+	Description     string                        `json:"description"`
+	Price           int                           `json:"price"`
+	IsFeatured      bool                          `json:"is_featured"`
+	SortIndex       int                           `json:"sort_index"`
+	KeyPrefix       string                        `json:"key_prefix,omitempty"`
+	DurationDays    int                           `json:"duration_days"`
+	Slug            string                        `json:"slug"`
+	ImageURL        string                        `json:"image_url"`
+	Currency        string                        `json:"currency"`
+	Status          string                        `json:"status"`
+	DurationOptions []ProductDurationOption       `json:"duration_options"`
+	Translations    map[string]ProductTranslation `json:"translations,omitempty"`
+}
+
+const (
+	ProductActive     = "active"
+	ProductHidden     = "hidden"
+	ProductComingSoon = "coming_soon"
+)
+
+type ProductTranslation struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
-	Price       int    `json:"price"`
-	IsFeatured  bool   `json:"is_featured"`
-	SortIndex   int    `json:"sort_index"`
+}
+
+type ProductDurationOption struct {
+	ID           int `json:"id"`
+	DurationDays int `json:"duration_days"`
+	Price        int `json:"price"`
 }
 
 type PaginatedUsersResponse struct {
@@ -40,4 +92,358 @@ type PaginatedKeysResponse struct {
 	Keys        []KeyForAdmin `json:"keys"`
 	TotalPages  int           `json:"total_pages"`
 	CurrentPage int           `json:"current_page"`
-}
\ No newline at end of file
+}
+
+const (
+	KeyJobPending   = "pending"
+	KeyJobRunning   = "running"
+	KeyJobCompleted = "completed"
+	KeyJobFailed    = "failed"
+)
+
+type KeyGenerationJob struct {
+	ID           int        `json:"id"`
+	Status       string     `json:"status"`
+	KeyType      string     `json:"key_type"`
+	DurationDays int        `json:"duration_days"`
+	ProductID    *int       `json:"product_id"`
+	GrantRole    *string    `json:"grant_role"`
+	KeyPrefix    string     `json:"key_prefix"`
+	GroupLength  int        `json:"group_length"`
+	Groups       int        `json:"groups"`
+	Quantity     int        `json:"quantity"`
+	Generated    int        `json:"generated"`
+	Error        *string    `json:"error"`
+	CreatedBy    int        `json:"created_by"`
+	CreatedAt    time.Time  `json:"created_at"`
+	FinishedAt   *time.Time `json:"finished_at"`
+	ExportURL    *string    `json:"export_url,omitempty"`
+}
+
+type KeyRedeemAttempt struct {
+	ID           int       `json:"id"`
+	UserID       int       `json:"user_id"`
+	IP           string    `json:"ip"`
+	KeyAttempted string    `json:"key_attempted"`
+	Result       string    `json:"result"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type PaginatedKeyAttemptsResponse struct {
+	Attempts    []KeyRedeemAttempt `json:"attempts"`
+	TotalPages  int                `json:"total_pages"`
+	CurrentPage int                `json:"current_page"`
+}
+
+type Reseller struct {
+	ID                int       `json:"id"`
+	Name              string    `json:"name"`
+	KeyQuota          int       `json:"key_quota"`
+	KeysIssued        int       `json:"keys_issued"`
+	AllowedKeyTypes   []string  `json:"allowed_key_types"`
+	AllowedProductIDs []int     `json:"allowed_product_ids"`
+	MaxDurationDays   int       `json:"max_duration_days"`
+	IsActive          bool      `json:"is_active"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+type KeyForReseller struct {
+	KeyString    string     `json:"key_string"`
+	KeyType      string     `json:"key_type"`
+	DurationDays int        `json:"duration_days"`
+	ProductID    *int       `json:"product_id"`
+	IsUsed       bool       `json:"is_used"`
+	UsedAt       *time.Time `json:"used_at"`
+}
+
+type PaginatedResellerKeysResponse struct {
+	Keys        []KeyForReseller `json:"keys"`
+	TotalPages  int              `json:"total_pages"`
+	CurrentPage int              `json:"current_page"`
+}
+
+const (
+	// SubscriptionSourceGlobal marks entitlements that come from the global
+	// users.subscription_expires_at rather than a subscriptions row.
+	SubscriptionSourceGlobal = "global"
+	SubscriptionSourceKey    = "key"
+	SubscriptionSourceAdmin  = "admin"
+	SubscriptionSourceTrial  = "trial"
+	SubscriptionSourceGift   = "gift"
+	SubscriptionSourceOrder  = "order"
+)
+
+type Subscription struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	ProductID int       `json:"product_id"`
+	StartsAt  time.Time `json:"starts_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Source    string    `json:"source"`
+	SourceRef *int      `json:"source_ref"`
+}
+
+type Entitlement struct {
+	ProductID   int       `json:"product_id"`
+	ProductName string    `json:"product_name"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	Lifetime    bool      `json:"lifetime"`
+	Source      string    `json:"source"`
+}
+
+const (
+	SubscriptionActionAddTime    = "add_time"
+	SubscriptionActionRemoveTime = "remove_time"
+	SubscriptionActionSetExpiry  = "set_expiry"
+	SubscriptionActionLifetime   = "lifetime"
+	SubscriptionActionFreeze     = "freeze"
+	SubscriptionActionUnfreeze   = "unfreeze"
+	SubscriptionActionReset      = "reset"
+	SubscriptionActionGiftSent   = "gift_sent"
+	SubscriptionActionGiftIn     = "gift_received"
+	SubscriptionActionReferral   = "referral_bonus"
+)
+
+type SubscriptionAdjustment struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id"`
+	ProductID    *int       `json:"product_id"`
+	AdminID      *int       `json:"admin_id"`
+	Action       string     `json:"action"`
+	Days         *int       `json:"days"`
+	OldExpiresAt *time.Time `json:"old_expires_at"`
+	NewExpiresAt *time.Time `json:"new_expires_at"`
+	Reason       string     `json:"reason"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+const (
+	GiftKindKey  = "key"
+	GiftKindDays = "days"
+
+	GiftPending   = "pending"
+	GiftCompleted = "completed"
+	GiftCancelled = "cancelled"
+)
+
+type GiftTransfer struct {
+	ID          int        `json:"id"`
+	Direction   string     `json:"direction"`
+	Sender      string     `json:"sender"`
+	Recipient   string     `json:"recipient"`
+	Kind        string     `json:"kind"`
+	KeyString   *string    `json:"key_string,omitempty"`
+	ProductID   *int       `json:"product_id"`
+	Days        *int       `json:"days"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	ConfirmedAt *time.Time `json:"confirmed_at"`
+}
+
+type OwnedKey struct {
+	KeyString    string `json:"key_string"`
+	KeyType      string `json:"key_type"`
+	DurationDays int    `json:"duration_days"`
+	ProductID    *int   `json:"product_id"`
+}
+
+const (
+	// OrderDelivery* say what a paid order issues: time on the buyer's
+	// subscription, an activation key the buyer owns, or wallet balance.
+	OrderDeliverySubscription = "subscription"
+	OrderDeliveryKey          = "key"
+	OrderDeliveryBalance      = "balance"
+
+	OrderPending  = "pending"
+	OrderPaid     = "paid"
+	OrderCanceled = "canceled"
+	OrderFailed   = "failed"
+	// OrderPaidNeedsRefund is an order the provider reports paid after it was
+	// already failed or canceled. Nothing was issued; the money goes back.
+	OrderPaidNeedsRefund = "paid_needs_refund"
+)
+
+type Order struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"user_id"`
+	ProductID    *int       `json:"product_id"`
+	Amount       int        `json:"amount"`
+	Discount     int        `json:"discount"`
+	PromoCode    *string    `json:"promo_code,omitempty"`
+	Currency     string     `json:"currency"`
+	DurationDays int        `json:"duration_days"`
+	Delivery     string     `json:"delivery"`
+	Status       string     `json:"status"`
+	Provider     string     `json:"provider"`
+	PaymentURL   *string    `json:"payment_url,omitempty"`
+	KeyString    *string    `json:"key_string,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	PaidAt       *time.Time `json:"paid_at"`
+}
+
+const (
+	PromoDiscountPercent = "percent"
+	PromoDiscountFixed   = "fixed"
+)
+
+type PromoCode struct {
+	ID             int        `json:"id"`
+	Code           string     `json:"code"`
+	DiscountType   string     `json:"discount_type"`
+	DiscountValue  int        `json:"discount_value"`
+	MaxUses        *int       `json:"max_uses"`
+	MaxUsesPerUser *int       `json:"max_uses_per_user"`
+	Uses           int        `json:"uses"`
+	ValidFrom      *time.Time `json:"valid_from"`
+	ValidUntil     *time.Time `json:"valid_until"`
+	IsActive       bool       `json:"is_active"`
+	ProductIDs     []int      `json:"product_ids"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// OrderQuote is what a product costs the user before checkout.
+type OrderQuote struct {
+	ProductID    int     `json:"product_id"`
+	DurationDays int     `json:"duration_days"`
+	Price        int     `json:"price"`
+	Discount     int     `json:"discount"`
+	Amount       int     `json:"amount"`
+	Currency     string  `json:"currency"`
+	PromoCode    *string `json:"promo_code,omitempty"`
+}
+
+const (
+	ReferralPending  = "pending"
+	ReferralReview   = "review"
+	ReferralRewarded = "rewarded"
+	ReferralRejected = "rejected"
+
+	ReferralRejectSameHWID = "same_hwid"
+	ReferralRejectSameIP   = "same_ip"
+	ReferralRejectAdmin    = "admin"
+)
+
+type Referral struct {
+	Username    string     `json:"username"`
+	Status      string     `json:"status"`
+	RewardDays  *int       `json:"reward_days"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+// AdminReferral is a referral as admins see it when reviewing.
+type AdminReferral struct {
+	ID           int        `json:"id"`
+	ReferrerID   int        `json:"referrer_id"`
+	Referrer     string     `json:"referrer"`
+	ReferredID   int        `json:"referred_id"`
+	Referred     string     `json:"referred"`
+	Status       string     `json:"status"`
+	ReviewReason *string    `json:"review_reason"`
+	RejectReason *string    `json:"reject_reason"`
+	RewardDays   *int       `json:"reward_days"`
+	CreatedAt    time.Time  `json:"created_at"`
+	CompletedAt  *time.Time `json:"completed_at"`
+}
+
+type ReferralStats struct {
+	ReferralCode string     `json:"referral_code"`
+	RewardDays   int        `json:"reward_days"`
+	Invited      int        `json:"invited"`
+	Pending      int        `json:"pending"`
+	Rewarded     int        `json:"rewarded"`
+	Rejected     int        `json:"rejected"`
+	DaysEarned   int        `json:"days_earned"`
+	Referrals    []Referral `json:"referrals"`
+}
+
+const (
+	WalletAccountPayments = "payments"
+	WalletAccountAdmin    = "admin"
+	WalletAccountSales    = "sales"
+
+	LedgerKindTopUp       = "top_up"
+	LedgerKindPurchase    = "purchase"
+	LedgerKindAdminCredit = "admin_credit"
+)
+
+type WalletTransaction struct {
+	ID           int       `json:"id"`
+	Kind         string    `json:"kind"`
+	Amount       int64     `json:"amount"`
+	BalanceAfter int64     `json:"balance_after"`
+	Reference    *string   `json:"reference"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type Wallet struct {
+	Balance      int64               `json:"balance"`
+	Currency     string              `json:"currency"`
+	Transactions []WalletTransaction `json:"transactions"`
+	TotalPages   int                 `json:"total_pages"`
+	CurrentPage  int                 `json:"current_page"`
+}
+
+// WalletAuditIssue is an account whose stored balance disagrees with its
+// ledger entries, or a transaction whose entries do not sum to zero.
+type WalletAuditIssue struct {
+	AccountID     *int   `json:"account_id,omitempty"`
+	TransactionID *int   `json:"transaction_id,omitempty"`
+	Expected      int64  `json:"expected"`
+	Actual        int64  `json:"actual"`
+	Problem       string `json:"problem"`
+}
+
+const DefaultReleaseChannel = "stable"
+
+// Release is a published, immutable launcher build.
+type Release struct {
+	ID                 int       `json:"id"`
+	Version            string    `json:"version"`
+	Build              string    `json:"build"`
+	Changelog          string    `json:"changelog"`
+	MinLauncherVersion *string   `json:"min_launcher_version"`
+	ManifestHash       *string   `json:"manifest_hash"`
+	CreatedBy          *int      `json:"created_by"`
+	CreatedAt          time.Time `json:"created_at"`
+}
+
+// ReleaseChannel is a launcher release channel. AllowedRoles nil means the
+// channel is open to everyone. While Rollout is set, that share of the
+// channel's users gets the rollout release instead of Release.
+type ReleaseChannel struct {
+	Name         string          `json:"name"`
+	ReleaseID    *int            `json:"release_id"`
+	Release      *string         `json:"release"`
+	Build        *string         `json:"build"`
+	Rollout      *ReleaseRollout `json:"rollout"`
+	AllowedRoles []string        `json:"allowed_roles"`
+	Members      []int           `json:"members,omitempty"`
+	UpdatedAt    time.Time       `json:"updated_at"`
+}
+
+type ReleaseRollout struct {
+	ReleaseID int    `json:"release_id"`
+	Release   string `json:"release"`
+	Percent   int    `json:"percent"`
+}
+
+const (
+	ReleaseActionSet      = "set"
+	ReleaseActionPromote  = "promote"
+	ReleaseActionRollout  = "rollout"
+	ReleaseActionRollback = "rollback"
+)
+
+type ReleaseChannelHistory struct {
+	ID             int       `json:"id"`
+	Channel        string    `json:"channel"`
+	Action         string    `json:"action"`
+	Release        *string   `json:"release"`
+	Build          string    `json:"build"`
+	RolloutPercent *int      `json:"rollout_percent"`
+	PromotedFrom   *string   `json:"promoted_from"`
+	AdminID        *int      `json:"admin_id"`
+	CreatedAt      time.Time `json:"created_at"`
+}
@@ -20,6 +20,15 @@ import (
 func main() {
 	config.LoadConfig()
 	database.ConnectDB()
+	handler.ResumeKeyGenerationJobs()
+
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	handler.StartExpiryReminders(jobsCtx)
+	handler.StartManifestWatcher(jobsCtx)
+	handler.StartFileStoreSync(jobsCtx)
+	handler.StartOrderExpiry(jobsCtx)
+	handler.StartReleasePatcher(jobsCtx)
 
 	r := mux.NewRouter()
 
@@ -34,33 +43,110 @@ func main() {
 	r.HandleFunc("/api/login", handler.LoginHandler).Methods("POST")
 	r.HandleFunc("/api/validate-token", handler.ValidateTokenHandler).Methods("POST")
 	r.HandleFunc("/api/products", handler.GetProductsHandler).Methods("GET")
+	r.HandleFunc("/api/products/{slug}", handler.GetProductHandler).Methods("GET")
+	r.PathPrefix("/api/uploads/").HandlerFunc(handler.UploadsHandler).Methods("GET")
+	r.PathPrefix("/api/launcher/files/").HandlerFunc(handler.SignedFileHandler).Methods("GET", "HEAD")
 	r.HandleFunc("/api/forgot-password", handler.ForgotPasswordHandler).Methods("POST")
 	r.HandleFunc("/api/reset-password", handler.ResetPasswordHandler).Methods("POST")
+	r.HandleFunc("/api/payments/webhook/{provider}", handler.PaymentWebhookHandler).Methods("POST")
+	if config.Cfg.PaymentProvider == "fake" {
+		handler.EnableFakePayments()
+		r.HandleFunc("/api/payments/fake/checkout", handler.FakeCheckoutHandler).Methods("GET")
+		r.HandleFunc("/api/payments/fake/checkout", handler.FakeCheckoutSubmitHandler).Methods("POST")
+	}
 
 	protectedRoutes := r.PathPrefix("/api").Subrouter()
 	protectedRoutes.Use(middleware.JWTMiddleware)
 
 	protectedRoutes.HandleFunc("/profile", handler.ProfileHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/profile/notifications", handler.UpdateNotificationSettingsHandler).Methods("PATCH")
+	protectedRoutes.HandleFunc("/profile/referrals", handler.GetReferralStatsHandler).Methods("GET")
 	protectedRoutes.HandleFunc("/keys/activate", handler.ActivateKeyHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/trial", handler.GetTrialStatusHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/trial/start", handler.StartTrialHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/keys", handler.GetOwnedKeysHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/gifts", handler.GetGiftsHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/gifts", handler.CreateGiftHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/gifts/{id}/confirm", handler.ConfirmGiftHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/gifts/{id}/cancel", handler.CancelGiftHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/orders", handler.GetOrdersHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/orders", handler.CreateOrderHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/orders/quote", handler.QuoteOrderHandler).Methods("POST")
+	protectedRoutes.HandleFunc("/orders/{id}", handler.GetOrderHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/wallet", handler.GetWalletHandler).Methods("GET")
+	protectedRoutes.HandleFunc("/wallet/top-up", handler.TopUpWalletHandler).Methods("POST")
 
-	protectedRoutes.HandleFunc("/launcher/manifest", handler.GetManifestHandler).Methods("GET")
-	protectedRoutes.PathPrefix("/launcher/download/").HandlerFunc(handler.DownloadFileHandler).Methods("GET")
+	protectedRoutes.Handle("/launcher/manifest", middleware.LauncherAccessMiddleware(http.HandlerFunc(handler.GetManifestHandler))).Methods("GET")
+	protectedRoutes.HandleFunc("/launcher/channels", handler.GetReleaseChannelsHandler).Methods("GET")
+	protectedRoutes.Handle("/launcher/release", middleware.LauncherAccessMiddleware(http.HandlerFunc(handler.GetReleaseHandler))).Methods("GET")
+	protectedRoutes.HandleFunc("/launcher/signing-keys", handler.GetManifestKeysHandler).Methods("GET")
+	protectedRoutes.PathPrefix("/launcher/download/").Handler(middleware.LauncherAccessMiddleware(http.HandlerFunc(handler.DownloadFileHandler))).Methods("GET")
+	protectedRoutes.Handle("/launcher/chunks/{hash}", middleware.LauncherAccessMiddleware(http.HandlerFunc(handler.GetChunkHandler))).Methods("GET")
 
 	adminRoutes := r.PathPrefix("/api/admin").Subrouter()
 	adminRoutes.Use(middleware.JWTMiddleware, middleware.AdminMiddleware)
 	adminRoutes.HandleFunc("/users", handler.AdminGetUsersHandler).Methods("GET")
 	adminRoutes.HandleFunc("/keys", handler.AdminGetKeysHandler).Methods("GET")
+	adminRoutes.HandleFunc("/products", handler.AdminGetProductsHandler).Methods("GET")
 	adminRoutes.HandleFunc("/products", handler.AdminCreateProductHandler).Methods("POST")
+	adminRoutes.HandleFunc("/products/reorder", handler.AdminReorderProductsHandler).Methods("POST")
+	adminRoutes.HandleFunc("/products/{id}/image", handler.AdminUploadProductImageHandler).Methods("POST")
 	adminRoutes.HandleFunc("/keys", handler.AdminCreateKeyHandler).Methods("POST")
+	adminRoutes.HandleFunc("/key-jobs", handler.AdminCreateKeyJobHandler).Methods("POST")
+	adminRoutes.HandleFunc("/key-jobs/{id}", handler.AdminGetKeyJobHandler).Methods("GET")
+	adminRoutes.HandleFunc("/key-jobs/{id}/export", handler.AdminExportKeyJobHandler).Methods("GET")
+	adminRoutes.HandleFunc("/key-attempts", handler.AdminGetKeyAttemptsHandler).Methods("GET")
 	adminRoutes.HandleFunc("/users/{id}/status", handler.AdminUpdateUserStatusHandler).Methods("PATCH")
 	adminRoutes.HandleFunc("/users/{id}", handler.AdminDeleteUserHandler).Methods("DELETE")
-	adminRoutes.HandleFunc("/products/{id}", handler.AdminUpdateProductHandler).Methods("PUT")
+	adminRoutes.HandleFunc("/users/{id}/subscription/history", handler.AdminGetSubscriptionHistoryHandler).Methods("GET")
+	adminRoutes.HandleFunc("/users/{id}/subscription/{action}", handler.AdminAdjustSubscriptionHandler).Methods("POST")
+	adminRoutes.HandleFunc("/products/{id}", handler.AdminUpdateProductHandler).Methods("PUT", "PATCH")
 	adminRoutes.HandleFunc("/products/{id}", handler.AdminDeleteProductHandler).Methods("DELETE")
 
+	adminRoutes.HandleFunc("/users/{id}/wallet", handler.AdminGetUserWalletHandler).Methods("GET")
+	adminRoutes.HandleFunc("/users/{id}/wallet", handler.AdminCreditWalletHandler).Methods("POST")
+	adminRoutes.HandleFunc("/wallet/audit", handler.AdminAuditWalletHandler).Methods("GET")
+
+	adminRoutes.HandleFunc("/referrals", handler.AdminGetReferralsHandler).Methods("GET")
+	adminRoutes.HandleFunc("/referrals/{id}/{action}", handler.AdminReviewReferralHandler).Methods("POST")
+
+	adminRoutes.HandleFunc("/promo-codes", handler.AdminGetPromoCodesHandler).Methods("GET")
+	adminRoutes.HandleFunc("/promo-codes", handler.AdminCreatePromoCodeHandler).Methods("POST")
+	adminRoutes.HandleFunc("/promo-codes/{id}", handler.AdminUpdatePromoCodeHandler).Methods("PATCH")
+	adminRoutes.HandleFunc("/promo-codes/{id}", handler.AdminDeletePromoCodeHandler).Methods("DELETE")
+
+	adminRoutes.HandleFunc("/launcher/rescan", handler.AdminRescanManifestHandler).Methods("POST")
+	adminRoutes.HandleFunc("/launcher/releases", handler.AdminGetReleasesHandler).Methods("GET")
+	adminRoutes.HandleFunc("/launcher/releases", handler.AdminPublishReleaseHandler).Methods("POST")
+	adminRoutes.HandleFunc("/launcher/releases/{version}/manifest", handler.AdminGetReleaseManifestHandler).Methods("GET")
+	adminRoutes.HandleFunc("/launcher/releases/{version}/signature", handler.AdminSignReleaseHandler).Methods("PUT")
+	adminRoutes.HandleFunc("/launcher/channels", handler.AdminGetReleaseChannelsHandler).Methods("GET")
+	adminRoutes.HandleFunc("/launcher/channels/{name}", handler.AdminUpdateReleaseChannelHandler).Methods("PUT")
+	adminRoutes.HandleFunc("/launcher/channels/{name}/promote", handler.AdminPromoteReleaseChannelHandler).Methods("POST")
+	adminRoutes.HandleFunc("/launcher/channels/{name}/rollout", handler.AdminRolloutReleaseHandler).Methods("POST")
+	adminRoutes.HandleFunc("/launcher/channels/{name}/rollback", handler.AdminRollbackReleaseChannelHandler).Methods("POST")
+	adminRoutes.HandleFunc("/launcher/channels/{name}/history", handler.AdminGetReleaseChannelHistoryHandler).Methods("GET")
+	adminRoutes.HandleFunc("/launcher/channels/{name}/members/{userId}", handler.AdminAddReleaseChannelMemberHandler).Methods("PUT")
+	adminRoutes.HandleFunc("/launcher/channels/{name}/members/{userId}", handler.AdminRemoveReleaseChannelMemberHandler).Methods("DELETE")
+	adminRoutes.HandleFunc("/resellers", handler.AdminGetResellersHandler).Methods("GET")
+	adminRoutes.HandleFunc("/resellers", handler.AdminCreateResellerHandler).Methods("POST")
+	adminRoutes.HandleFunc("/resellers/{id}", handler.AdminUpdateResellerHandler).Methods("PATCH")
+	adminRoutes.HandleFunc("/resellers/{id}/api-keys", handler.AdminCreateResellerAPIKeyHandler).Methods("POST")
+	adminRoutes.HandleFunc("/resellers/{id}/api-keys/{keyId}", handler.AdminRevokeResellerAPIKeyHandler).Methods("DELETE")
+
+	resellerRoutes := r.PathPrefix("/api/reseller").Subrouter()
+	resellerRoutes.Use(middleware.ResellerHMACMiddleware)
+	resellerRoutes.HandleFunc("/quota", handler.ResellerQuotaHandler).Methods("GET")
+	resellerRoutes.HandleFunc("/keys", handler.ResellerGetKeysHandler).Methods("GET")
+	resellerRoutes.HandleFunc("/keys", handler.ResellerAllocateKeysHandler).Methods("POST")
+
 	allowedOrigins := handlers.AllowedOrigins([]string{"http://localhost:3000", "null"}) 
 	allowedMethods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE"})
-	allowedHeaders := handlers.AllowedHeaders([]string{"Authorization", "Content-Type"})
-	corsRouter := handlers.CORS(allowedOrigins, allowedMethods, allowedHeaders)(r)
+	allowedHeaders := handlers.AllowedHeaders([]string{"Authorization", "Content-Type", "Idempotency-Key", "X-Launcher-Version", "X-HWID", "If-None-Match"})
+	// Launchers verify manifests with these, and run at origin "null".
+	exposedHeaders := handlers.ExposedHeaders([]string{"ETag", "X-Release-Version", "X-Release-Channel", "X-Min-Launcher-Version",
+		"X-Manifest-Signature", "X-Manifest-Key-Id", "X-Manifest-Issued-At", "X-Manifest-Expires-At"})
+	corsRouter := handlers.CORS(allowedOrigins, allowedMethods, allowedHeaders, exposedHeaders)(r)
 
 	server := &http.Server{Addr: config.Cfg.Port, Handler: corsRouter}
 
@@ -75,6 +161,7 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Println("Server is shutting down...")
+	stopJobs()
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := server.Shutdown(ctx); err != nil {
@@ -0,0 +1,30 @@
+-- Explicit activation key types. Until now a key with duration_days = 0
+-- silently meant "reset HWID".
+ALTER TABLE activation_keys
+    ADD COLUMN key_type VARCHAR(32) NOT NULL DEFAULT 'subscription',
+    ADD COLUMN product_id INT NULL,
+    ADD COLUMN grant_role VARCHAR(32) NULL;
+
+UPDATE activation_keys SET key_type = 'hwid_reset' WHERE duration_days = 0;
+
+-- Lifetime access is stored as 9999-12-31, which TIMESTAMP cannot hold.
+ALTER TABLE users
+    MODIFY COLUMN subscription_expires_at DATETIME NULL,
+    ADD COLUMN extra_device_slots INT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS user_devices (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    hwid VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_user_devices (user_id, hwid)
+);
+
+CREATE TABLE IF NOT EXISTS user_products (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    product_id INT NOT NULL,
+    key_id INT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_user_products (user_id, product_id)
+);
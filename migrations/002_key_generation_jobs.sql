@@ -0,0 +1,19 @@
+CREATE TABLE IF NOT EXISTS key_generation_jobs (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    key_type VARCHAR(32) NOT NULL,
+    duration_days INT NOT NULL DEFAULT 0,
+    product_id INT NULL,
+    grant_role VARCHAR(32) NULL,
+    quantity INT NOT NULL,
+    generated INT NOT NULL DEFAULT 0,
+    error TEXT NULL,
+    created_by INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished_at DATETIME NULL
+);
+
+ALTER TABLE activation_keys
+    ADD COLUMN job_id INT NULL,
+    ADD UNIQUE KEY uq_activation_keys_key_string (key_string),
+    ADD KEY idx_activation_keys_job_id (job_id);
@@ -0,0 +1,9 @@
+-- Per-batch and per-product key formats. Keys issued before this migration
+-- keep their hex format and are still accepted on redeem.
+ALTER TABLE key_generation_jobs
+    ADD COLUMN key_prefix VARCHAR(8) NOT NULL DEFAULT '',
+    ADD COLUMN group_length INT NOT NULL DEFAULT 5,
+    ADD COLUMN group_count INT NOT NULL DEFAULT 5;
+
+ALTER TABLE products
+    ADD COLUMN key_prefix VARCHAR(8) NULL;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS key_redeem_attempts (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    ip VARCHAR(64) NOT NULL,
+    key_attempted VARCHAR(64) NOT NULL,
+    result VARCHAR(16) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_key_redeem_attempts_user (user_id, created_at),
+    KEY idx_key_redeem_attempts_ip (ip, created_at)
+);
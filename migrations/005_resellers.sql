@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS resellers (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(255) NOT NULL,
+    key_quota INT NOT NULL DEFAULT 0,
+    keys_issued INT NOT NULL DEFAULT 0,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- The secret has to be readable to verify HMAC signatures, so it is stored
+-- as issued. It is only shown to the admin once, when the key is created.
+CREATE TABLE IF NOT EXISTS reseller_api_keys (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    reseller_id INT NOT NULL,
+    access_key VARCHAR(64) NOT NULL,
+    secret VARCHAR(128) NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    is_revoked BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME NULL,
+    UNIQUE KEY uq_reseller_api_keys_access_key (access_key)
+);
+
+ALTER TABLE activation_keys
+    ADD COLUMN reseller_id INT NULL,
+    ADD KEY idx_activation_keys_reseller_id (reseller_id);
@@ -0,0 +1,21 @@
+-- Per-product subscriptions. users.subscription_expires_at stays the global
+-- subscription that covers every product; rows here cover a single product.
+-- Extensions append a row starting where the previous one ends, so the table
+-- doubles as the subscription history.
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    product_id INT NOT NULL,
+    starts_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    source VARCHAR(32) NOT NULL,
+    source_ref INT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_subscriptions_user_product (user_id, product_id, expires_at)
+);
+
+-- Product unlocks become lifetime subscriptions to that product.
+INSERT INTO subscriptions (user_id, product_id, starts_at, expires_at, source, source_ref)
+SELECT user_id, product_id, created_at, '9999-12-31 00:00:00', 'key', key_id FROM user_products;
+
+DROP TABLE user_products;
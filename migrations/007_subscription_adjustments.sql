@@ -0,0 +1,27 @@
+-- Audit log of manual subscription changes. product_id NULL means the global
+-- subscription in users.subscription_expires_at.
+CREATE TABLE IF NOT EXISTS subscription_adjustments (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    product_id INT NULL,
+    admin_id INT NULL,
+    action VARCHAR(32) NOT NULL,
+    days INT NULL,
+    old_expires_at DATETIME NULL,
+    new_expires_at DATETIME NULL,
+    reason VARCHAR(500) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_subscription_adjustments_user (user_id, created_at)
+);
+
+-- A frozen subscription is ended immediately and its remaining time is kept
+-- here until it is unfrozen.
+CREATE TABLE IF NOT EXISTS subscription_freezes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    product_id INT NULL,
+    frozen_at DATETIME NOT NULL,
+    remaining_seconds BIGINT NOT NULL,
+    unfrozen_at DATETIME NULL,
+    KEY idx_subscription_freezes_user (user_id, unfrozen_at)
+);
@@ -0,0 +1,18 @@
+-- One row per trial started. HWID and email are kept so the same machine or
+-- mailbox cannot start a second trial from a new account.
+CREATE TABLE IF NOT EXISTS trial_claims (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    hwid VARCHAR(255) NOT NULL,
+    email VARCHAR(255) NOT NULL,
+    days INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_trial_claims_user (user_id),
+    KEY idx_trial_claims_hwid (hwid),
+    KEY idx_trial_claims_email (email)
+);
+
+-- Admin override: 'grant' allows one more trial regardless of history,
+-- 'deny' blocks trials for the user. NULL applies the normal rules.
+ALTER TABLE users
+    ADD COLUMN trial_override VARCHAR(16) NULL;
@@ -0,0 +1,21 @@
+-- Keys bought or gifted belong to a user until they are redeemed.
+ALTER TABLE activation_keys
+    ADD COLUMN owner_user_id INT NULL,
+    ADD KEY idx_activation_keys_owner (owner_user_id);
+
+CREATE TABLE IF NOT EXISTS gift_transfers (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    sender_id INT NOT NULL,
+    recipient_id INT NOT NULL,
+    kind VARCHAR(16) NOT NULL,
+    key_id INT NULL,
+    product_id INT NULL,
+    days INT NULL,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    confirmation_code VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at DATETIME NOT NULL,
+    confirmed_at DATETIME NULL,
+    KEY idx_gift_transfers_sender (sender_id, created_at),
+    KEY idx_gift_transfers_recipient (recipient_id, created_at)
+);
@@ -0,0 +1,15 @@
+-- One row per reminder sent. product_id 0 is the global subscription; a
+-- reminder window is identified by the expiry it warns about and its offset,
+-- so extending a subscription opens new windows.
+CREATE TABLE IF NOT EXISTS subscription_reminders (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    product_id INT NOT NULL DEFAULT 0,
+    expires_at DATETIME NOT NULL,
+    offset_days INT NOT NULL,
+    sent_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_subscription_reminders (user_id, product_id, expires_at, offset_days)
+);
+
+ALTER TABLE users
+    ADD COLUMN expiry_reminders_opt_out BOOLEAN NOT NULL DEFAULT FALSE;
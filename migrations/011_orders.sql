@@ -0,0 +1,33 @@
+-- How long a purchase of the product lasts; 0 means lifetime.
+ALTER TABLE products
+    ADD COLUMN duration_days INT NOT NULL DEFAULT 30;
+
+CREATE TABLE IF NOT EXISTS orders (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    product_id INT NOT NULL,
+    amount INT NOT NULL,
+    currency VARCHAR(3) NOT NULL,
+    duration_days INT NOT NULL,
+    delivery VARCHAR(16) NOT NULL DEFAULT 'subscription',
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    provider VARCHAR(32) NOT NULL,
+    provider_payment_id VARCHAR(255) NULL,
+    payment_url TEXT NULL,
+    key_id INT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    paid_at DATETIME NULL,
+    UNIQUE KEY uq_orders_payment (provider, provider_payment_id),
+    INDEX idx_orders_user (user_id, created_at)
+);
+
+-- Webhook events already handled, so redelivered events are applied once.
+CREATE TABLE IF NOT EXISTS payment_events (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    provider VARCHAR(32) NOT NULL,
+    event_id VARCHAR(255) NOT NULL,
+    order_id INT NOT NULL,
+    status VARCHAR(16) NOT NULL,
+    received_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_payment_events (provider, event_id)
+);
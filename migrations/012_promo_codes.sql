@@ -0,0 +1,26 @@
+CREATE TABLE IF NOT EXISTS promo_codes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    code VARCHAR(64) NOT NULL UNIQUE,
+    discount_type VARCHAR(16) NOT NULL,
+    discount_value INT NOT NULL,
+    -- NULL means unlimited.
+    max_uses INT NULL,
+    max_uses_per_user INT NULL,
+    -- Orders holding the code; released again when an order is not paid.
+    uses INT NOT NULL DEFAULT 0,
+    valid_from DATETIME NULL,
+    valid_until DATETIME NULL,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- A code with no rows here applies to every product.
+CREATE TABLE IF NOT EXISTS promo_code_products (
+    promo_code_id INT NOT NULL,
+    product_id INT NOT NULL,
+    PRIMARY KEY (promo_code_id, product_id)
+);
+
+ALTER TABLE orders
+    ADD COLUMN promo_code_id INT NULL,
+    ADD COLUMN discount INT NOT NULL DEFAULT 0;
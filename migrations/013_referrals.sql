@@ -0,0 +1,19 @@
+ALTER TABLE users
+    ADD COLUMN referral_code VARCHAR(16) NULL UNIQUE,
+    ADD COLUMN registration_ip VARCHAR(64) NULL,
+    ADD COLUMN last_login_ip VARCHAR(64) NULL;
+
+-- One row per referred user. A referral stays pending until the referred user
+-- first redeems a paid key or pays for an order, then it is either rewarded or
+-- rejected as a self-referral.
+CREATE TABLE IF NOT EXISTS referrals (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    referrer_id INT NOT NULL,
+    referred_id INT NOT NULL UNIQUE,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    reject_reason VARCHAR(32) NULL,
+    reward_days INT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_at DATETIME NULL,
+    KEY idx_referrals_referrer (referrer_id)
+);
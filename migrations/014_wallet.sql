@@ -0,0 +1,36 @@
+-- Double-entry ledger behind user balances. Every transaction's entries sum
+-- to zero; accounts.balance is the running total of an account's entries.
+-- System accounts (user_id NULL) stand for money outside the users' wallets
+-- and may go negative; user accounts may not.
+CREATE TABLE IF NOT EXISTS wallet_accounts (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NULL UNIQUE,
+    code VARCHAR(32) NULL UNIQUE,
+    balance BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+INSERT IGNORE INTO wallet_accounts (code) VALUES ('payments'), ('admin'), ('sales');
+
+CREATE TABLE IF NOT EXISTS ledger_transactions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    idempotency_key VARCHAR(191) NOT NULL UNIQUE,
+    kind VARCHAR(32) NOT NULL,
+    reference VARCHAR(255) NULL,
+    created_by INT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS ledger_entries (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    transaction_id INT NOT NULL,
+    account_id INT NOT NULL,
+    amount BIGINT NOT NULL,
+    balance_after BIGINT NOT NULL,
+    KEY idx_ledger_entries_account (account_id, id),
+    KEY idx_ledger_entries_transaction (transaction_id)
+);
+
+-- Balance top-ups are orders without a product.
+ALTER TABLE orders
+    MODIFY product_id INT NULL;
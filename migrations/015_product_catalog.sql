@@ -0,0 +1,26 @@
+ALTER TABLE products
+    ADD COLUMN slug VARCHAR(64) NULL UNIQUE,
+    ADD COLUMN image_url VARCHAR(512) NULL,
+    -- NULL means the store's default currency.
+    ADD COLUMN currency VARCHAR(3) NULL,
+    -- active, hidden or coming_soon. Hidden products are left out of the
+    -- public listing; coming_soon ones are listed but cannot be bought.
+    ADD COLUMN status VARCHAR(16) NOT NULL DEFAULT 'active';
+
+CREATE TABLE IF NOT EXISTS product_translations (
+    product_id INT NOT NULL,
+    language VARCHAR(8) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    description TEXT NOT NULL,
+    PRIMARY KEY (product_id, language)
+);
+
+-- Alternative durations a product can be bought for, each with its own price.
+CREATE TABLE IF NOT EXISTS product_duration_options (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    product_id INT NOT NULL,
+    duration_days INT NOT NULL,
+    price INT NOT NULL,
+    sort_index INT NOT NULL DEFAULT 0,
+    KEY idx_product_duration_options_product (product_id, sort_index)
+);
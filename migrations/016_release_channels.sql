@@ -0,0 +1,34 @@
+-- Launcher release channels. Each channel points at one build, a directory
+-- under game_files/builds. allowed_roles NULL opens a channel to everyone;
+-- otherwise only users with one of the listed roles, listed members and
+-- admins may use it. A stable channel without a build serves the flat
+-- game_files directory, as before channels existed.
+CREATE TABLE IF NOT EXISTS release_channels (
+    name VARCHAR(32) PRIMARY KEY,
+    build VARCHAR(64) NULL,
+    allowed_roles VARCHAR(255) NULL,
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS release_channel_members (
+    channel VARCHAR(32) NOT NULL,
+    user_id INT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (channel, user_id)
+);
+
+-- Every build a channel has pointed at, newest last.
+CREATE TABLE IF NOT EXISTS release_channel_history (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    channel VARCHAR(32) NOT NULL,
+    build VARCHAR(64) NOT NULL,
+    promoted_from VARCHAR(32) NULL,
+    admin_id INT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    KEY idx_release_channel_history_channel (channel, id)
+);
+
+INSERT IGNORE INTO release_channels (name, allowed_roles) VALUES
+    ('stable', NULL),
+    ('beta', 'tester'),
+    ('dev', '');
@@ -0,0 +1,37 @@
+-- Published launcher releases. A release is immutable: its build directory
+-- may not change after publishing, which manifest_hash records. Channels now
+-- point at releases instead of bare builds, and may roll a second release
+-- out to a percentage of their users.
+CREATE TABLE IF NOT EXISTS releases (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    version VARCHAR(64) NOT NULL,
+    build VARCHAR(64) NOT NULL,
+    changelog TEXT NULL,
+    min_launcher_version VARCHAR(32) NULL,
+    manifest_hash VARCHAR(64) NULL,
+    created_by INT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_releases_version (version),
+    UNIQUE KEY uq_releases_build (build)
+);
+
+-- Builds channels already served become releases named after the build.
+INSERT IGNORE INTO releases (version, build)
+    SELECT DISTINCT build, build FROM release_channel_history;
+
+ALTER TABLE release_channels
+    ADD COLUMN release_id INT NULL,
+    ADD COLUMN rollout_release_id INT NULL,
+    ADD COLUMN rollout_percent INT NOT NULL DEFAULT 0;
+
+UPDATE release_channels c JOIN releases r ON r.build = c.build SET c.release_id = r.id;
+
+ALTER TABLE release_channels DROP COLUMN build;
+
+ALTER TABLE release_channel_history
+    ADD COLUMN release_id INT NULL,
+    ADD COLUMN action VARCHAR(16) NOT NULL DEFAULT 'set',
+    ADD COLUMN rollout_percent INT NULL;
+
+UPDATE release_channel_history h JOIN releases r ON r.build = h.build SET h.release_id = r.id;
+UPDATE release_channel_history SET action = 'promote' WHERE promoted_from IS NOT NULL;
@@ -0,0 +1,5 @@
+-- Detached Ed25519 signatures of release manifests made offline with
+-- cmd/manifest-sign, so the signing key never has to be on the API server.
+ALTER TABLE releases
+    ADD COLUMN manifest_signature VARCHAR(128) NULL,
+    ADD COLUMN manifest_key_id VARCHAR(32) NULL;
@@ -0,0 +1,14 @@
+-- Binary deltas between consecutive versions of a release file. A patch is
+-- identified by the hashes it goes from and to, so the same file is shared
+-- by every path and release that needs it.
+CREATE TABLE IF NOT EXISTS release_patches (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    path VARCHAR(512) NOT NULL,
+    from_hash CHAR(64) NOT NULL,
+    to_hash CHAR(64) NOT NULL,
+    size BIGINT NOT NULL,
+    sha256 CHAR(64) NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY uq_release_patches (path(255), from_hash, to_hash),
+    KEY idx_release_patches_to (to_hash)
+);
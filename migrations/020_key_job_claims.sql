@@ -0,0 +1,6 @@
+-- Key generation jobs are claimed by one server instance at a time. The
+-- claim is a lease renewed after every chunk, so a job whose instance died
+-- is picked up again by the next one that starts.
+ALTER TABLE key_generation_jobs
+    ADD COLUMN claimed_by VARCHAR(64) NULL,
+    ADD COLUMN claimed_until DATETIME NULL;
@@ -0,0 +1,6 @@
+-- One row per user and per IP that has tried to redeem a key. Redeem checks
+-- lock the rows of the caller before counting attempts, so concurrent
+-- attempts from the same user or IP are counted one after another.
+CREATE TABLE IF NOT EXISTS redeem_guard_locks (
+    scope VARCHAR(80) PRIMARY KEY
+);
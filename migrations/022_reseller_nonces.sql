@@ -0,0 +1,9 @@
+-- Nonces of signed reseller requests, kept while their timestamp is still
+-- accepted so that each request is served once.
+CREATE TABLE IF NOT EXISTS reseller_nonces (
+    api_key_id INT NOT NULL,
+    nonce VARCHAR(64) NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (api_key_id, nonce),
+    KEY idx_reseller_nonces_created (api_key_id, created_at)
+);
@@ -0,0 +1,4 @@
+-- Room for the paid_needs_refund status of orders paid after they failed or
+-- were canceled.
+ALTER TABLE orders
+    MODIFY status VARCHAR(32) NOT NULL DEFAULT 'pending';
@@ -0,0 +1,3 @@
+-- Lets the expiry job find pending orders by age.
+ALTER TABLE orders
+    ADD INDEX idx_orders_status (status, created_at);
@@ -0,0 +1,4 @@
+-- Why a referral was held for an admin to look at, e.g. both accounts using
+-- the same address, which also happens to different people behind one NAT.
+ALTER TABLE referrals
+    ADD COLUMN review_reason VARCHAR(32) NULL;
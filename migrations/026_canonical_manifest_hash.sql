@@ -0,0 +1,5 @@
+-- manifest_hash is now the SHA-256 of the canonical path/hash/size list of a
+-- release's files instead of a hash of the JSON encoding. Hashes in the old,
+-- quoted format can no longer be compared; they are cleared and recorded
+-- again the next time a release is published.
+UPDATE releases SET manifest_hash = NULL WHERE manifest_hash LIKE '"%';
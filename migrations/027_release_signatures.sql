@@ -0,0 +1,17 @@
+-- Offline signatures of release manifests, one per channel a release is
+-- served on. They cover the release version, the channel, a validity window
+-- and the files, but no URLs. Signatures over the old manifest bodies cannot
+-- be checked any more and are dropped.
+CREATE TABLE IF NOT EXISTS release_signatures (
+    release_id INT NOT NULL,
+    channel VARCHAR(32) NOT NULL,
+    signature VARCHAR(128) NOT NULL,
+    key_id VARCHAR(32) NOT NULL,
+    issued_at DATETIME NOT NULL,
+    expires_at DATETIME NOT NULL,
+    PRIMARY KEY (release_id, channel)
+);
+
+ALTER TABLE releases
+    DROP COLUMN manifest_signature,
+    DROP COLUMN manifest_key_id;
@@ -0,0 +1,6 @@
+-- Patches to a release are made in the background after it is published.
+-- patches_done_at is set once they are; older releases had theirs made
+-- while publishing.
+ALTER TABLE releases ADD COLUMN patches_done_at TIMESTAMP NULL;
+
+UPDATE releases SET patches_done_at = created_at;
@@ -0,0 +1,8 @@
+-- What each reseller may sell: key types and products as comma-separated
+-- lists, and the longest subscription key. Existing resellers keep selling
+-- global subscription keys of up to a year; lifetime and product keys have
+-- to be allowed explicitly.
+ALTER TABLE resellers
+    ADD COLUMN allowed_key_types VARCHAR(255) NOT NULL DEFAULT 'subscription',
+    ADD COLUMN allowed_product_ids VARCHAR(255) NOT NULL DEFAULT '',
+    ADD COLUMN max_duration_days INT NOT NULL DEFAULT 365;
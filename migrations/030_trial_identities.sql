@@ -0,0 +1,14 @@
+-- The HWIDs and normalized emails trials were started with, one row each.
+-- The primary key stops two accounts sharing either from both starting a
+-- trial at the same time.
+CREATE TABLE IF NOT EXISTS trial_identities (
+    kind VARCHAR(8) NOT NULL,
+    value VARCHAR(255) NOT NULL,
+    claim_id INT NOT NULL,
+    PRIMARY KEY (kind, value)
+);
+
+INSERT IGNORE INTO trial_identities (kind, value, claim_id)
+    SELECT 'hwid', hwid, MIN(id) FROM trial_claims GROUP BY hwid;
+INSERT IGNORE INTO trial_identities (kind, value, claim_id)
+    SELECT 'email', email, MIN(id) FROM trial_claims GROUP BY email;